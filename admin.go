@@ -0,0 +1,593 @@
+package tang
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwk"
+)
+
+// ErrAdminAuthNotConfigured is returned when the admin server would accept unauthenticated clients
+var ErrAdminAuthNotConfigured = errors.New("admin API requires a bearer token or verified TLS client certificates")
+
+// ErrAdminCleartext is returned when the admin server would receive bearer tokens in cleartext over the network
+var ErrAdminCleartext = errors.New("admin API without TLS has to listen on a loopback address unless insecure connections are allowed")
+
+var errKeyNotFound = errors.New("key not found")
+
+// AdminServer is an HTTP server that manages the keys of a KeyStore. It is meant to listen
+// on a separate address than the Tang server, and every request has to be authenticated either
+// with a bearer token or with a TLS client certificate.
+//
+// Endpoints:
+//
+//	GET  /keys                   list keys
+//	POST /keys                   generate a key, body {"use": "sign"|"exchange", "advertised": bool}
+//	POST /rotate                 generate new advertised keys and hide the previously advertised ones
+//	POST /keys/{thp}/advertise   advertise a hidden active key
+//	POST /keys/{thp}/hide        stop advertising a key
+//	POST /keys/{thp}/deprecate   mark a key deprecated, it still recovers existing bindings
+//	POST /keys/{thp}/revoke      mark a key revoked, it refuses recovery
+//	POST /keys/{thp}/approval    require operator approvals for recoveries, body {"required": bool}
+//	POST /keys/{thp}/validity    bound the time a key is used, body KeyValidity
+//	POST /reload                 reload the keys from the store
+//	GET  /approvals              list the recoveries waiting for a decision
+//	POST /approvals/{id}/approve allow a held recovery
+//	POST /approvals/{id}/deny    reject a held recovery
+type AdminServer struct {
+	http.Server
+	Store *KeyStore
+	// Tang receives the reloaded keys after every change, it may be nil
+	Tang *Server
+	// Token is the bearer token clients have to present. If it is empty, clients have to present
+	// a certificate verified against TLSConfig.ClientCAs.
+	Token string
+	// Insecure allows plain HTTP on addresses other than loopback, the bearer token is then sent in cleartext
+	Insecure bool
+	// Audit receives an event for every admin request, events are logged if it is nil
+	Audit func(AuditEvent)
+
+	mu sync.Mutex // serializes changes of the store
+}
+
+// AdminKey is a key as listed by the admin API
+type AdminKey struct {
+	Thumbprint string   `json:"thp"`
+	Advertised bool     `json:"advertised"`
+	State      KeyState `json:"state"`
+	// ApprovalRequired keys recover only after an operator approved the request
+	ApprovalRequired bool        `json:"approval_required,omitempty"`
+	Validity         KeyValidity `json:"validity,omitzero"`
+	Alg              string      `json:"alg,omitempty"`
+	KeyOps           []string    `json:"key_ops,omitempty"`
+	Filename         string      `json:"file"`
+}
+
+// adminChanges is the response of the endpoints that change keys
+type adminChanges struct {
+	Added  []string `json:"added,omitempty"`
+	Hidden []string `json:"hidden,omitempty"`
+	Keys   []string `json:"keys,omitempty"`
+}
+
+// adminGenerateRequest is the body of POST /keys
+type adminGenerateRequest struct {
+	Use        string `json:"use"`
+	Advertised *bool  `json:"advertised"`
+}
+
+// adminApprovalRequest is the body of POST /keys/{thp}/approval
+type adminApprovalRequest struct {
+	Required bool `json:"required"`
+}
+
+// errApprovalsDisabled is returned by the approval endpoints when the Tang server has no approval queue
+var errApprovalsDisabled = errors.New("approvals are not enabled on the server")
+
+// adminActorKey is the context key of the authenticated identity of an admin request
+type adminActorKey struct{}
+
+// NewAdminServer creates an admin server for the store that reloads the keys of the Tang server after changes
+func NewAdminServer(store *KeyStore, tang *Server) *AdminServer {
+	a := &AdminServer{Store: store, Tang: tang}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /keys", a.handle("list", a.listKeys))
+	mux.HandleFunc("POST /keys", a.handle("generate", a.generateKey))
+	mux.HandleFunc("POST /rotate", a.handle("rotate", a.rotateKeys))
+	mux.HandleFunc("POST /keys/{thp}/advertise", a.handle("advertise", a.setKeyAdvertised(true)))
+	mux.HandleFunc("POST /keys/{thp}/hide", a.handle("hide", a.setKeyAdvertised(false)))
+	mux.HandleFunc("POST /keys/{thp}/deprecate", a.handle("deprecate", a.setKeyState(KeyStateDeprecated)))
+	mux.HandleFunc("POST /keys/{thp}/revoke", a.handle("revoke", a.setKeyState(KeyStateRevoked)))
+	mux.HandleFunc("POST /keys/{thp}/approval", a.handle("set-approval", a.setKeyApproval))
+	mux.HandleFunc("POST /keys/{thp}/validity", a.handle("set-validity", a.setKeyValidity))
+	mux.HandleFunc("POST /reload", a.handle("reload", a.reloadKeys))
+	mux.HandleFunc("GET /approvals", a.handle("list-approvals", a.listApprovals))
+	mux.HandleFunc("POST /approvals/{id}/approve", a.handle("approve", a.decideApproval(ApprovalApproved)))
+	mux.HandleFunc("POST /approvals/{id}/deny", a.handle("deny", a.decideApproval(ApprovalDenied)))
+	a.Handler = mux
+
+	return a
+}
+
+// ListenAndServe listens on Addr, with TLS if TLSConfig is set. Without TLS only loopback addresses are
+// accepted, unless Insecure is set.
+func (a *AdminServer) ListenAndServe() error {
+	if err := a.checkAuth(); err != nil {
+		return err
+	}
+	addr := a.Addr
+	if addr == "" {
+		addr = ":8443"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return a.Serve(l)
+}
+
+// Serve accepts admin requests on the listener, with TLS if TLSConfig is set. Without TLS the listener
+// has to be on a loopback address, unless Insecure is set.
+func (a *AdminServer) Serve(l net.Listener) error {
+	if err := a.checkAuth(); err != nil {
+		_ = l.Close()
+		return err
+	}
+	if a.TLSConfig == nil && !a.Insecure && !isLoopback(l.Addr()) {
+		_ = l.Close()
+		return ErrAdminCleartext
+	}
+	if a.TLSConfig != nil {
+		return a.Server.ServeTLS(l, "", "")
+	}
+	return a.Server.Serve(l)
+}
+
+func (a *AdminServer) checkAuth() error {
+	if a.Token != "" {
+		return nil
+	}
+	if a.TLSConfig != nil && a.TLSConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+		return nil
+	}
+	return ErrAdminAuthNotConfigured
+}
+
+func isLoopback(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	return ok && tcp.IP.IsLoopback()
+}
+
+// adminHandler handles an authenticated admin request. It returns the keys affected by the request
+// for the audit event; an error is reported to the client with the given status, or 500 if it is zero.
+type adminHandler func(w http.ResponseWriter, req *http.Request) (keys []string, status int, err error)
+
+func (a *AdminServer) handle(action string, h adminHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		event := AuditEvent{
+			Time:   time.Now().UTC(),
+			Remote: req.RemoteAddr,
+			Action: action,
+			Result: AuditOK,
+		}
+		defer func() { a.audit(event) }()
+
+		actor, ok := a.authenticate(req)
+		if !ok {
+			event.Result = AuditDenied
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		event.Actor = actor
+
+		req = req.WithContext(context.WithValue(req.Context(), adminActorKey{}, actor))
+		keys, status, err := h(w, req)
+		event.Keys = keys
+		if err != nil {
+			event.Result = AuditFailed
+			event.Error = err.Error()
+			if status == 0 {
+				// the response could not be encoded, nothing has been written yet
+				status = http.StatusInternalServerError
+			}
+			http.Error(w, err.Error(), status)
+		}
+	}
+}
+
+func (a *AdminServer) audit(e AuditEvent) {
+	countRequest("admin."+e.Action, e.Result)
+	if a.Audit != nil {
+		a.Audit(e)
+	} else {
+		logAuditEvent(e)
+	}
+}
+
+// authenticate returns the identity of the client, preferring a verified client certificate over the token
+func (a *AdminServer) authenticate(req *http.Request) (string, bool) {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return "cert:" + req.TLS.VerifiedChains[0][0].Subject.CommonName, true
+	}
+	if a.Token == "" {
+		return "", false
+	}
+	token, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+		return "", false
+	}
+	return "token", true
+}
+
+func (a *AdminServer) listKeys(w http.ResponseWriter, _ *http.Request) ([]string, int, error) {
+	stored, err := a.Store.Keys()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	keys := []AdminKey{}
+	for _, s := range stored {
+		k := AdminKey{
+			Thumbprint:       s.Thumbprint,
+			Advertised:       s.Advertised,
+			State:            s.State,
+			ApprovalRequired: s.ApprovalRequired,
+			Validity:         s.Validity,
+			Filename:         s.Filename,
+		}
+		if alg, ok := s.Algorithm(); ok {
+			k.Alg = alg.String()
+		}
+		if ops, ok := s.KeyOps(); ok {
+			for _, op := range ops {
+				k.KeyOps = append(k.KeyOps, string(op))
+			}
+		}
+		keys = append(keys, k)
+	}
+	return nil, 0, writeJSON(w, http.StatusOK, keys)
+}
+
+func (a *AdminServer) generateKey(w http.ResponseWriter, req *http.Request) ([]string, int, error) {
+	var r adminGenerateRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 4096)).Decode(&r); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err)
+	}
+	var gen func() (jwk.Key, error)
+	switch r.Use {
+	case "sign":
+		gen = GenerateVerifyKey
+	case "exchange":
+		gen = GenerateExchangeKey
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("use has to be 'sign' or 'exchange'")
+	}
+	advertised := r.Advertised == nil || *r.Advertised
+
+	key, err := gen()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.check(func(keys []StoredKey) ([]StoredKey, error) {
+		return append(keys, StoredKey{Key: key, Advertised: advertised}), nil
+	}); err != nil {
+		return nil, http.StatusConflict, err
+	}
+	thp, err := a.Store.Put(key, advertised)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if err := a.reload(); err != nil {
+		return []string{thp}, http.StatusInternalServerError, err
+	}
+	return []string{thp}, 0, writeJSON(w, http.StatusCreated, adminChanges{Added: []string{thp}})
+}
+
+// rotateKeys generates a new sign and exchange key and hides all previously advertised keys,
+// the hidden keys keep recovering existing bindings
+func (a *AdminServer) rotateKeys(w http.ResponseWriter, _ *http.Request) ([]string, int, error) {
+	sig, err := GenerateVerifyKey()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	exc, err := GenerateExchangeKey()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stored, err := a.Store.Keys()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	var changes adminChanges
+	for _, key := range []jwk.Key{sig, exc} {
+		thp, err := a.Store.Put(key, true)
+		if err != nil {
+			return changes.Added, http.StatusInternalServerError, err
+		}
+		changes.Added = append(changes.Added, thp)
+	}
+	for _, s := range stored {
+		if !s.Advertised || slices.Contains(changes.Hidden, s.Thumbprint) {
+			continue
+		}
+		if err := a.Store.SetAdvertised(s.Thumbprint, false); err != nil {
+			return append(changes.Added, changes.Hidden...), http.StatusInternalServerError, err
+		}
+		changes.Hidden = append(changes.Hidden, s.Thumbprint)
+	}
+
+	affected := append(slices.Clone(changes.Added), changes.Hidden...)
+	if err := a.reload(); err != nil {
+		return affected, http.StatusInternalServerError, err
+	}
+	return affected, 0, writeJSON(w, http.StatusOK, changes)
+}
+
+func (a *AdminServer) setKeyAdvertised(advertised bool) adminHandler {
+	return func(w http.ResponseWriter, req *http.Request) ([]string, int, error) {
+		thp := req.PathValue("thp")
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		if err := a.check(func(keys []StoredKey) ([]StoredKey, error) {
+			return updateStoredKey(keys, thp, func(k *StoredKey) error {
+				if advertised && k.State != KeyStateActive {
+					return fmt.Errorf("key %s is %s and cannot be advertised", thp, k.State)
+				}
+				k.Advertised = advertised
+				return nil
+			})
+		}); err != nil {
+			return []string{thp}, checkStatus(err), err
+		}
+		if err := a.Store.SetAdvertised(thp, advertised); err != nil {
+			return []string{thp}, http.StatusInternalServerError, err
+		}
+		if err := a.reload(); err != nil {
+			return []string{thp}, http.StatusInternalServerError, err
+		}
+		return []string{thp}, 0, writeJSON(w, http.StatusOK, adminChanges{Keys: []string{thp}})
+	}
+}
+
+func (a *AdminServer) setKeyState(state KeyState) adminHandler {
+	return func(w http.ResponseWriter, req *http.Request) ([]string, int, error) {
+		thp := req.PathValue("thp")
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		if err := a.check(func(keys []StoredKey) ([]StoredKey, error) {
+			return updateStoredKey(keys, thp, func(k *StoredKey) error {
+				if k.State == KeyStateRevoked {
+					return fmt.Errorf("key %s is already revoked", thp)
+				}
+				key, err := k.Clone()
+				if err != nil {
+					return err
+				}
+				if err := setKeyState(key, state); err != nil {
+					return err
+				}
+				k.Key, k.State, k.Advertised = key, state, false
+				return nil
+			})
+		}); err != nil {
+			return []string{thp}, checkStatus(err), err
+		}
+		if err := a.Store.SetState(thp, state); err != nil {
+			return []string{thp}, http.StatusInternalServerError, err
+		}
+		if err := a.reload(); err != nil {
+			return []string{thp}, http.StatusInternalServerError, err
+		}
+		return []string{thp}, 0, writeJSON(w, http.StatusOK, adminChanges{Keys: []string{thp}})
+	}
+}
+
+func (a *AdminServer) setKeyApproval(w http.ResponseWriter, req *http.Request) ([]string, int, error) {
+	thp := req.PathValue("thp")
+	var r adminApprovalRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 4096)).Decode(&r); err != nil {
+		return []string{thp}, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.check(func(keys []StoredKey) ([]StoredKey, error) {
+		return updateStoredKey(keys, thp, func(k *StoredKey) error {
+			k.ApprovalRequired = r.Required
+			return nil
+		})
+	}); err != nil {
+		return []string{thp}, checkStatus(err), err
+	}
+	if err := a.Store.SetApprovalRequired(thp, r.Required); err != nil {
+		return []string{thp}, http.StatusInternalServerError, err
+	}
+	if err := a.reload(); err != nil {
+		return []string{thp}, http.StatusInternalServerError, err
+	}
+	return []string{thp}, 0, writeJSON(w, http.StatusOK, adminChanges{Keys: []string{thp}})
+}
+
+func (a *AdminServer) setKeyValidity(w http.ResponseWriter, req *http.Request) ([]string, int, error) {
+	thp := req.PathValue("thp")
+	var v KeyValidity
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 4096)).Decode(&v); err != nil {
+		return []string{thp}, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.check(func(keys []StoredKey) ([]StoredKey, error) {
+		return updateStoredKey(keys, thp, func(k *StoredKey) error {
+			key, err := k.Clone()
+			if err != nil {
+				return err
+			}
+			if err := setKeyValidity(key, v); err != nil {
+				return err
+			}
+			k.Key = key
+			return nil
+		})
+	}); err != nil {
+		return []string{thp}, checkStatus(err), err
+	}
+	if err := a.Store.SetValidity(thp, v); err != nil {
+		return []string{thp}, http.StatusInternalServerError, err
+	}
+	if err := a.reload(); err != nil {
+		return []string{thp}, http.StatusInternalServerError, err
+	}
+	return []string{thp}, 0, writeJSON(w, http.StatusOK, adminChanges{Keys: []string{thp}})
+}
+
+func (a *AdminServer) listApprovals(w http.ResponseWriter, _ *http.Request) ([]string, int, error) {
+	q := a.approvals()
+	if q == nil {
+		return nil, http.StatusNotFound, errApprovalsDisabled
+	}
+	return nil, 0, writeJSON(w, http.StatusOK, q.Requests())
+}
+
+func (a *AdminServer) decideApproval(status ApprovalStatus) adminHandler {
+	return func(w http.ResponseWriter, req *http.Request) ([]string, int, error) {
+		q := a.approvals()
+		if q == nil {
+			return nil, http.StatusNotFound, errApprovalsDisabled
+		}
+
+		decide := q.Approve
+		if status == ApprovalDenied {
+			decide = q.Deny
+		}
+		actor, _ := req.Context().Value(adminActorKey{}).(string)
+		r, err := decide(req.PathValue("id"), actor)
+		var keys []string
+		if r.Thumbprint != "" {
+			keys = []string{r.Thumbprint}
+		}
+		switch {
+		case errors.Is(err, ErrApprovalNotFound):
+			return keys, http.StatusNotFound, err
+		case err != nil:
+			return keys, http.StatusConflict, err
+		}
+		return keys, 0, writeJSON(w, http.StatusOK, r)
+	}
+}
+
+func (a *AdminServer) approvals() *ApprovalQueue {
+	if a.Tang == nil {
+		return nil
+	}
+	return a.Tang.Approvals
+}
+
+func (a *AdminServer) reloadKeys(w http.ResponseWriter, _ *http.Request) ([]string, int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.reload(); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return nil, 0, writeJSON(w, http.StatusOK, adminChanges{})
+}
+
+// check verifies that the store still yields a servable key set after the change,
+// so a request can not leave the Tang server without advertised keys
+func (a *AdminServer) check(change func([]StoredKey) ([]StoredKey, error)) error {
+	keys, err := a.Store.Keys()
+	if err != nil {
+		return err
+	}
+	if keys, err = change(keys); err != nil {
+		return err
+	}
+
+	ks := NewKeySet()
+	ks.RejectDuplicates = a.Store.RejectDuplicates
+	for _, k := range keys {
+		if err := ks.AppendKey(k.Key, k.Advertised); err != nil {
+			return err
+		}
+	}
+	if err := ks.RecomputeAdvertisements(); err != nil {
+		return fmt.Errorf("the change leaves the server without usable keys: %v", err)
+	}
+	return nil
+}
+
+func (a *AdminServer) reload() error {
+	ks, err := a.Store.Load()
+	if err != nil {
+		return err
+	}
+	if a.Tang != nil {
+		a.Tang.SetKeys(ks)
+	}
+	return nil
+}
+
+// updateStoredKey applies the update to every entry of the key with the given thumbprint
+func updateStoredKey(keys []StoredKey, thp string, update func(k *StoredKey) error) ([]StoredKey, error) {
+	found := false
+	for i := range keys {
+		if keys[i].Thumbprint != thp {
+			continue
+		}
+		if err := update(&keys[i]); err != nil {
+			return nil, err
+		}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %s", errKeyNotFound, thp)
+	}
+	return keys, nil
+}
+
+// checkStatus maps an error of a rejected change to the HTTP status
+func checkStatus(err error) int {
+	if errors.Is(err, errKeyNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusConflict
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(data, '\n'))
+	return nil
+}
@@ -0,0 +1,269 @@
+package tang
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jws"
+	"github.com/stretchr/testify/require"
+)
+
+type adminTestClient struct {
+	t      *testing.T
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (c *adminTestClient) do(method, path, body string) (int, []byte) {
+	req, err := http.NewRequest(method, c.url+path, strings.NewReader(body))
+	require.NoError(c.t, err)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	client := c.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	require.NoError(c.t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(c.t, err)
+	return resp.StatusCode, data
+}
+
+func startAdminServer(t *testing.T) (*AdminServer, *Server, *adminTestClient, *[]AuditEvent) {
+	s, _ := createTestStore(t)
+	ks, err := s.Load()
+	require.NoError(t, err)
+	srv := NewServer()
+	srv.Keys = ks
+
+	var mu sync.Mutex
+	var events []AuditEvent
+	admin := NewAdminServer(s, srv)
+	admin.Token = "admin token"
+	admin.Audit = func(e AuditEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}
+
+	ts := httptest.NewServer(admin.Handler)
+	t.Cleanup(ts.Close)
+	return admin, srv, &adminTestClient{t: t, url: ts.URL, token: admin.Token}, &events
+}
+
+func advertisedThumbprints(t *testing.T, ks *KeySet) []string {
+	msg, err := jws.Parse(ks.DefaultAdvertisement)
+	require.NoError(t, err)
+	set, err := jwk.Parse(msg.Payload())
+	require.NoError(t, err)
+	var thps []string
+	for i := range set.Len() {
+		k, _ := set.Key(i)
+		thp, err := thumbprint(k, ThumbprintHash)
+		require.NoError(t, err)
+		thps = append(thps, thp)
+	}
+	return thps
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	t.Parallel()
+
+	_, _, client, events := startAdminServer(t)
+
+	client.token = ""
+	status, _ := client.do("GET", "/keys", "")
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	client.token = "wrong"
+	status, _ = client.do("POST", "/rotate", "")
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	require.Len(t, *events, 2)
+	require.Equal(t, AuditDenied, (*events)[1].Result)
+	require.Equal(t, "rotate", (*events)[1].Action)
+	require.Empty(t, (*events)[1].Actor)
+
+	admin := NewAdminServer(NewKeyStore(t.TempDir()), nil)
+	require.ErrorIs(t, admin.ListenAndServe(), ErrAdminAuthNotConfigured)
+
+	// without TLS the token may only be sent over loopback, unless that is explicitly allowed
+	admin.Token = "admin token"
+	l, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	require.ErrorIs(t, admin.Serve(l), ErrAdminCleartext)
+	for _, insecure := range []bool{false, true} {
+		admin := NewAdminServer(NewKeyStore(t.TempDir()), nil)
+		admin.Token, admin.Insecure = "admin token", insecure
+		addr := "127.0.0.1:0"
+		if insecure {
+			addr = ":0"
+		}
+		l, err := net.Listen("tcp", addr)
+		require.NoError(t, err)
+		errCh := make(chan error, 1)
+		go func() { errCh <- admin.Serve(l) }()
+		require.NoError(t, admin.Close())
+		require.ErrorIs(t, <-errCh, http.ErrServerClosed)
+	}
+}
+
+func TestAdminResponseError(t *testing.T) {
+	t.Parallel()
+
+	admin := NewAdminServer(NewKeyStore(t.TempDir()), nil)
+	admin.Token = "admin token"
+	var events []AuditEvent
+	admin.Audit = func(e AuditEvent) { events = append(events, e) }
+	h := admin.handle("list", func(http.ResponseWriter, *http.Request) ([]string, int, error) {
+		return nil, 0, errors.New("unable to encode the response")
+	})
+
+	req := httptest.NewRequest("GET", "/keys", nil)
+	req.Header.Set("Authorization", "Bearer "+admin.Token)
+	w := httptest.NewRecorder()
+	h(w, req)
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.Len(t, events, 1)
+	require.Equal(t, AuditFailed, events[0].Result)
+}
+
+func TestAdminKeyLifecycle(t *testing.T) {
+	t.Parallel()
+
+	admin, srv, client, events := startAdminServer(t)
+
+	status, data := client.do("GET", "/keys", "")
+	require.Equal(t, http.StatusOK, status)
+	var keys []AdminKey
+	require.NoError(t, json.Unmarshal(data, &keys))
+	require.Len(t, keys, 3)
+
+	var signThp, exchangeThp, hiddenThp string
+	for _, k := range keys {
+		switch {
+		case k.Alg == "ES512":
+			signThp = k.Thumbprint
+		case k.Advertised:
+			exchangeThp = k.Thumbprint
+		default:
+			hiddenThp = k.Thumbprint
+		}
+		require.Equal(t, KeyStateActive, k.State)
+	}
+
+	// a new exchange key is advertised right away
+	status, data = client.do("POST", "/keys", `{"use": "exchange"}`)
+	require.Equal(t, http.StatusCreated, status, string(data))
+	var changes adminChanges
+	require.NoError(t, json.Unmarshal(data, &changes))
+	require.Len(t, changes.Added, 1)
+	generatedThp := changes.Added[0]
+	require.Contains(t, advertisedThumbprints(t, srv.keySet()), generatedThp)
+
+	// the only sign key cannot be hidden
+	status, _ = client.do("POST", "/keys/"+signThp+"/hide", "")
+	require.Equal(t, http.StatusConflict, status)
+	require.True(t, storeState(t, admin.Store)[signThp])
+
+	status, _ = client.do("POST", "/keys/unknown/hide", "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	// deprecated keys are hidden but still recover
+	status, _ = client.do("POST", "/keys/"+exchangeThp+"/deprecate", "")
+	require.Equal(t, http.StatusOK, status)
+	require.NotContains(t, advertisedThumbprints(t, srv.keySet()), exchangeThp)
+	_, err := srv.keySet().RecoverKey(exchangeThp, thresholdTestRequest(t))
+	require.NoError(t, err)
+
+	// revoked keys refuse recovery
+	status, _ = client.do("POST", "/keys/"+hiddenThp+"/revoke", "")
+	require.Equal(t, http.StatusOK, status)
+	_, err = srv.keySet().RecoverKey(hiddenThp, thresholdTestRequest(t))
+	require.ErrorIs(t, err, ErrKeyRevoked)
+
+	status, _ = client.do("POST", "/keys/"+hiddenThp+"/advertise", "")
+	require.Equal(t, http.StatusConflict, status)
+
+	// the state survives a reload from disk
+	status, _ = client.do("POST", "/reload", "")
+	require.Equal(t, http.StatusOK, status)
+	stored, err := admin.Store.Keys()
+	require.NoError(t, err)
+	for _, s := range stored {
+		switch s.Thumbprint {
+		case exchangeThp:
+			require.Equal(t, KeyStateDeprecated, s.State)
+		case hiddenThp:
+			require.Equal(t, KeyStateRevoked, s.State)
+		}
+	}
+	_, err = srv.keySet().RecoverKey(hiddenThp, thresholdTestRequest(t))
+	require.ErrorIs(t, err, ErrKeyRevoked)
+
+	// rotation replaces all advertised keys
+	status, data = client.do("POST", "/rotate", "")
+	require.Equal(t, http.StatusOK, status)
+	changes = adminChanges{}
+	require.NoError(t, json.Unmarshal(data, &changes))
+	require.Len(t, changes.Added, 2)
+	require.ElementsMatch(t, []string{signThp, generatedThp}, changes.Hidden)
+	require.ElementsMatch(t, changes.Added, advertisedThumbprints(t, srv.keySet()))
+
+	for _, e := range *events {
+		require.Equal(t, "token", e.Actor)
+	}
+	last := (*events)[len(*events)-1]
+	require.Equal(t, "rotate", last.Action)
+	require.Equal(t, AuditOK, last.Result)
+	require.Len(t, last.Keys, 4)
+}
+
+func TestAdminClientCertificate(t *testing.T) {
+	t.Parallel()
+
+	s, _ := createTestStore(t)
+	serverCert := generateTestCertificate(t)
+	clientCert := generateTestCertificate(t)
+	cas := x509.NewCertPool()
+	cas.AddCert(clientCert.Leaf)
+
+	var events []AuditEvent
+	admin := NewAdminServer(s, nil)
+	admin.Audit = func(e AuditEvent) { events = append(events, e) }
+	ts := httptest.NewUnstartedServer(admin.Handler)
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    cas,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert.Leaf)
+	client := &adminTestClient{t: t, url: ts.URL, client: &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "remote",
+			Certificates: []tls.Certificate{clientCert},
+		},
+	}}}
+	status, _ := client.do("GET", "/keys", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "cert:remote", events[0].Actor)
+}
@@ -0,0 +1,171 @@
+package tang
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jws"
+)
+
+// AdvertisementFormat is a JWS serialization of an advertisement
+type AdvertisementFormat string
+
+const (
+	// AdvertisementGeneral is the JSON serialization with a signature per sign key, clevis expects it
+	AdvertisementGeneral AdvertisementFormat = "general"
+	// AdvertisementFlattened is the flattened JSON serialization with the signature of a single key
+	AdvertisementFlattened AdvertisementFormat = "flattened"
+	// AdvertisementCompact is the compact serialization with the signature of a single key
+	AdvertisementCompact AdvertisementFormat = "compact"
+)
+
+// ParseAdvertisementFormat parses the name of an advertisement format
+func ParseAdvertisementFormat(s string) (AdvertisementFormat, error) {
+	switch f := AdvertisementFormat(s); f {
+	case AdvertisementGeneral, AdvertisementFlattened, AdvertisementCompact:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown advertisement format %q, expected general, flattened or compact", s)
+	}
+}
+
+// ContentType returns the media type of the format
+func (f AdvertisementFormat) ContentType() string {
+	if f == AdvertisementCompact {
+		return "application/jose"
+	}
+	return "application/jose+json"
+}
+
+// serialization is an advertisement in one format together with its entity tag
+type serialization struct {
+	data []byte
+	etag string
+}
+
+// negotiateAdvertisementFormat picks the format of an advertisement. The "format" query parameter takes
+// precedence, otherwise the Accept header selects compact with application/jose. Anything else gets
+// the general serialization, so existing clients keep working.
+func negotiateAdvertisementFormat(req *http.Request) (AdvertisementFormat, error) {
+	if format := req.URL.Query().Get("format"); format != "" {
+		return ParseAdvertisementFormat(format)
+	}
+
+	format, quality := AdvertisementGeneral, 0.0
+	for _, r := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(r)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		var f AdvertisementFormat
+		switch mediaType {
+		case "application/jose":
+			f = AdvertisementCompact
+		case "application/jose+json", "application/json", "application/*", "*/*":
+			f = AdvertisementGeneral
+		default:
+			continue
+		}
+		if q > quality {
+			format, quality = f, q
+		}
+	}
+	return format, nil
+}
+
+// signSingle returns the flattened and compact serializations of the payload signed by the key
+func signSingle(payload []byte, key jwk.Key) (serialization, serialization, error) {
+	option, err := signOption(key)
+	if err != nil {
+		return serialization{}, serialization{}, err
+	}
+	compact, err := jws.Sign(payload, option)
+	if err != nil {
+		return serialization{}, serialization{}, err
+	}
+
+	// both serializations share the signature, the flattened one is assembled from the compact parts
+	protected, encodedPayload, signature, err := compactParts(compact)
+	if err != nil {
+		return serialization{}, serialization{}, err
+	}
+	flattened, err := json.Marshal(map[string]string{
+		"protected": protected,
+		"payload":   encodedPayload,
+		"signature": signature,
+	})
+	if err != nil {
+		return serialization{}, serialization{}, err
+	}
+	return serialization{flattened, advertisementETag(flattened)}, serialization{compact, advertisementETag(compact)}, nil
+}
+
+// serialized returns the advertisement of the sign key in the format, data is nil if the key has none
+func (k *tangKey) serialized(format AdvertisementFormat) serialization {
+	switch format {
+	case AdvertisementFlattened:
+		return k.flattened
+	case AdvertisementCompact:
+		return k.compact
+	default:
+		return serialization{k.advertisement, k.etag}
+	}
+}
+
+// VerifyAdvertisement checks the signatures of an advertisement in any of the formats and returns the advertised
+// keys. Like clevis, it requires a valid signature of every advertised verify key, ES512 and EdDSA keys alike.
+// Flattened and compact advertisements carry a single signature, it has to be made by one of them.
+func VerifyAdvertisement(data []byte) (jwk.Set, error) {
+	msg, err := jws.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	set, err := jwk.Parse(msg.Payload())
+	if err != nil {
+		return nil, err
+	}
+
+	var general struct {
+		Signatures json.RawMessage `json:"signatures"`
+	}
+	single := json.Unmarshal(data, &general) != nil || general.Signatures == nil
+	var verified int
+	for i := range set.Len() {
+		key, _ := set.Key(i)
+		if !keyValidForUse(key, []jwk.KeyOperation{jwk.KeyOpVerify}) {
+			continue
+		}
+		alg, ok := key.Algorithm()
+		if !ok {
+			return nil, fmt.Errorf("verify key without an algorithm")
+		}
+		signAlg, ok := alg.(jwa.SignatureAlgorithm)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a signature algorithm", alg)
+		}
+		if _, err := jws.Verify(data, jws.WithKey(signAlg, key)); err != nil {
+			if single {
+				continue
+			}
+			thp, _ := thumbprint(key, ThumbprintHash)
+			return nil, fmt.Errorf("advertisement is not signed by verify key %s: %w", thp, err)
+		}
+		verified++
+	}
+	if verified == 0 {
+		return nil, fmt.Errorf("advertisement is not signed by any of its verify keys")
+	}
+	return set, nil
+}
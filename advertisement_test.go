@@ -0,0 +1,172 @@
+package tang
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jws"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateAdvertisementFormat(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		query  string
+		accept string
+		format AdvertisementFormat
+		err    bool
+	}{
+		{"", "", AdvertisementGeneral, false},
+		{"", "*/*", AdvertisementGeneral, false},
+		{"", "application/jose+json", AdvertisementGeneral, false},
+		{"", "application/jose", AdvertisementCompact, false},
+		{"", "text/html, application/jose", AdvertisementCompact, false},
+		{"", "application/jose;q=0.5, application/jose+json", AdvertisementGeneral, false},
+		{"", "application/jose+json;q=0.1, application/jose;q=0.9", AdvertisementCompact, false},
+		{"", "text/plain", AdvertisementGeneral, false},
+		{"format=flattened", "", AdvertisementFlattened, false},
+		{"format=compact", "application/jose+json", AdvertisementCompact, false},
+		{"format=general", "application/jose", AdvertisementGeneral, false},
+		{"format=yaml", "", "", true},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/adv?"+test.query, nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		format, err := negotiateAdvertisementFormat(req)
+		if test.err {
+			require.Error(t, err, test.query)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, test.format, format, "query %q accept %q", test.query, test.accept)
+	}
+}
+
+func TestAdvertisementFormats(t *testing.T) {
+	t.Parallel()
+
+	keys, err := ReadKeys("testdata/keys")
+	require.NoError(t, err)
+	srv := NewServer()
+	srv.Keys = keys
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	get := func(path, accept string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		require.NoError(t, err)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, data
+	}
+	verify := func(data []byte, key *tangKey) {
+		pub, err := key.PublicKey()
+		require.NoError(t, err)
+		alg, _ := key.Algorithm()
+		payload, err := jws.Verify(data, jws.WithKey(alg.(jwa.SignatureAlgorithm), pub))
+		require.NoError(t, err)
+		set, err := jwk.Parse(payload)
+		require.NoError(t, err)
+		require.NotZero(t, set.Len())
+	}
+
+	resp, general := get("/adv", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	msg, err := jws.Parse(general)
+	require.NoError(t, err)
+	// testdata has two sign keys, the general serialization carries both signatures
+	require.Len(t, msg.Signatures(), 2)
+	require.Contains(t, resp.Header.Get("Vary"), "Accept")
+
+	resp, compact := get("/adv", "application/jose")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/jose", resp.Header.Get("Content-Type"))
+	require.Len(t, strings.Split(string(compact), "."), 3)
+	require.NotEqual(t, keys.defaultETag, resp.Header.Get("ETag"))
+	verify(compact, keys.defaultSigner)
+
+	resp, flattened := get("/adv?format=flattened", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/jose+json", resp.Header.Get("Content-Type"))
+	var fields map[string]string
+	require.NoError(t, json.Unmarshal(flattened, &fields))
+	require.Contains(t, fields, "signature")
+	require.NotContains(t, fields, "signatures")
+	verify(flattened, keys.defaultSigner)
+
+	// the single-signature formats of a key are signed by that key
+	for thp, k := range keys.byThumbprint {
+		if !keyValidForUse(k, []jwk.KeyOperation{jwk.KeyOpSign}) {
+			resp, _ = get("/adv/"+thp+"?format=compact", "")
+			require.Equal(t, http.StatusNotFound, resp.StatusCode)
+			continue
+		}
+		resp, data := get("/adv/"+thp+"?format=compact", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		verify(data, k)
+	}
+
+	resp, _ = get("/adv?format=yaml", "")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestAdvertisementGeneralSingleSignKey(t *testing.T) {
+	t.Parallel()
+
+	vk, err := GenerateVerifyKey()
+	require.NoError(t, err)
+	ek, err := GenerateExchangeKey()
+	require.NoError(t, err)
+	keys := NewKeySet()
+	require.NoError(t, keys.AppendKey(vk, true))
+	require.NoError(t, keys.AppendKey(ek, true))
+	require.NoError(t, keys.RecomputeAdvertisements())
+	srv := NewServer()
+	srv.Keys = keys
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	thp, err := thumbprint(vk, ThumbprintHash)
+	require.NoError(t, err)
+	for _, path := range []string{"/adv", "/adv?format=general", "/adv/" + thp} {
+		resp, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, path)
+
+		// a single signature is still served in the general serialization clevis expects
+		var general struct {
+			Payload    string `json:"payload"`
+			Signatures []struct {
+				Protected string `json:"protected"`
+				Signature string `json:"signature"`
+			} `json:"signatures"`
+			Signature *string `json:"signature"`
+		}
+		require.NoError(t, json.Unmarshal(data, &general), path)
+		require.NotEmpty(t, general.Payload, path)
+		require.Len(t, general.Signatures, 1, path)
+		require.Nil(t, general.Signature, path)
+
+		set, err := VerifyAdvertisement(data)
+		require.NoError(t, err, path)
+		require.Equal(t, 2, set.Len(), path)
+	}
+}
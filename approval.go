@@ -0,0 +1,281 @@
+package tang
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ApprovalTokenHeader is the request header a client repeats its recovery with after it got 202 Accepted
+	ApprovalTokenHeader = "Tang-Approval-Token"
+	// DefaultApprovalWindow is the default time an approved recovery stays valid
+	DefaultApprovalWindow = 5 * time.Minute
+	// DefaultApprovalTimeout is the default time a recovery waits for an operator decision
+	DefaultApprovalTimeout = time.Hour
+	// DefaultMaxPendingApprovals is the default number of recoveries that may wait for a decision
+	DefaultMaxPendingApprovals = 100
+	// DefaultMaxPendingApprovalsPerRemote is the default number of waiting recoveries of a single client address
+	DefaultMaxPendingApprovalsPerRemote = 10
+	// approvalRetryAfter is the retry interval suggested to clients waiting for an approval
+	approvalRetryAfter = 5 * time.Second
+)
+
+// ApprovalStatus is the state of a recovery waiting for an operator
+type ApprovalStatus string
+
+const (
+	ApprovalPending  ApprovalStatus = "pending"
+	ApprovalApproved ApprovalStatus = "approved"
+	ApprovalDenied   ApprovalStatus = "denied"
+)
+
+var (
+	// ErrApprovalRequired is returned when a key that needs an approval is used where approvals are not possible
+	ErrApprovalRequired = errors.New("key requires an operator approval")
+	// ErrApprovalNotFound is returned for unknown or expired approval tokens
+	ErrApprovalNotFound = errors.New("approval request not found or expired")
+	// ErrApprovalDecided is returned when an operator decides a request that is not pending anymore
+	ErrApprovalDecided = errors.New("approval request is already decided")
+	// ErrApprovalQueueFull is returned when too many recoveries wait for a decision
+	ErrApprovalQueueFull = errors.New("too many recoveries wait for an approval")
+	// ErrTooManyApprovalRequests is returned when too many recoveries of a client address wait for a decision
+	ErrTooManyApprovalRequests = errors.New("too many recoveries of the client wait for an approval")
+)
+
+// ApprovalRequest is a recovery held until an operator approves or denies it
+type ApprovalRequest struct {
+	// ID is the retry token of the client
+	ID         string         `json:"id"`
+	Thumbprint string         `json:"thp"`
+	Remote     string         `json:"remote"`
+	Created    time.Time      `json:"created"`
+	Status     ApprovalStatus `json:"status"`
+	// DecidedBy identifies the operator that approved or denied the request
+	DecidedBy string    `json:"decided_by,omitempty"`
+	Decided   time.Time `json:"decided,omitzero"`
+	// Expires is the end of the approval window once approved, until then the time the request is dropped
+	Expires time.Time `json:"expires"`
+
+	// digest binds the approval to the exchange key of the original request
+	digest [sha256.Size]byte
+}
+
+// ApprovalQueue holds the recoveries of keys marked as approval-required. The queue lives in memory,
+// pending requests are lost on restart and the clients have to ask again.
+type ApprovalQueue struct {
+	// Window is the time an approved recovery stays valid
+	Window time.Duration
+	// Timeout is the time a request waits for a decision
+	Timeout time.Duration
+	// MaxPending and MaxPendingPerRemote bound the requests waiting for a decision, in total and per client address
+	MaxPending          int
+	MaxPendingPerRemote int
+
+	mu       sync.Mutex
+	requests map[string]*ApprovalRequest
+}
+
+// NewApprovalQueue creates a queue with the default window, timeout and limits
+func NewApprovalQueue() *ApprovalQueue {
+	return &ApprovalQueue{
+		Window:              DefaultApprovalWindow,
+		Timeout:             DefaultApprovalTimeout,
+		MaxPending:          DefaultMaxPendingApprovals,
+		MaxPendingPerRemote: DefaultMaxPendingApprovalsPerRemote,
+	}
+}
+
+// Requests returns the requests that are not expired, oldest first
+func (q *ApprovalQueue) Requests() []ApprovalRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expire(time.Now())
+
+	list := make([]ApprovalRequest, 0, len(q.requests))
+	for _, r := range q.requests {
+		list = append(list, *r)
+	}
+	slices.SortFunc(list, func(a, b ApprovalRequest) int { return a.Created.Compare(b.Created) })
+	return list
+}
+
+// Approve allows the recovery, the client has to retry within the approval window
+func (q *ApprovalQueue) Approve(id, operator string) (ApprovalRequest, error) {
+	return q.decide(id, operator, ApprovalApproved)
+}
+
+// Deny rejects the recovery
+func (q *ApprovalQueue) Deny(id, operator string) (ApprovalRequest, error) {
+	return q.decide(id, operator, ApprovalDenied)
+}
+
+func (q *ApprovalQueue) decide(id, operator string, status ApprovalStatus) (ApprovalRequest, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	q.expire(now)
+
+	r, ok := q.requests[id]
+	if !ok {
+		return ApprovalRequest{}, ErrApprovalNotFound
+	}
+	if r.Status != ApprovalPending {
+		return *r, ErrApprovalDecided
+	}
+	r.Status, r.DecidedBy, r.Decided = status, operator, now.UTC()
+	if status == ApprovalApproved {
+		r.Expires = r.Decided.Add(q.window())
+	}
+	return *r, nil
+}
+
+// check returns the request for the token, or queues a new request if the token is empty. A repeated request
+// without a token gets the pending request of the same key and body instead of a new one. An approved
+// request is consumed, so every approval allows a single recovery.
+func (q *ApprovalQueue) check(token, thp, remote string, body []byte) (ApprovalRequest, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	q.expire(now)
+
+	digest := sha256.Sum256(body)
+	if token == "" {
+		pending, fromRemote := 0, 0
+		for _, r := range q.requests {
+			if r.Status != ApprovalPending {
+				continue
+			}
+			if r.Thumbprint == thp && r.digest == digest {
+				return *r, nil
+			}
+			pending++
+			if remoteHost(r.Remote) == remoteHost(remote) {
+				fromRemote++
+			}
+		}
+		if pending >= limit(q.MaxPending, DefaultMaxPendingApprovals) {
+			return ApprovalRequest{}, ErrApprovalQueueFull
+		}
+		if fromRemote >= limit(q.MaxPendingPerRemote, DefaultMaxPendingApprovalsPerRemote) {
+			return ApprovalRequest{}, ErrTooManyApprovalRequests
+		}
+
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return ApprovalRequest{}, err
+		}
+		r := &ApprovalRequest{
+			ID:         base64.RawURLEncoding.EncodeToString(id),
+			Thumbprint: thp,
+			Remote:     remote,
+			Created:    now.UTC(),
+			Status:     ApprovalPending,
+			Expires:    now.UTC().Add(q.timeout()),
+			digest:     digest,
+		}
+		if q.requests == nil {
+			q.requests = make(map[string]*ApprovalRequest)
+		}
+		q.requests[r.ID] = r
+		return *r, nil
+	}
+
+	r, ok := q.requests[token]
+	// the token is valid only for the request it was issued for
+	if !ok || r.Thumbprint != thp || r.digest != digest {
+		return ApprovalRequest{}, ErrApprovalNotFound
+	}
+	if r.Status != ApprovalPending {
+		delete(q.requests, token)
+	}
+	return *r, nil
+}
+
+// expire drops requests past their expiration, denied requests are kept until then so clients learn the decision
+func (q *ApprovalQueue) expire(now time.Time) {
+	for id, r := range q.requests {
+		if !now.Before(r.Expires) {
+			delete(q.requests, id)
+		}
+	}
+}
+
+func (q *ApprovalQueue) window() time.Duration {
+	if q.Window <= 0 {
+		return DefaultApprovalWindow
+	}
+	return q.Window
+}
+
+func (q *ApprovalQueue) timeout() time.Duration {
+	if q.Timeout <= 0 {
+		return DefaultApprovalTimeout
+	}
+	return q.Timeout
+}
+
+// limit returns the configured limit, or the default if it is not set
+func limit(n, def int) int {
+	if n <= 0 {
+		return def
+	}
+	return n
+}
+
+// remoteHost strips the port from a client address
+func remoteHost(remote string) string {
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		return host
+	}
+	return remote
+}
+
+// awaitApproval decides whether a recovery of an approval-required key may proceed. If it may not,
+// the response is written and the audit result is returned.
+func (srv *Server) awaitApproval(w http.ResponseWriter, req *http.Request, thp string, body []byte) (bool, string, error) {
+	if srv.Approvals == nil {
+		err := fmt.Errorf("%w, but approvals are not enabled: %s", ErrApprovalRequired, thp)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false, AuditDenied, err
+	}
+
+	token := strings.TrimSpace(req.Header.Get(ApprovalTokenHeader))
+	r, err := srv.Approvals.check(token, thp, req.RemoteAddr, body)
+	switch {
+	case errors.Is(err, ErrApprovalQueueFull), errors.Is(err, ErrTooManyApprovalRequests):
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, ErrTooManyApprovalRequests) {
+			status = http.StatusTooManyRequests
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(approvalRetryAfter.Seconds())))
+		http.Error(w, err.Error(), status)
+		return false, AuditDenied, err
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false, AuditDenied, err
+	}
+
+	switch r.Status {
+	case ApprovalApproved:
+		return true, "", nil
+	case ApprovalDenied:
+		err := fmt.Errorf("recovery denied by %s", r.DecidedBy)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false, AuditDenied, err
+	default:
+		w.Header().Set(ApprovalTokenHeader, r.ID)
+		w.Header().Set("Retry-After", strconv.Itoa(int(approvalRetryAfter.Seconds())))
+		_ = writeJSON(w, http.StatusAccepted, r)
+		return false, AuditPending, nil
+	}
+}
@@ -0,0 +1,215 @@
+package tang
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/stretchr/testify/require"
+)
+
+func approvalTestRecover(t *testing.T, url, thp, token, body string) (*http.Response, []byte) {
+	req, err := http.NewRequest("POST", url+"/rec/"+thp, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/jwk+json")
+	if token != "" {
+		req.Header.Set(ApprovalTokenHeader, token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, data
+}
+
+func TestApprovalRequiredRecovery(t *testing.T) {
+	t.Parallel()
+
+	_, srv, client, events := startAdminServer(t)
+
+	status, data := client.do("GET", "/keys", "")
+	require.Equal(t, http.StatusOK, status)
+	var keys []AdminKey
+	require.NoError(t, json.Unmarshal(data, &keys))
+	var thp string
+	for _, k := range keys {
+		if k.Advertised && slices.Contains(k.KeyOps, string(jwk.KeyOpDeriveKey)) {
+			thp = k.Thumbprint
+		}
+	}
+	require.NotEmpty(t, thp)
+
+	status, _ = client.do("POST", "/keys/"+thp+"/approval", `{"required": true}`)
+	require.Equal(t, http.StatusOK, status)
+	status, data = client.do("GET", "/keys", "")
+	require.Equal(t, http.StatusOK, status)
+	require.NoError(t, json.Unmarshal(data, &keys))
+	for _, k := range keys {
+		require.Equal(t, k.Thumbprint == thp, k.ApprovalRequired)
+	}
+
+	// without a queue the recovery is refused
+	noQueue := NewServer()
+	noQueue.SetKeys(srv.keySet())
+	ts := httptest.NewServer(noQueue.Handler)
+	resp, _ := approvalTestRecover(t, ts.URL, thp, "", reverseTestXferKey)
+	ts.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	status, _ = client.do("GET", "/approvals", "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	queued := NewServer()
+	queued.SetKeys(srv.keySet())
+	queued.Approvals = NewApprovalQueue()
+	admin := NewAdminServer(nil, queued)
+	admin.Token = client.token
+	adminTS := httptest.NewServer(admin.Handler)
+	defer adminTS.Close()
+	client.url = adminTS.URL
+	ts = httptest.NewServer(queued.Handler)
+	defer ts.Close()
+
+	resp, data = approvalTestRecover(t, ts.URL, thp, "", reverseTestXferKey)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	token := resp.Header.Get(ApprovalTokenHeader)
+	require.NotEmpty(t, token)
+	require.NotEmpty(t, resp.Header.Get("Retry-After"))
+	var pending ApprovalRequest
+	require.NoError(t, json.Unmarshal(data, &pending))
+	require.Equal(t, token, pending.ID)
+	require.Equal(t, ApprovalPending, pending.Status)
+
+	// retrying before the decision keeps waiting
+	resp, _ = approvalTestRecover(t, ts.URL, thp, token, reverseTestXferKey)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	require.Equal(t, token, resp.Header.Get(ApprovalTokenHeader))
+
+	// the token is bound to the original request
+	resp, _ = approvalTestRecover(t, ts.URL, thp, token, `{"alg":"ECMR"}`)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	status, data = client.do("GET", "/approvals", "")
+	require.Equal(t, http.StatusOK, status)
+	var requests []ApprovalRequest
+	require.NoError(t, json.Unmarshal(data, &requests))
+	require.Len(t, requests, 1)
+	require.Equal(t, thp, requests[0].Thumbprint)
+
+	status, data = client.do("POST", "/approvals/"+token+"/approve", "")
+	require.Equal(t, http.StatusOK, status)
+	var approved ApprovalRequest
+	require.NoError(t, json.Unmarshal(data, &approved))
+	require.Equal(t, ApprovalApproved, approved.Status)
+	require.Equal(t, "token", approved.DecidedBy)
+
+	status, _ = client.do("POST", "/approvals/"+token+"/deny", "")
+	require.Equal(t, http.StatusConflict, status)
+
+	resp, data = approvalTestRecover(t, ts.URL, thp, token, reverseTestXferKey)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err := jwk.ParseKey(data)
+	require.NoError(t, err)
+
+	// an approval allows a single recovery
+	resp, _ = approvalTestRecover(t, ts.URL, thp, token, reverseTestXferKey)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, _ = approvalTestRecover(t, ts.URL, thp, "", reverseTestXferKey)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	token = resp.Header.Get(ApprovalTokenHeader)
+	status, _ = client.do("POST", "/approvals/"+token+"/deny", "")
+	require.Equal(t, http.StatusOK, status)
+	resp, data = approvalTestRecover(t, ts.URL, thp, token, reverseTestXferKey)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.Contains(t, string(data), "denied")
+
+	status, _ = client.do("POST", "/approvals/unknown/approve", "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	require.Equal(t, "set-approval", (*events)[1].Action)
+	require.Equal(t, []string{thp}, (*events)[1].Keys)
+}
+
+func TestApprovalQueueExpiry(t *testing.T) {
+	t.Parallel()
+
+	q := NewApprovalQueue()
+	q.Timeout = 50 * time.Millisecond
+	q.Window = 50 * time.Millisecond
+
+	pending, err := q.check("", "thp", "client", []byte("body"))
+	require.NoError(t, err)
+	approved, err := q.check("", "thp", "client", []byte("other body"))
+	require.NoError(t, err)
+	_, err = q.Approve(approved.ID, "operator")
+	require.NoError(t, err)
+	require.Len(t, q.Requests(), 2)
+
+	time.Sleep(100 * time.Millisecond)
+
+	require.Empty(t, q.Requests())
+	_, err = q.Approve(pending.ID, "operator")
+	require.ErrorIs(t, err, ErrApprovalNotFound)
+	_, err = q.check(approved.ID, "thp", "client", []byte("other body"))
+	require.ErrorIs(t, err, ErrApprovalNotFound)
+}
+
+func TestApprovalQueueLimits(t *testing.T) {
+	t.Parallel()
+
+	q := NewApprovalQueue()
+	q.MaxPending = 3
+	q.MaxPendingPerRemote = 2
+
+	first, err := q.check("", "thp", "192.0.2.1:1000", []byte("body 0"))
+	require.NoError(t, err)
+	// a repeated request waits for the same decision
+	again, err := q.check("", "thp", "192.0.2.1:1001", []byte("body 0"))
+	require.NoError(t, err)
+	require.Equal(t, first.ID, again.ID)
+	require.Len(t, q.Requests(), 1)
+
+	_, err = q.check("", "thp", "192.0.2.1:1002", []byte("body 1"))
+	require.NoError(t, err)
+	_, err = q.check("", "thp", "192.0.2.1:1003", []byte("body 2"))
+	require.ErrorIs(t, err, ErrTooManyApprovalRequests)
+	_, err = q.check("", "thp", "192.0.2.2:1000", []byte("body 3"))
+	require.NoError(t, err)
+	_, err = q.check("", "thp", "192.0.2.3:1000", []byte("body 4"))
+	require.ErrorIs(t, err, ErrApprovalQueueFull)
+	require.Len(t, q.Requests(), 3)
+
+	// decided requests do not count
+	_, err = q.Deny(first.ID, "operator")
+	require.NoError(t, err)
+	_, err = q.check("", "thp", "192.0.2.3:1000", []byte("body 4"))
+	require.NoError(t, err)
+
+	srv := NewServer()
+	srv.Approvals = q
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/rec/thp", nil)
+	req.RemoteAddr = "192.0.2.4:1000"
+	approved, _, err := srv.awaitApproval(w, req, "thp", []byte("body 5"))
+	require.False(t, approved)
+	require.ErrorIs(t, err, ErrApprovalQueueFull)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	q.MaxPending = 10
+	_, err = q.check("", "thp", "192.0.2.3:1001", []byte("body 6"))
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	req.RemoteAddr = "192.0.2.3:1002"
+	_, _, err = srv.awaitApproval(w, req, "thp", []byte("body 5"))
+	require.ErrorIs(t, err, ErrTooManyApprovalRequests)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+}
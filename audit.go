@@ -0,0 +1,42 @@
+package tang
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// Audit results
+const (
+	AuditOK     = "ok"
+	AuditDenied = "denied"
+	AuditFailed = "failed"
+	// AuditPending is the result of a recovery waiting for an operator approval
+	AuditPending = "pending"
+)
+
+// AuditEvent describes a security relevant action
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	// Actor identifies the authenticated client, it is empty if authentication failed
+	Actor  string `json:"actor,omitempty"`
+	Remote string `json:"remote,omitempty"`
+	Action string `json:"action"`
+	// Keys are the thumbprints of the keys affected by the action
+	Keys   []string `json:"keys,omitempty"`
+	Result string   `json:"result"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// logAuditEvent is the audit hook used when none is configured
+func logAuditEvent(e AuditEvent) {
+	msg := e.Result
+	if e.Error != "" {
+		msg += ": " + e.Error
+	}
+	actor := e.Actor
+	if actor == "" {
+		actor = "unauthenticated client"
+	}
+	log.Printf("audit: %s by %s from %s [%s]: %s", e.Action, actor, e.Remote, strings.Join(e.Keys, ","), msg)
+}
@@ -0,0 +1,226 @@
+package tang
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+var (
+	// ErrAuditLogCorrupt is returned when the hash chain of an audit log is broken. The chain is not keyed,
+	// it detects accidental corruption and truncation, not a deliberate rewrite of the log.
+	ErrAuditLogCorrupt = errors.New("audit log chain is broken")
+	// ErrAuditLogTorn is returned when the last line of an audit log has no newline. Records are written
+	// with a single write, so this is a write interrupted by a crash rather than corruption, RepairAuditLog
+	// removes the incomplete record.
+	ErrAuditLogTorn = errors.New("audit log ends with an incomplete record")
+)
+
+// maxAuditRecordSize limits the length of a line in an audit log
+const maxAuditRecordSize = 1024 * 1024
+
+// genesisHash is the previous hash of the first record in an audit log
+var genesisHash = hex.EncodeToString(make([]byte, sha256.Size))
+
+// AuditRecord is a single line of an AuditLog. Every record contains the hash of the previous one,
+// so a damaged, lost or reordered record breaks the chain. Anyone who can write the log can also
+// recompute the hashes, the chain does not protect against that.
+type AuditRecord struct {
+	Seq uint64 `json:"seq"`
+	AuditEvent
+	// Prev is the hash of the previous record
+	Prev string `json:"prev"`
+	// Hash is the hex SHA-256 of the record serialized with an empty Hash
+	Hash string `json:"hash"`
+}
+
+func (r *AuditRecord) computeHash() (string, error) {
+	c := *r
+	c.Hash = ""
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog is an append-only file of hash chained AuditRecords, one JSON object per line
+type AuditLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	seq  uint64
+	last string
+}
+
+// OpenAuditLog opens the audit log for appending, the file is created if needed. An existing file
+// is verified first, so records are never appended to a corrupt log, or to
+// an incomplete record left by a crash, see ErrAuditLogTorn.
+func OpenAuditLog(filename string) (*AuditLog, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &AuditLog{f: f, last: genesisHash}
+	_, err = scanAuditLog(f, func(r AuditRecord) bool {
+		l.seq, l.last = r.Seq, r.Hash
+		return true
+	})
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return l, nil
+}
+
+// RepairAuditLog removes an incomplete last record left by an interrupted write and returns the number of bytes
+// removed. The records before it are verified, a corrupt log is not changed.
+func RepairAuditLog(filename string) (int64, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	complete, err := scanAuditLog(f, func(AuditRecord) bool { return true })
+	if !errors.Is(err, ErrAuditLogTorn) {
+		return 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err := f.Truncate(complete); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return fi.Size() - complete, nil
+}
+
+// Record appends the event to the log and syncs it to the disk
+func (l *AuditLog) Record(e AuditEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r := AuditRecord{Seq: l.seq + 1, AuditEvent: e, Prev: l.last}
+	hash, err := r.computeHash()
+	if err != nil {
+		return err
+	}
+	r.Hash = hash
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+
+	l.seq, l.last = r.Seq, r.Hash
+	return nil
+}
+
+// Log records the event and logs a failure, it matches the signature of the Audit hooks
+func (l *AuditLog) Log(e AuditEvent) {
+	if err := l.Record(e); err != nil {
+		log.Printf("unable to write audit record: %v", err)
+		logAuditEvent(e)
+	}
+}
+
+// Close closes the log file
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// ScanAuditLog reads the records of the log in order and verifies the chain. The callback may stop
+// the scan by returning false. An error wrapping ErrAuditLogCorrupt is returned at the first record
+// that does not match the chain, and an error wrapping ErrAuditLogTorn if the last line is incomplete.
+func ScanAuditLog(r io.Reader, fn func(AuditRecord) bool) error {
+	_, err := scanAuditLog(r, fn)
+	return err
+}
+
+// scanAuditLog implements ScanAuditLog and returns the size of the complete lines that were read
+func scanAuditLog(r io.Reader, fn func(AuditRecord) bool) (int64, error) {
+	reader := bufio.NewReader(r)
+
+	prev := genesisHash
+	var seq uint64
+	var complete int64
+	for line := 1; ; line++ {
+		data, err := reader.ReadSlice('\n')
+		var buf []byte
+		for errors.Is(err, bufio.ErrBufferFull) && len(buf) <= maxAuditRecordSize {
+			buf = append(buf, data...)
+			data, err = reader.ReadSlice('\n')
+		}
+		if buf != nil {
+			data = append(buf, data...)
+		}
+		switch {
+		case len(data) > maxAuditRecordSize:
+			return complete, fmt.Errorf("%w: line %d: record is longer than %d bytes", ErrAuditLogCorrupt, line, maxAuditRecordSize)
+		case errors.Is(err, io.EOF) && len(data) == 0:
+			return complete, nil
+		case errors.Is(err, io.EOF):
+			return complete, fmt.Errorf("%w: line %d, %d bytes", ErrAuditLogTorn, line, len(data))
+		case err != nil:
+			return complete, err
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		var rec AuditRecord
+		if err := dec.Decode(&rec); err != nil {
+			return complete, fmt.Errorf("%w: line %d: %v", ErrAuditLogCorrupt, line, err)
+		}
+
+		hash, err := rec.computeHash()
+		if err != nil {
+			return complete, err
+		}
+		switch {
+		case rec.Hash != hash:
+			return complete, fmt.Errorf("%w: line %d: record hash mismatch", ErrAuditLogCorrupt, line)
+		case rec.Prev != prev:
+			return complete, fmt.Errorf("%w: line %d: record does not follow the previous one", ErrAuditLogCorrupt, line)
+		case rec.Seq != seq+1:
+			return complete, fmt.Errorf("%w: line %d: expected sequence number %d, got %d", ErrAuditLogCorrupt, line, seq+1, rec.Seq)
+		}
+		prev, seq = rec.Hash, rec.Seq
+		complete += int64(len(data))
+
+		if !fn(rec) {
+			return complete, nil
+		}
+	}
+}
+
+// VerifyAuditLog checks the chain of the log and returns the number of records and the hash of the last one.
+// The hash can be stored elsewhere to detect truncation of the log later.
+func VerifyAuditLog(r io.Reader) (uint64, string, error) {
+	var count uint64
+	last := genesisHash
+	err := ScanAuditLog(r, func(rec AuditRecord) bool {
+		count, last = rec.Seq, rec.Hash
+		return true
+	})
+	return count, last, err
+}
@@ -0,0 +1,169 @@
+package tang
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLogChain(t *testing.T) {
+	t.Parallel()
+
+	filename := path.Join(t.TempDir(), "audit.log")
+	l, err := OpenAuditLog(filename)
+	require.NoError(t, err)
+	for _, result := range []string{AuditOK, AuditFailed, AuditOK} {
+		require.NoError(t, l.Record(AuditEvent{Time: time.Now().UTC(), Action: "recover", Keys: []string{"thp"}, Result: result}))
+	}
+	require.NoError(t, l.Close())
+
+	// reopening continues the chain
+	l, err = OpenAuditLog(filename)
+	require.NoError(t, err)
+	require.NoError(t, l.Record(AuditEvent{Time: time.Now().UTC(), Action: "recover", Result: AuditOK}))
+	require.NoError(t, l.Close())
+
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	count, _, err := VerifyAuditLog(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.EqualValues(t, 4, count)
+
+	lines := strings.SplitAfter(string(data), "\n")
+	tampered := map[string]string{
+		"edited record":    strings.Join(lines[:1], "") + strings.Replace(lines[1], `"failed"`, `"ok"`, 1) + strings.Join(lines[2:], ""),
+		"removed record":   lines[0] + strings.Join(lines[2:], ""),
+		"reordered record": lines[1] + lines[0] + strings.Join(lines[2:], ""),
+		"added field":      lines[0] + strings.Replace(lines[1], `{`, `{"note":"x",`, 1) + strings.Join(lines[2:], ""),
+	}
+	for name, content := range tampered {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := VerifyAuditLog(strings.NewReader(content))
+			require.ErrorIs(t, err, ErrAuditLogCorrupt)
+
+			filename := path.Join(t.TempDir(), "audit.log")
+			require.NoError(t, os.WriteFile(filename, []byte(content), 0o600))
+			_, err = OpenAuditLog(filename)
+			require.ErrorIs(t, err, ErrAuditLogCorrupt)
+		})
+	}
+}
+
+func TestAuditLogTornRecord(t *testing.T) {
+	t.Parallel()
+
+	filename := path.Join(t.TempDir(), "audit.log")
+	l, err := OpenAuditLog(filename)
+	require.NoError(t, err)
+	for range 2 {
+		require.NoError(t, l.Record(AuditEvent{Time: time.Now().UTC(), Action: "recover", Result: AuditOK}))
+	}
+	require.NoError(t, l.Close())
+	complete, err := os.ReadFile(filename)
+	require.NoError(t, err)
+
+	// a crash in the middle of a write leaves a line without a newline
+	torn := `{"seq":3,"time":"2026-`
+	require.NoError(t, os.WriteFile(filename, append(slices.Clone(complete), torn...), 0o600))
+
+	count, _, err := VerifyAuditLog(strings.NewReader(string(complete) + torn))
+	require.ErrorIs(t, err, ErrAuditLogTorn)
+	require.NotErrorIs(t, err, ErrAuditLogCorrupt)
+	require.EqualValues(t, 2, count)
+	_, err = OpenAuditLog(filename)
+	require.ErrorIs(t, err, ErrAuditLogTorn)
+
+	removed, err := RepairAuditLog(filename)
+	require.NoError(t, err)
+	require.EqualValues(t, len(torn), removed)
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, complete, data)
+
+	// the chain continues after the repair and a second repair does nothing
+	l, err = OpenAuditLog(filename)
+	require.NoError(t, err)
+	require.NoError(t, l.Record(AuditEvent{Time: time.Now().UTC(), Action: "recover", Result: AuditOK}))
+	require.NoError(t, l.Close())
+	removed, err = RepairAuditLog(filename)
+	require.NoError(t, err)
+	require.Zero(t, removed)
+	data, err = os.ReadFile(filename)
+	require.NoError(t, err)
+	count, _, err = VerifyAuditLog(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.EqualValues(t, 3, count)
+
+	// a corrupt log is not changed by a repair
+	tampered := strings.Replace(string(data), `"seq":2`, `"seq":5`, 1) + torn
+	require.NoError(t, os.WriteFile(filename, []byte(tampered), 0o600))
+	_, err = RepairAuditLog(filename)
+	require.ErrorIs(t, err, ErrAuditLogCorrupt)
+	data, err = os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, tampered, string(data))
+}
+
+func TestAuditLogRecoveries(t *testing.T) {
+	t.Parallel()
+
+	filename := path.Join(t.TempDir(), "audit.log")
+	l, err := OpenAuditLog(filename)
+	require.NoError(t, err)
+	defer l.Close()
+
+	ks, err := ReadKeys("testdata/keys")
+	require.NoError(t, err)
+
+	srv := NewServer()
+	srv.Keys = ks
+	srv.Audit = l.Log
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/rec/"+reverseTestThp, "application/jwk+json", strings.NewReader(reverseTestXferKey))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Post(ts.URL+"/rec/unknown", "application/jwk+json", strings.NewReader(reverseTestXferKey))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	errs := acceptReverseClient(listener, func(conn net.Conn) error { return runReverseClient(conn, ks) })
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, ReverseTangHandshakeContext(t.Context(), "127.0.0.1:"+strconv.Itoa(port), ks, ReverseOptions{Audit: l.Log}))
+	require.NoError(t, <-errs)
+
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+	var records []AuditRecord
+	require.NoError(t, ScanAuditLog(f, func(r AuditRecord) bool {
+		records = append(records, r)
+		return true
+	}))
+
+	require.Len(t, records, 3)
+	require.Equal(t, "recover", records[0].Action)
+	require.Equal(t, AuditOK, records[0].Result)
+	require.Equal(t, []string{reverseTestThp}, records[0].Keys)
+	require.NotEmpty(t, records[0].Remote)
+	require.Equal(t, AuditFailed, records[1].Result)
+	require.Equal(t, "reverse-recover", records[2].Action)
+	require.Equal(t, AuditOK, records[2].Result)
+	require.Equal(t, "127.0.0.1:"+strconv.Itoa(port), records[2].Remote)
+}
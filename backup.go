@@ -0,0 +1,188 @@
+package tang
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+	"github.com/lestrrat-go/jwx/v3/jwe"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+)
+
+// backupVersion is the version of the backup archive format
+const backupVersion = 1
+
+// ErrKeyExists is returned by RestoreBackup when the store already contains a key from the backup
+var ErrKeyExists = errors.New("key already exists")
+
+// backupArchive is the plaintext content of a backup
+type backupArchive struct {
+	Version int           `json:"version"`
+	Created time.Time     `json:"created"`
+	Keys    []backupEntry `json:"keys"`
+}
+
+// backupEntry is a key in a backup together with its state. The thumbprint serves as a manifest
+// entry that is verified against the key on restore.
+type backupEntry struct {
+	Thumbprint string          `json:"thp"`
+	Advertised bool            `json:"advertised"`
+	Key        json.RawMessage `json:"key"`
+}
+
+// CreateBackup creates an authenticated encrypted archive of all keys in the store.
+// The archive is a JWE encrypted with the passphrase.
+func CreateBackup(s *KeyStore, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	archive, err := marshalBackup(s)
+	if err != nil {
+		return nil, err
+	}
+	return jwe.Encrypt(archive, jwe.WithKey(jwa.PBES2_HS512_A256KW(), passphrase), jwe.WithContentEncryption(jwa.A256GCM()))
+}
+
+// RestoreBackup decrypts the archive created by CreateBackup and writes its keys into the store.
+// Restore fails with ErrKeyExists if any of the keys is already in the store. With force existing keys
+// are replaced by their backed up copies, so they get back the state and restrictions they had in the backup.
+// The thumbprints of the restored keys are returned.
+func RestoreBackup(s *KeyStore, backup, passphrase []byte, force bool) ([]string, error) {
+	archive, err := jwe.Decrypt(backup, jwe.WithKey(jwa.PBES2_HS512_A256KW(), passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt backup: %v", err)
+	}
+	return restoreArchive(s, archive, force)
+}
+
+// CreateSharedBackup creates an archive like CreateBackup, but encrypts it with a random key that is split
+// into n shares using Shamir's secret sharing. Any k of the shares are needed to restore the backup.
+func CreateSharedBackup(s *KeyStore, n, k int) ([]byte, []Share, error) {
+	archive, err := marshalBackup(s)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	shares, err := SplitSecret(key, n, k)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backup, err := jwe.Encrypt(archive, jwe.WithKey(jwa.A256KW(), key), jwe.WithContentEncryption(jwa.A256GCM()))
+	if err != nil {
+		return nil, nil, err
+	}
+	return backup, shares, nil
+}
+
+// RestoreSharedBackup restores an archive created by CreateSharedBackup using at least threshold of its shares
+func RestoreSharedBackup(s *KeyStore, backup []byte, shares []Share, force bool) ([]string, error) {
+	key, err := CombineShares(shares)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := jwe.Decrypt(backup, jwe.WithKey(jwa.A256KW(), key))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt backup, the shares do not match it: %v", err)
+	}
+	return restoreArchive(s, archive, force)
+}
+
+func marshalBackup(s *KeyStore) ([]byte, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", s.Dir)
+	}
+
+	archive := backupArchive{Version: backupVersion, Created: time.Now().UTC()}
+	for _, k := range keys {
+		data, err := json.Marshal(k.Key)
+		if err != nil {
+			return nil, err
+		}
+		archive.Keys = append(archive.Keys, backupEntry{
+			Thumbprint: k.Thumbprint,
+			Advertised: k.Advertised,
+			Key:        data,
+		})
+	}
+
+	return json.Marshal(archive)
+}
+
+// restoreArchive verifies all entries of the archive first and only then writes the keys,
+// so a broken or conflicting backup leaves the store untouched
+func restoreArchive(s *KeyStore, data []byte, force bool) ([]string, error) {
+	archive, keys, err := parseArchive(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if !force {
+		stored, err := s.Keys()
+		if err != nil {
+			return nil, err
+		}
+		existing := make(map[string]bool)
+		for _, k := range stored {
+			existing[k.Thumbprint] = true
+		}
+		for _, e := range archive.Keys {
+			if existing[e.Thumbprint] {
+				return nil, fmt.Errorf("%w: %s", ErrKeyExists, e.Thumbprint)
+			}
+		}
+	}
+
+	put := s.Put
+	if force {
+		put = s.Replace
+	}
+	var restored []string
+	for i, key := range keys {
+		thp, err := put(key, archive.Keys[i].Advertised)
+		if err != nil {
+			return restored, err
+		}
+		restored = append(restored, thp)
+	}
+	return restored, nil
+}
+
+// parseArchive decodes the archive and verifies every key against its manifest thumbprint
+func parseArchive(data []byte) (*backupArchive, []jwk.Key, error) {
+	var archive backupArchive
+	if err := json.Unmarshal(data, &archive); err != nil {
+		return nil, nil, fmt.Errorf("invalid backup: %v", err)
+	}
+	if archive.Version != backupVersion {
+		return nil, nil, fmt.Errorf("unsupported backup version %d", archive.Version)
+	}
+
+	keys := make([]jwk.Key, len(archive.Keys))
+	for i, e := range archive.Keys {
+		key, err := jwk.ParseKey(e.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid key %s in backup: %v", e.Thumbprint, err)
+		}
+		thp, err := thumbprint(key, ThumbprintHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		if thp != e.Thumbprint {
+			return nil, nil, fmt.Errorf("key %s in backup does not match its manifest thumbprint %s", thp, e.Thumbprint)
+		}
+		keys[i] = key
+	}
+	return &archive, keys, nil
+}
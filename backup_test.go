@@ -0,0 +1,134 @@
+package tang
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func createTestStore(t *testing.T) (*KeyStore, map[string]bool) {
+	s := NewKeyStore(t.TempDir())
+	state := make(map[string]bool)
+
+	for i, advertised := range []bool{true, true, false} {
+		gen := GenerateExchangeKey
+		if i == 0 {
+			gen = GenerateVerifyKey
+		}
+		key, err := gen()
+		require.NoError(t, err)
+		thp, err := s.Put(key, advertised)
+		require.NoError(t, err)
+		state[thp] = advertised
+	}
+
+	return s, state
+}
+
+func storeState(t *testing.T, s *KeyStore) map[string]bool {
+	keys, err := s.Keys()
+	require.NoError(t, err)
+	state := make(map[string]bool)
+	for _, k := range keys {
+		state[k.Thumbprint] = k.Advertised
+	}
+	return state
+}
+
+func TestBackupRestore(t *testing.T) {
+	t.Parallel()
+
+	s, state := createTestStore(t)
+	backup, err := CreateBackup(s, []byte("passphrase"))
+	require.NoError(t, err)
+
+	target := NewKeyStore(t.TempDir())
+	restored, err := RestoreBackup(target, backup, []byte("passphrase"), false)
+	require.NoError(t, err)
+	require.Len(t, restored, 3)
+	require.Equal(t, state, storeState(t, target))
+
+	// the keys are already there
+	_, err = RestoreBackup(target, backup, []byte("passphrase"), false)
+	require.ErrorIs(t, err, ErrKeyExists)
+
+	// forced restore brings back the original state
+	keys, err := target.Keys()
+	require.NoError(t, err)
+	require.NoError(t, target.SetAdvertised(keys[0].Thumbprint, !keys[0].Advertised))
+	_, err = RestoreBackup(target, backup, []byte("passphrase"), true)
+	require.NoError(t, err)
+	require.Equal(t, state, storeState(t, target))
+}
+
+func TestBackupRestoreForceMetadata(t *testing.T) {
+	t.Parallel()
+
+	s, state := createTestStore(t)
+	backup, err := CreateBackup(s, []byte("passphrase"))
+	require.NoError(t, err)
+	target := NewKeyStore(t.TempDir())
+	_, err = RestoreBackup(target, backup, []byte("passphrase"), false)
+	require.NoError(t, err)
+
+	keys, err := target.Keys()
+	require.NoError(t, err)
+	revoked, restricted := keys[0].Thumbprint, keys[1].Thumbprint
+	require.NoError(t, target.SetState(revoked, KeyStateRevoked))
+	require.NoError(t, target.SetApprovalRequired(restricted, true))
+	require.NoError(t, target.SetValidity(restricted, KeyValidity{RecoverUntil: time.Now().Add(time.Hour)}))
+	// a copy under another name is replaced as well
+	current, err := target.stat(restricted)
+	require.NoError(t, err)
+	require.NoError(t, os.Rename(path.Join(target.Dir, current), path.Join(target.Dir, "renamed.jwk")))
+
+	_, err = RestoreBackup(target, backup, []byte("passphrase"), true)
+	require.NoError(t, err)
+	require.Equal(t, state, storeState(t, target))
+	keys, err = target.Keys()
+	require.NoError(t, err)
+	require.Len(t, keys, 3)
+	for _, k := range keys {
+		require.Equal(t, keyFilename(k.Thumbprint, k.Advertised), k.Filename)
+		require.Equal(t, KeyStateActive, k.State, k.Thumbprint)
+		require.False(t, k.ApprovalRequired, k.Thumbprint)
+		require.True(t, k.Validity.Equal(KeyValidity{}), k.Thumbprint)
+	}
+}
+
+func TestBackupWrongPassphrase(t *testing.T) {
+	t.Parallel()
+
+	s, _ := createTestStore(t)
+	backup, err := CreateBackup(s, []byte("passphrase"))
+	require.NoError(t, err)
+
+	target := NewKeyStore(t.TempDir())
+	_, err = RestoreBackup(target, backup, []byte("wrong"), false)
+	require.ErrorContains(t, err, "unable to decrypt backup")
+	require.Empty(t, storeState(t, target))
+}
+
+func TestBackupManifestMismatch(t *testing.T) {
+	t.Parallel()
+
+	s, _ := createTestStore(t)
+	data, err := marshalBackup(s)
+	require.NoError(t, err)
+
+	var archive backupArchive
+	require.NoError(t, json.Unmarshal(data, &archive))
+	archive.Keys[1].Thumbprint = archive.Keys[0].Thumbprint
+	data, err = json.Marshal(archive)
+	require.NoError(t, err)
+
+	target := NewKeyStore(t.TempDir())
+	_, err = restoreArchive(target, data, false)
+	require.ErrorContains(t, err, "does not match its manifest thumbprint")
+	// nothing is written if any of the entries is broken
+	require.Empty(t, storeState(t, target))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/anatol/tang.go"
+)
+
+// adminOptions configures the admin listener of the server
+type adminOptions struct {
+	// Address is the host to listen on, all interfaces if empty. Without TLS it has to be a loopback address.
+	Address   string    `yaml:"address"`
+	Port      int       `yaml:"port"`
+	TokenFile string    `yaml:"token-file"`
+	TLS       tlsConfig `yaml:"tls"`
+	// ClientCA verifies client certificates, they authenticate clients instead of the token
+	ClientCA string `yaml:"client-ca"`
+	// Insecure allows plain HTTP on other than loopback addresses, the token is sent in cleartext
+	Insecure bool `yaml:"insecure"`
+}
+
+// startAdmin starts the admin API for the key directory of the server
+func startAdmin(srv *tang.Server, key []string, policy keyPolicy, opts adminOptions) (<-chan error, error) {
+	store, err := serverKeyStore(key, policy, "admin API")
+	if err != nil {
+		return nil, err
+	}
+
+	admin := tang.NewAdminServer(store, srv)
+	admin.Audit = srv.Audit
+	admin.Addr = net.JoinHostPort(opts.Address, strconv.Itoa(opts.Port))
+	admin.Insecure = opts.Insecure
+	if opts.TokenFile != "" {
+		if admin.Token, err = readToken(opts.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.TLS.enabled() {
+		cert, err := tls.LoadX509KeyPair(opts.TLS.Cert, opts.TLS.Key)
+		if err != nil {
+			return nil, err
+		}
+		admin.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	if opts.ClientCA != "" {
+		data, err := os.ReadFile(opts.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		cas := x509.NewCertPool()
+		if !cas.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no PEM certificates found", opts.ClientCA)
+		}
+		admin.TLSConfig.ClientCAs = cas
+		admin.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- admin.ListenAndServe() }()
+	return errCh, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/anatol/tang.go"
+)
+
+// adminClientOptions describes how to connect to the admin API of a server
+type adminClientOptions struct {
+	url        string
+	tokenFile  string
+	caCert     string
+	clientCert string
+	clientKey  string
+}
+
+// adminClient calls the admin API of a running server
+type adminClient struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newAdminClient(opts adminClientOptions) (*adminClient, error) {
+	c := &adminClient{url: strings.TrimSuffix(opts.url, "/"), client: &http.Client{Timeout: 30 * time.Second}}
+	if opts.tokenFile != "" {
+		token, err := readToken(opts.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		c.token = token
+	}
+
+	if opts.caCert == "" && opts.clientCert == "" && opts.clientKey == "" {
+		return c, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.caCert != "" {
+		data, err := os.ReadFile(opts.caCert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no PEM certificates found", opts.caCert)
+		}
+	}
+	if opts.clientCert != "" || opts.clientKey != "" {
+		cert, err := tls.LoadX509KeyPair(opts.clientCert, opts.clientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	c.client.Transport = &http.Transport{TLSClientConfig: config}
+	return c, nil
+}
+
+// call sends the request body as JSON and decodes the JSON response into out, if not nil
+func (c *adminClient) call(method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.url+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func listApprovals(opts adminClientOptions, output string) error {
+	c, err := newAdminClient(opts)
+	if err != nil {
+		return err
+	}
+	var requests []tang.ApprovalRequest
+	if err := c.call(http.MethodGet, "/approvals", nil, &requests); err != nil {
+		return err
+	}
+
+	switch output {
+	case "json":
+		data, err := json.MarshalIndent(requests, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTHP\tCLIENT\tCREATED\tSTATUS\tEXPIRES")
+		for _, r := range requests {
+			status := string(r.Status)
+			if r.DecidedBy != "" {
+				status += " by " + r.DecidedBy
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.ID, r.Thumbprint, r.Remote,
+				r.Created.Local().Format(time.RFC3339), status, r.Expires.Local().Format(time.RFC3339))
+		}
+		return w.Flush()
+	}
+}
+
+// decideApproval approves or denies the held recovery with the given id
+func decideApproval(opts adminClientOptions, id string, approve bool) error {
+	c, err := newAdminClient(opts)
+	if err != nil {
+		return err
+	}
+	action := "deny"
+	if approve {
+		action = "approve"
+	}
+	var r tang.ApprovalRequest
+	if err := c.call(http.MethodPost, "/approvals/"+url.PathEscape(id)+"/"+action, nil, &r); err != nil {
+		return err
+	}
+	fmt.Printf("recovery of key %s from %s %s\n", r.Thumbprint, r.Remote, r.Status)
+	if r.Status == tang.ApprovalApproved {
+		fmt.Printf("the client has to retry before %s\n", r.Expires.Local().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// requireApproval marks or unmarks a key of the running server as approval-required
+func requireApproval(opts adminClientOptions, thp string, required bool) error {
+	c, err := newAdminClient(opts)
+	if err != nil {
+		return err
+	}
+	body := map[string]bool{"required": required}
+	return c.call(http.MethodPost, "/keys/"+url.PathEscape(thp)+"/approval", body, nil)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/anatol/tang.go"
+)
+
+// auditHook opens the audit log and returns the function that records events in it. With repair an incomplete
+// last record is removed first. No hook is returned if filename is empty. The log stays open until the process exits.
+func auditHook(filename string, repair bool) (func(tang.AuditEvent), error) {
+	if filename == "" {
+		return nil, nil
+	}
+	if repair {
+		if err := repairAuditLog(filename); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	l, err := tang.OpenAuditLog(filename)
+	if errors.Is(err, tang.ErrAuditLogTorn) {
+		return nil, fmt.Errorf("%w, remove it with 'tangctl audit repair %s'", err, filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l.Log, nil
+}
+
+func repairAuditLog(filename string) error {
+	removed, err := tang.RepairAuditLog(filename)
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		log.Printf("%s: removed an incomplete last record of %d bytes", filename, removed)
+	}
+	return nil
+}
+
+func verifyAuditLog(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	count, last, err := tang.VerifyAuditLog(f)
+	if err != nil && !errors.Is(err, tang.ErrAuditLogTorn) {
+		return err
+	}
+	fmt.Printf("%s: %d records, chain intact, last hash %s\n", filename, count, last)
+	if err != nil {
+		return fmt.Errorf("%w, remove it with 'tangctl audit repair %s'", err, filename)
+	}
+	return nil
+}
+
+// auditFilter selects audit records, empty fields match any record
+type auditFilter struct {
+	thp    string
+	client string
+	action string
+	since  string
+	until  string
+}
+
+type auditMatcher struct {
+	auditFilter
+	sinceTime, untilTime time.Time
+}
+
+func (f auditFilter) matcher() (*auditMatcher, error) {
+	m := &auditMatcher{auditFilter: f}
+	var err error
+	if f.since != "" {
+		if m.sinceTime, err = parseQueryTime(f.since); err != nil {
+			return nil, err
+		}
+	}
+	if f.until != "" {
+		if m.untilTime, err = parseQueryTime(f.until); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *auditMatcher) match(r tang.AuditRecord) bool {
+	if m.thp != "" && !slices.Contains(r.Keys, m.thp) {
+		return false
+	}
+	if m.action != "" && r.Action != m.action {
+		return false
+	}
+	if m.client != "" && r.Actor != m.client && r.Remote != m.client {
+		// the client may be given without the port
+		if host, _, err := net.SplitHostPort(r.Remote); err != nil || host != m.client {
+			return false
+		}
+	}
+	if !m.sinceTime.IsZero() && r.Time.Before(m.sinceTime) {
+		return false
+	}
+	if !m.untilTime.IsZero() && !r.Time.Before(m.untilTime) {
+		return false
+	}
+	return true
+}
+
+func parseQueryTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time '%s', use RFC 3339 or YYYY-MM-DD", s)
+	}
+	return t, nil
+}
+
+// queryAuditLog prints the records matching the filter. The chain of the whole log is verified,
+// so a corrupt log is reported instead of returning partial results.
+func queryAuditLog(filename string, filter auditFilter, output string) error {
+	m, err := filter.matcher()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	records := []tang.AuditRecord{}
+	err = tang.ScanAuditLog(f, func(r tang.AuditRecord) bool {
+		if m.match(r) {
+			records = append(records, r)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	switch output {
+	case "json":
+		data, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SEQ\tTIME\tACTION\tCLIENT\tKEYS\tRESULT")
+		for _, r := range records {
+			client := r.Remote
+			if r.Actor != "" {
+				client = r.Actor + "@" + r.Remote
+			}
+			result := r.Result
+			if r.Error != "" {
+				result += ": " + r.Error
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", r.Seq, r.Time.Local().Format(time.RFC3339), r.Action,
+				valueOrNone(client), valueOrNone(strings.Join(r.Keys, ",")), result)
+		}
+		return w.Flush()
+	}
+}
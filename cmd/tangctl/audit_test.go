@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/anatol/tang.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditHookRepair(t *testing.T) {
+	t.Parallel()
+
+	filename := path.Join(t.TempDir(), "audit.log")
+	hook, err := auditHook(filename, false)
+	require.NoError(t, err)
+	hook(tang.AuditEvent{Time: time.Now().UTC(), Action: "recover", Result: tang.AuditOK})
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"seq":2,`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = auditHook(filename, false)
+	require.ErrorIs(t, err, tang.ErrAuditLogTorn)
+	require.ErrorContains(t, err, "tangctl audit repair "+filename)
+	require.ErrorContains(t, verifyAuditLog(filename), "incomplete record")
+
+	_, err = auditHook(filename, true)
+	require.NoError(t, err)
+	require.NoError(t, verifyAuditLog(filename))
+
+	// a missing log is created as before
+	_, err = auditHook(path.Join(t.TempDir(), "new.log"), true)
+	require.NoError(t, err)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/anatol/tang.go"
+)
+
+// passphraseEnv is the environment variable the backup passphrase is read from if no file is given
+const passphraseEnv = "TANG_BACKUP_PASSPHRASE"
+
+func backupKeys(dir, output, passphraseFile string) error {
+	passphrase, err := readPassphrase(passphraseFile)
+	if err != nil {
+		return err
+	}
+
+	backup, err := tang.CreateBackup(tang.NewKeyStore(dir), passphrase)
+	if err != nil {
+		return err
+	}
+
+	if output == "-" {
+		_, err = fmt.Println(string(backup))
+		return err
+	}
+	return os.WriteFile(output, backup, 0o600)
+}
+
+// sharedBackupKeys writes a backup encrypted with a random key and the Shamir shares of the key. Every share
+// goes to its own file next to the backup, so the shares can be handed to different custodians.
+func sharedBackupKeys(dir, output string, shares, threshold int) error {
+	if output == "-" {
+		return fmt.Errorf("the shares are written next to the backup, write the backup to a file")
+	}
+	if shares == 0 || threshold == 0 {
+		return fmt.Errorf("both --shares and --threshold are required")
+	}
+
+	backup, keyShares, err := tang.CreateSharedBackup(tang.NewKeyStore(dir), shares, threshold)
+	if err != nil {
+		return err
+	}
+
+	// the shares go first, existing shares of another backup are never overwritten
+	filenames := make([]string, len(keyShares))
+	for i, s := range keyShares {
+		filenames[i] = fmt.Sprintf("%s.share-%d", output, i+1)
+		if err := writeShare(filenames[i], s); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(output, backup, 0o600); err != nil {
+		return err
+	}
+
+	fmt.Printf("Backup key shares, any %d of %d are needed to restore %s:\n", threshold, shares, output)
+	for _, filename := range filenames {
+		fmt.Println(filename)
+	}
+	return nil
+}
+
+// writeShare writes a share to a new file only the owner can read
+func writeShare(filename string, s tang.Share) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, s)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func restoreKeys(backupFile, dir, passphraseFile string, shareFiles []string, force bool) error {
+	backup, err := os.ReadFile(backupFile)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	store := tang.NewKeyStore(dir)
+
+	var restored []string
+	if len(shareFiles) != 0 {
+		var keyShares []tang.Share
+		keyShares, err = readShares(shareFiles, os.Stdin)
+		if err != nil {
+			return err
+		}
+		restored, err = tang.RestoreSharedBackup(store, backup, keyShares, force)
+	} else {
+		var passphrase []byte
+		passphrase, err = readPassphrase(passphraseFile)
+		if err != nil {
+			return err
+		}
+		restored, err = tang.RestoreBackup(store, backup, passphrase, force)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("restored %d keys into %s\n", len(restored), dir)
+	return nil
+}
+
+func readPassphrase(filename string) ([]byte, error) {
+	if filename == "" {
+		passphrase := os.Getenv(passphraseEnv)
+		if passphrase == "" {
+			return nil, fmt.Errorf("passphrase is required, use --passphrase-file or %s", passphraseEnv)
+		}
+		return []byte(passphrase), nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	passphrase := strings.TrimRight(string(data), "\r\n")
+	if passphrase == "" {
+		return nil, fmt.Errorf("%s: passphrase is empty", filename)
+	}
+	return []byte(passphrase), nil
+}
+
+// readShares reads the Shamir shares from the files, one share per line. Shares are secret, so they are
+// read from files or stdin ("-") instead of the command line where other users could see them.
+func readShares(files []string, stdin io.Reader) ([]tang.Share, error) {
+	var shares []tang.Share
+	for _, filename := range files {
+		var data []byte
+		var err error
+		if filename == "-" {
+			data, err = io.ReadAll(stdin)
+		} else {
+			data, err = os.ReadFile(filename)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		found := false
+		for line := range strings.Lines(string(data)) {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			s, err := tang.ParseShare(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", filename, err)
+			}
+			shares = append(shares, s)
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: no shares found", filename)
+		}
+	}
+	return shares, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/anatol/tang.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadShares(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("backup key")
+	shares, err := tang.SplitSecret(secret, 3, 3)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	file := func(name, content string) string {
+		filename := path.Join(dir, name)
+		require.NoError(t, os.WriteFile(filename, []byte(content), 0o600))
+		return filename
+	}
+	two := file("two", "\n"+shares[0].String()+"\r\n\n  "+shares[1].String()+"  \n")
+	stdin := strings.NewReader(shares[2].String() + "\n")
+
+	read, err := readShares([]string{two, "-"}, stdin)
+	require.NoError(t, err)
+	require.Len(t, read, 3)
+	combined, err := tang.CombineShares(read)
+	require.NoError(t, err)
+	require.Equal(t, secret, combined)
+
+	_, err = readShares([]string{file("empty", "\n\n")}, nil)
+	require.ErrorContains(t, err, "no shares found")
+	_, err = readShares([]string{file("invalid", "not a share\n")}, nil)
+	require.ErrorContains(t, err, "invalid:")
+	_, err = readShares([]string{path.Join(dir, "missing")}, nil)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestSharedBackupFiles(t *testing.T) {
+	t.Parallel()
+
+	dir, names := createKeyDir(t)
+	output := path.Join(t.TempDir(), "keys.backup")
+	require.NoError(t, sharedBackupKeys(dir, output, 3, 2))
+
+	for i := 1; i <= 3; i++ {
+		filename := fmt.Sprintf("%s.share-%d", output, i)
+		fi, err := os.Stat(filename)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+		shares, err := readShares([]string{filename}, nil)
+		require.NoError(t, err)
+		require.Len(t, shares, 1)
+	}
+
+	restored := t.TempDir()
+	require.NoError(t, restoreKeys(output, restored, "", []string{output + ".share-1", output + ".share-3"}, false))
+	require.ElementsMatch(t, names, dirEntries(t, restored))
+
+	// the shares of an existing backup are kept
+	require.ErrorIs(t, sharedBackupKeys(dir, output, 3, 2), os.ErrExist)
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anatol/tang.go"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the names of the environment variables that override the server configuration,
+// e.g. TANG_LISTEN_PORT overrides listen.port
+const envPrefix = "TANG"
+
+// serverConfig is the configuration of the server command. Environment variables override the
+// configuration file, and command line flags override both.
+type serverConfig struct {
+	Listen      listenConfig       `yaml:"listen"`
+	Keys        []string           `yaml:"keys"`
+	Advertise   advertiseConfig    `yaml:"advertise"`
+	Log         logConfig          `yaml:"log"`
+	Limits      limitsConfig       `yaml:"limits"`
+	Policy      policyConfig       `yaml:"policy"`
+	Replication replicationOptions `yaml:"replication"`
+	Admin       adminOptions       `yaml:"admin"`
+	Metrics     metricsConfig      `yaml:"metrics"`
+}
+
+type listenConfig struct {
+	// Address is the host to listen on, all interfaces if empty
+	Address string    `yaml:"address"`
+	Port    int       `yaml:"port"`
+	TLS     tlsConfig `yaml:"tls"`
+}
+
+type tlsConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+func (c tlsConfig) enabled() bool {
+	return c.Cert != "" || c.Key != ""
+}
+
+type advertiseConfig struct {
+	// MaxAge is the time clients and caches may reuse an advertisement, they revalidate it with its ETag if zero
+	MaxAge time.Duration `yaml:"max-age"`
+}
+
+type logConfig struct {
+	// File receives the server log instead of stderr
+	File string `yaml:"file"`
+	// Audit is the hash chained audit log
+	Audit string `yaml:"audit"`
+	// AuditRepair removes an incomplete last record left by a crash before the audit log is opened
+	AuditRepair bool `yaml:"audit-repair"`
+}
+
+// limitsConfig bounds the resources a client may use, zero values are unlimited
+type limitsConfig struct {
+	ReadHeaderTimeout time.Duration `yaml:"read-header-timeout"`
+	ReadTimeout       time.Duration `yaml:"read-timeout"`
+	WriteTimeout      time.Duration `yaml:"write-timeout"`
+	IdleTimeout       time.Duration `yaml:"idle-timeout"`
+	MaxHeaderBytes    int           `yaml:"max-header-bytes"`
+}
+
+type policyConfig struct {
+	ApprovalWindow  time.Duration `yaml:"approval-window"`
+	ApprovalTimeout time.Duration `yaml:"approval-timeout"`
+	// MaxPendingApprovals bounds the recoveries waiting for a decision, in total and per client address
+	MaxPendingApprovals          int `yaml:"max-pending-approvals"`
+	MaxPendingApprovalsPerRemote int `yaml:"max-pending-approvals-per-remote"`
+	// ThumbprintHashes are the hashes clients may identify keys with, all supported hashes if empty
+	ThumbprintHashes []string `yaml:"thumbprint-hashes"`
+	// RejectDuplicateKeys refuses to load key directories with duplicate keys instead of keeping the stronger copy
+	RejectDuplicateKeys bool `yaml:"reject-duplicate-keys"`
+}
+
+// keyPolicy is the parsed policy for loading and looking up keys
+type keyPolicy struct {
+	thumbprintHashes []crypto.Hash
+	rejectDuplicates bool
+}
+
+func (p policyConfig) keyPolicy() (keyPolicy, error) {
+	policy := keyPolicy{rejectDuplicates: p.RejectDuplicateKeys}
+	for _, name := range p.ThumbprintHashes {
+		h, err := tang.ParseThumbprintHash(name)
+		if err != nil {
+			return keyPolicy{}, fmt.Errorf("policy.thumbprint-hashes: %v", err)
+		}
+		policy.thumbprintHashes = append(policy.thumbprintHashes, h)
+	}
+	return policy, nil
+}
+
+// load reads the keys of the files and directories into a key set following the policy
+func (p keyPolicy) load(keys ...string) (*tang.KeySet, error) {
+	ks := tang.NewKeySet()
+	ks.ThumbprintHashes, ks.RejectDuplicates = p.thumbprintHashes, p.rejectDuplicates
+	if err := ks.Load(keys...); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// store returns the key store of dir, the key sets it loads follow the policy
+func (p keyPolicy) store(dir string) *tang.KeyStore {
+	store := tang.NewKeyStore(dir)
+	store.ThumbprintHashes, store.RejectDuplicates = p.thumbprintHashes, p.rejectDuplicates
+	return store
+}
+
+type metricsConfig struct {
+	// Port serves the expvar metrics, they are disabled if it is zero
+	Port int    `yaml:"port"`
+	Path string `yaml:"path"`
+}
+
+// serverFlags are the command line flags of the server command
+type serverFlags struct {
+	Config string        `long:"config" description:"YAML configuration file, command line flags override its settings"`
+	Port   int           `long:"port" description:"Http port"`
+	Key    []string      `long:"key" description:"Private key"`
+	MaxAge time.Duration `long:"adv-max-age" description:"Time clients and caches may reuse an advertisement without revalidating it"`
+	// replication
+	ReplicationPort       int           `long:"replication-port" description:"Serve key snapshots to followers on this port"`
+	ReplicateFrom         string        `long:"replicate-from" description:"URL of the replication primary to follow"`
+	ReplicationSecretFile string        `long:"replication-secret-file" description:"File with the secret shared by the replication primary and followers"`
+	ReplicationInterval   time.Duration `long:"replication-interval" default:"1m" description:"Time between two snapshots fetched by a follower"`
+	// admin API
+	AdminAddress   string `long:"admin-address" description:"Host the key management API listens on, all interfaces if empty"`
+	AdminPort      int    `long:"admin-port" description:"Serve the key management API on this port"`
+	AdminTokenFile string `long:"admin-token-file" description:"File with the bearer token admin clients have to present"`
+	AdminTLSCert   string `long:"admin-tls-cert" description:"PEM certificate to serve the admin API with TLS"`
+	AdminTLSKey    string `long:"admin-tls-key" description:"PEM private key of the admin TLS certificate"`
+	AdminClientCA  string `long:"admin-client-ca" description:"PEM CA certificates admin client certificates are verified against"`
+	AdminInsecure  bool   `long:"admin-insecure" description:"Serve the admin API without TLS on other than loopback addresses"`
+	AuditLog       string `long:"audit-log" description:"Append recoveries and admin actions to this hash chained log"`
+	AuditRepair    bool   `long:"audit-repair" description:"Remove an incomplete last record left by a crash from the audit log"`
+	// approvals
+	ApprovalWindow  time.Duration `long:"approval-window" default:"5m" description:"Time an approved recovery stays valid"`
+	ApprovalTimeout time.Duration `long:"approval-timeout" default:"1h" description:"Time a recovery of an approval-required key waits for a decision"`
+}
+
+// applyServerFlags overrides the configuration with the flags given on the command line
+func applyServerFlags(cfg *serverConfig, f serverFlags, isSet func(name string) bool) {
+	for _, o := range []struct {
+		name  string
+		apply func()
+	}{
+		{"port", func() { cfg.Listen.Port = f.Port }},
+		{"key", func() { cfg.Keys = f.Key }},
+		{"adv-max-age", func() { cfg.Advertise.MaxAge = f.MaxAge }},
+		{"replication-port", func() { cfg.Replication.Port = f.ReplicationPort }},
+		{"replicate-from", func() { cfg.Replication.Primary = f.ReplicateFrom }},
+		{"replication-secret-file", func() { cfg.Replication.SecretFile = f.ReplicationSecretFile }},
+		{"replication-interval", func() { cfg.Replication.Interval = f.ReplicationInterval }},
+		{"admin-address", func() { cfg.Admin.Address = f.AdminAddress }},
+		{"admin-port", func() { cfg.Admin.Port = f.AdminPort }},
+		{"admin-token-file", func() { cfg.Admin.TokenFile = f.AdminTokenFile }},
+		{"admin-tls-cert", func() { cfg.Admin.TLS.Cert = f.AdminTLSCert }},
+		{"admin-tls-key", func() { cfg.Admin.TLS.Key = f.AdminTLSKey }},
+		{"admin-client-ca", func() { cfg.Admin.ClientCA = f.AdminClientCA }},
+		{"admin-insecure", func() { cfg.Admin.Insecure = f.AdminInsecure }},
+		{"audit-log", func() { cfg.Log.Audit = f.AuditLog }},
+		{"audit-repair", func() { cfg.Log.AuditRepair = f.AuditRepair }},
+		{"approval-window", func() { cfg.Policy.ApprovalWindow = f.ApprovalWindow }},
+		{"approval-timeout", func() { cfg.Policy.ApprovalTimeout = f.ApprovalTimeout }},
+	} {
+		if isSet(o.name) {
+			o.apply()
+		}
+	}
+}
+
+func defaultServerConfig() *serverConfig {
+	return &serverConfig{
+		Policy: policyConfig{
+			ApprovalWindow:               tang.DefaultApprovalWindow,
+			ApprovalTimeout:              tang.DefaultApprovalTimeout,
+			MaxPendingApprovals:          tang.DefaultMaxPendingApprovals,
+			MaxPendingApprovalsPerRemote: tang.DefaultMaxPendingApprovalsPerRemote,
+		},
+		Replication: replicationOptions{Interval: tang.DefaultReplicationInterval},
+		Metrics:     metricsConfig{Path: "/debug/vars"},
+	}
+}
+
+// readServerConfig reads the configuration file on top of the defaults and applies the environment overrides.
+// The file is optional, without it the configuration comes from the environment only.
+func readServerConfig(filename string) (*serverConfig, error) {
+	cfg := defaultServerConfig()
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		// an empty file keeps the defaults
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix, os.LookupEnv); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides the fields of the struct with the environment variables named after their YAML path.
+// Lists are comma separated.
+func applyEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	t := v.Type()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		env := prefix + "_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, env, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := lookup(env)
+		if !ok {
+			continue
+		}
+		var err error
+		switch p := field.Addr().Interface().(type) {
+		case *string:
+			*p = value
+		case *[]string:
+			*p = nil
+			for _, s := range strings.Split(value, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					*p = append(*p, s)
+				}
+			}
+		case *int:
+			*p, err = strconv.Atoi(value)
+		case *bool:
+			*p, err = strconv.ParseBool(value)
+		case *time.Duration:
+			*p, err = time.ParseDuration(value)
+		default:
+			err = fmt.Errorf("unsupported type %T", p)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", env, err)
+		}
+	}
+	return nil
+}
+
+// validate checks the configuration for mistakes that would make the server fail later or
+// run with a surprising setup. The errors name the configuration key.
+func (cfg *serverConfig) validate() error {
+	if len(cfg.Keys) == 0 {
+		return fmt.Errorf("keys (--key): at least one key file or directory is required")
+	}
+	for _, k := range cfg.Keys {
+		if _, err := os.Stat(k); err != nil {
+			return fmt.Errorf("keys: %v", err)
+		}
+	}
+
+	// listen.port 0 lets the system pick a free port, the other servers are disabled without a port
+	ports := map[int]string{}
+	for _, p := range []struct {
+		name string
+		port int
+	}{
+		{"listen.port (--port)", cfg.Listen.Port},
+		{"replication.port", cfg.Replication.Port},
+		{"admin.port", cfg.Admin.Port},
+		{"metrics.port", cfg.Metrics.Port},
+	} {
+		switch {
+		case p.port == 0:
+			continue
+		case p.port < 0 || p.port > 65535:
+			return fmt.Errorf("%s: %d is not a valid port", p.name, p.port)
+		case ports[p.port] != "":
+			return fmt.Errorf("%s: port %d is already used by %s", p.name, p.port, ports[p.port])
+		}
+		ports[p.port] = p.name
+	}
+
+	if err := checkTLSConfig("listen.tls", cfg.Listen.TLS); err != nil {
+		return err
+	}
+	if err := checkFiles(map[string]string{"log.audit": dirOf(cfg.Log.Audit), "log.file": dirOf(cfg.Log.File)}); err != nil {
+		return err
+	}
+
+	for name, d := range map[string]time.Duration{
+		"advertise.max-age":          cfg.Advertise.MaxAge,
+		"limits.read-header-timeout": cfg.Limits.ReadHeaderTimeout,
+		"limits.read-timeout":        cfg.Limits.ReadTimeout,
+		"limits.write-timeout":       cfg.Limits.WriteTimeout,
+		"limits.idle-timeout":        cfg.Limits.IdleTimeout,
+		"policy.approval-window":     cfg.Policy.ApprovalWindow,
+		"policy.approval-timeout":    cfg.Policy.ApprovalTimeout,
+		"replication.interval":       cfg.Replication.Interval,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s: %v is negative", name, d)
+		}
+	}
+	for name, n := range map[string]int{
+		"limits.max-header-bytes":                 cfg.Limits.MaxHeaderBytes,
+		"policy.max-pending-approvals":            cfg.Policy.MaxPendingApprovals,
+		"policy.max-pending-approvals-per-remote": cfg.Policy.MaxPendingApprovalsPerRemote,
+	} {
+		if n < 0 {
+			return fmt.Errorf("%s: %d is negative", name, n)
+		}
+	}
+	if _, err := cfg.Policy.keyPolicy(); err != nil {
+		return err
+	}
+
+	if r := cfg.Replication; r.Port != 0 || r.Primary != "" {
+		if r.Port != 0 && r.Primary != "" {
+			return fmt.Errorf("replication: a server cannot be a replication primary and follower at the same time")
+		}
+		if r.SecretFile == "" {
+			return fmt.Errorf("replication.secret-file is required for replication")
+		}
+		if err := checkFiles(map[string]string{"replication.secret-file": r.SecretFile}); err != nil {
+			return err
+		}
+		secret, err := readToken(r.SecretFile)
+		if err != nil {
+			return fmt.Errorf("replication.secret-file: %v", err)
+		}
+		if err := tang.CheckReplicationSecret([]byte(secret)); err != nil {
+			return fmt.Errorf("replication.secret-file: %v", err)
+		}
+	}
+
+	if a := cfg.Admin; a.Port != 0 {
+		if cfg.Replication.Primary != "" {
+			return fmt.Errorf("admin: the keys of a replication follower are managed by its primary, the admin API is not available")
+		}
+		if err := checkTLSConfig("admin.tls", a.TLS); err != nil {
+			return err
+		}
+		if a.ClientCA != "" && !a.TLS.enabled() {
+			return fmt.Errorf("admin.client-ca requires admin.tls.cert and admin.tls.key")
+		}
+		if a.TokenFile == "" && a.ClientCA == "" {
+			return fmt.Errorf("admin: %v, set admin.token-file or admin.client-ca", tang.ErrAdminAuthNotConfigured)
+		}
+		if err := checkFiles(map[string]string{"admin.token-file": a.TokenFile, "admin.client-ca": a.ClientCA}); err != nil {
+			return err
+		}
+		if !a.TLS.enabled() && !a.Insecure && !loopbackHost(a.Address) {
+			return fmt.Errorf("admin: without admin.tls the token is sent in cleartext, listen on a loopback admin.address or set admin.insecure")
+		}
+	}
+
+	if !strings.HasPrefix(cfg.Metrics.Path, "/") {
+		return fmt.Errorf("metrics.path: '%s' has to start with '/'", cfg.Metrics.Path)
+	}
+	return nil
+}
+
+func checkTLSConfig(name string, c tlsConfig) error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.Cert == "" || c.Key == "" {
+		return fmt.Errorf("%s: cert and key have to be set together", name)
+	}
+	return checkFiles(map[string]string{name + ".cert": c.Cert, name + ".key": c.Key})
+}
+
+// checkFiles verifies that the configured files exist, empty names are skipped
+func checkFiles(files map[string]string) error {
+	for name, filename := range files {
+		if filename == "" {
+			continue
+		}
+		if _, err := os.Stat(filename); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// loopbackHost reports whether a listen address is only reachable from the local machine
+func loopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// dirOf returns the directory a file is going to be created in
+func dirOf(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	return path.Dir(filename)
+}
+
+// checkConfig validates the configuration file and the keys it refers to without starting the server
+func checkConfig(filename string, show bool) error {
+	cfg, err := readServerConfig(filename)
+	if err != nil {
+		return err
+	}
+	if err := cfg.validate(); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	// a follower may start with an empty key directory
+	if cfg.Replication.Primary == "" {
+		policy, err := cfg.Policy.keyPolicy()
+		if err != nil {
+			return err
+		}
+		if _, err := policy.load(cfg.Keys...); err != nil {
+			return fmt.Errorf("%s: keys: %v", filename, err)
+		}
+	}
+
+	if show {
+		data, err := yaml.Marshal(cfg)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(data))
+		return nil
+	}
+	fmt.Printf("%s: ok\n", filename)
+	return nil
+}
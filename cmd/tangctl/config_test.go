@@ -0,0 +1,218 @@
+package main
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyEnv(t *testing.T) {
+	t.Parallel()
+
+	env := map[string]string{
+		"TANG_LISTEN_PORT":                  "8080",
+		"TANG_LISTEN_TLS_CERT":              "/etc/tang/tls.crt",
+		"TANG_KEYS":                         "/keys/a, /keys/b,",
+		"TANG_ADVERTISE_MAX_AGE":            "5m",
+		"TANG_LIMITS_MAX_HEADER_BYTES":      "4096",
+		"TANG_POLICY_THUMBPRINT_HASHES":     "sha256,sha512",
+		"TANG_POLICY_REJECT_DUPLICATE_KEYS": "true",
+		"TANG_POLICY_MAX_PENDING_APPROVALS": "20",
+		"TANG_REPLICATION_SECRET_FILE":      "/etc/tang/replication.secret",
+		"TANG_ADMIN_CLIENT_CA":              "/etc/tang/ca.pem",
+		"TANG_METRICS_PATH":                 "/metrics",
+	}
+	var looked []string
+	cfg := defaultServerConfig()
+	err := applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix, func(name string) (string, bool) {
+		looked = append(looked, name)
+		v, ok := env[name]
+		return v, ok
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, 8080, cfg.Listen.Port)
+	require.Equal(t, "/etc/tang/tls.crt", cfg.Listen.TLS.Cert)
+	require.Equal(t, []string{"/keys/a", "/keys/b"}, cfg.Keys)
+	require.Equal(t, 5*time.Minute, cfg.Advertise.MaxAge)
+	require.Equal(t, 4096, cfg.Limits.MaxHeaderBytes)
+	require.Equal(t, []string{"sha256", "sha512"}, cfg.Policy.ThumbprintHashes)
+	require.True(t, cfg.Policy.RejectDuplicateKeys)
+	require.Equal(t, 20, cfg.Policy.MaxPendingApprovals)
+	require.Equal(t, "/etc/tang/replication.secret", cfg.Replication.SecretFile)
+	require.Equal(t, "/etc/tang/ca.pem", cfg.Admin.ClientCA)
+	require.Equal(t, "/metrics", cfg.Metrics.Path)
+	// unset variables keep the defaults
+	require.Equal(t, time.Minute, cfg.Replication.Interval)
+
+	require.Contains(t, looked, "TANG_LISTEN_ADDRESS")
+	require.Contains(t, looked, "TANG_LOG_AUDIT")
+	require.Contains(t, looked, "TANG_POLICY_APPROVAL_WINDOW")
+	require.Contains(t, looked, "TANG_REPLICATION_PRIMARY")
+	require.Contains(t, looked, "TANG_ADMIN_TLS_KEY")
+	require.NotContains(t, looked, "TANG_LISTEN")
+
+	for name, value := range map[string]string{
+		"TANG_LISTEN_PORT":                  "http",
+		"TANG_ADVERTISE_MAX_AGE":            "5",
+		"TANG_POLICY_REJECT_DUPLICATE_KEYS": "maybe",
+	} {
+		err := applyEnv(reflect.ValueOf(defaultServerConfig()).Elem(), envPrefix, func(n string) (string, bool) {
+			return value, n == name
+		})
+		require.ErrorContains(t, err, name+":")
+	}
+}
+
+func TestServerConfigPrecedence(t *testing.T) {
+	filename := path.Join(t.TempDir(), "tang.yaml")
+	require.NoError(t, os.WriteFile(filename, []byte(`
+listen:
+  port: 1
+keys: [/from/file]
+advertise:
+  max-age: 1m
+policy:
+  approval-window: 1m
+`), 0o600))
+
+	t.Setenv("TANG_LISTEN_PORT", "2")
+	t.Setenv("TANG_ADVERTISE_MAX_AGE", "2m")
+	cfg, err := readServerConfig(filename)
+	require.NoError(t, err)
+	// the environment overrides the file
+	require.Equal(t, 2, cfg.Listen.Port)
+	require.Equal(t, 2*time.Minute, cfg.Advertise.MaxAge)
+	require.Equal(t, []string{"/from/file"}, cfg.Keys)
+	require.Equal(t, time.Minute, cfg.Policy.ApprovalWindow)
+
+	// flags override both, but only the ones given on the command line
+	flags := serverFlags{Port: 3, Key: []string{"/from/flag"}, MaxAge: 3 * time.Minute, ApprovalWindow: 5 * time.Minute}
+	applyServerFlags(cfg, flags, func(name string) bool { return name == "port" || name == "key" })
+	require.Equal(t, 3, cfg.Listen.Port)
+	require.Equal(t, []string{"/from/flag"}, cfg.Keys)
+	require.Equal(t, 2*time.Minute, cfg.Advertise.MaxAge)
+	require.Equal(t, time.Minute, cfg.Policy.ApprovalWindow)
+
+	// without a file the configuration comes from the defaults and the environment
+	cfg, err = readServerConfig("")
+	require.NoError(t, err)
+	require.Equal(t, 2, cfg.Listen.Port)
+	require.Equal(t, defaultServerConfig().Policy, cfg.Policy)
+
+	empty := path.Join(t.TempDir(), "empty.yaml")
+	require.NoError(t, os.WriteFile(empty, nil, 0o600))
+	_, err = readServerConfig(empty)
+	require.NoError(t, err)
+
+	unknown := path.Join(t.TempDir(), "unknown.yaml")
+	require.NoError(t, os.WriteFile(unknown, []byte("listen:\n  prot: 80\n"), 0o600))
+	_, err = readServerConfig(unknown)
+	require.ErrorContains(t, err, "field prot not found")
+
+	t.Setenv("TANG_LIMITS_READ_TIMEOUT", "soon")
+	_, err = readServerConfig(filename)
+	require.ErrorContains(t, err, "TANG_LIMITS_READ_TIMEOUT")
+}
+
+func TestServerConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	file := func(name, content string) string {
+		filename := path.Join(dir, name)
+		require.NoError(t, os.WriteFile(filename, []byte(content), 0o600))
+		return filename
+	}
+	keys := t.TempDir()
+	cert, key := file("tls.crt", "cert"), file("tls.key", "key")
+	secret := file("replication.secret", "0123456789abcdef")
+	shortSecret := file("short.secret", "secret")
+	token := file("admin.token", "token")
+	missing := path.Join(dir, "missing")
+
+	valid := func() *serverConfig {
+		cfg := defaultServerConfig()
+		cfg.Keys = []string{keys}
+		cfg.Listen.Port = 80
+		return cfg
+	}
+	require.NoError(t, valid().validate())
+
+	tests := []struct {
+		name   string
+		modify func(cfg *serverConfig)
+		err    string
+	}{
+		{"no keys", func(cfg *serverConfig) { cfg.Keys = nil }, "keys (--key): at least one key file or directory is required"},
+		{"missing keys", func(cfg *serverConfig) { cfg.Keys = []string{missing} }, "keys: stat " + missing},
+		{"invalid port", func(cfg *serverConfig) { cfg.Listen.Port = 70000 }, "listen.port (--port): 70000 is not a valid port"},
+		{"negative port", func(cfg *serverConfig) { cfg.Metrics.Port = -1 }, "metrics.port: -1 is not a valid port"},
+		{"port conflict", func(cfg *serverConfig) { cfg.Admin.Port, cfg.Admin.TokenFile = 80, token }, "admin.port: port 80 is already used by listen.port (--port)"},
+		{"tls cert only", func(cfg *serverConfig) { cfg.Listen.TLS.Cert = cert }, "listen.tls: cert and key have to be set together"},
+		{"tls missing key", func(cfg *serverConfig) { cfg.Listen.TLS = tlsConfig{cert, missing} }, "listen.tls.key: stat " + missing},
+		{"audit dir", func(cfg *serverConfig) { cfg.Log.Audit = path.Join(missing, "audit.log") }, "log.audit: stat " + missing},
+		{"log dir", func(cfg *serverConfig) { cfg.Log.File = path.Join(missing, "tang.log") }, "log.file: stat " + missing},
+		{"negative max-age", func(cfg *serverConfig) { cfg.Advertise.MaxAge = -time.Second }, "advertise.max-age: -1s is negative"},
+		{"negative timeout", func(cfg *serverConfig) { cfg.Limits.ReadTimeout = -time.Second }, "limits.read-timeout: -1s is negative"},
+		{"negative approval timeout", func(cfg *serverConfig) { cfg.Policy.ApprovalTimeout = -time.Second }, "policy.approval-timeout: -1s is negative"},
+		{"negative replication interval", func(cfg *serverConfig) { cfg.Replication.Interval = -time.Second }, "replication.interval: -1s is negative"},
+		{"negative header bytes", func(cfg *serverConfig) { cfg.Limits.MaxHeaderBytes = -1 }, "limits.max-header-bytes: -1 is negative"},
+		{"negative pending approvals", func(cfg *serverConfig) { cfg.Policy.MaxPendingApprovals = -1 }, "policy.max-pending-approvals: -1 is negative"},
+		{"unknown hash", func(cfg *serverConfig) { cfg.Policy.ThumbprintHashes = []string{"md5"} }, "policy.thumbprint-hashes: "},
+		{"primary and follower", func(cfg *serverConfig) {
+			cfg.Replication = replicationOptions{Port: 81, Primary: "http://primary", SecretFile: secret}
+		}, "a server cannot be a replication primary and follower at the same time"},
+		{"no replication secret", func(cfg *serverConfig) { cfg.Replication.Port = 81 }, "replication.secret-file is required for replication"},
+		{"missing replication secret", func(cfg *serverConfig) {
+			cfg.Replication = replicationOptions{Port: 81, SecretFile: missing}
+		}, "replication.secret-file: stat " + missing},
+		{"short replication secret", func(cfg *serverConfig) {
+			cfg.Replication = replicationOptions{Primary: "http://primary", SecretFile: shortSecret}
+		}, "replication.secret-file: replication secret has to be at least 16 bytes long"},
+		{"admin on follower", func(cfg *serverConfig) {
+			cfg.Replication = replicationOptions{Primary: "http://primary", SecretFile: secret}
+			cfg.Admin.Port, cfg.Admin.TokenFile = 82, token
+		}, "admin: the keys of a replication follower are managed by its primary"},
+		{"admin client ca without tls", func(cfg *serverConfig) {
+			cfg.Admin.Port, cfg.Admin.ClientCA = 82, cert
+		}, "admin.client-ca requires admin.tls.cert and admin.tls.key"},
+		{"admin without auth", func(cfg *serverConfig) { cfg.Admin.Port = 82 }, "set admin.token-file or admin.client-ca"},
+		{"missing admin token", func(cfg *serverConfig) { cfg.Admin.Port, cfg.Admin.TokenFile = 82, missing }, "admin.token-file: stat " + missing},
+		{"admin cleartext", func(cfg *serverConfig) {
+			cfg.Admin.Port, cfg.Admin.TokenFile = 82, token
+		}, "admin: without admin.tls the token is sent in cleartext"},
+		{"metrics path", func(cfg *serverConfig) { cfg.Metrics.Path = "metrics" }, "metrics.path: 'metrics' has to start with '/'"},
+	}
+	for _, test := range tests {
+		cfg := valid()
+		test.modify(cfg)
+		require.ErrorContains(t, cfg.validate(), test.err, test.name)
+	}
+
+	// complete setups pass
+	for _, modify := range []func(cfg *serverConfig){
+		func(cfg *serverConfig) { cfg.Listen.TLS = tlsConfig{cert, key} },
+		// the system picks a port like without a configuration file
+		func(cfg *serverConfig) { cfg.Listen.Port = 0 },
+		func(cfg *serverConfig) { cfg.Replication = replicationOptions{Port: 81, SecretFile: secret} },
+		func(cfg *serverConfig) {
+			cfg.Admin.Port, cfg.Admin.TLS, cfg.Admin.ClientCA = 82, tlsConfig{cert, key}, cert
+		},
+		func(cfg *serverConfig) { cfg.Metrics.Port = 83 },
+		func(cfg *serverConfig) { cfg.Admin = adminOptions{Address: "127.0.0.1", Port: 82, TokenFile: token} },
+		func(cfg *serverConfig) { cfg.Admin = adminOptions{Address: "localhost", Port: 82, TokenFile: token} },
+		func(cfg *serverConfig) { cfg.Admin = adminOptions{Port: 82, TokenFile: token, Insecure: true} },
+		func(cfg *serverConfig) {
+			cfg.Admin = adminOptions{Port: 82, TokenFile: token, TLS: tlsConfig{cert, key}}
+		},
+	} {
+		cfg := valid()
+		modify(cfg)
+		require.NoError(t, cfg.validate())
+	}
+}
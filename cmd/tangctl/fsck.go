@@ -0,0 +1,402 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/anatol/tang.go"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+)
+
+// insecurePerm are permission bits a key file must not have: the keys are private,
+// readable by the owner and optionally by the group tangd runs as
+const insecurePerm = 0o027
+
+// fsckProblem is an inconsistency found in a key directory
+type fsckProblem struct {
+	file    string
+	problem string
+	fixed   bool
+}
+
+// fsckFile holds the state of a single key file during the check
+type fsckFile struct {
+	name       string
+	advertised bool
+	keys       []jwk.Key
+}
+
+type fsck struct {
+	dir      string
+	fix      bool
+	problems []fsckProblem
+}
+
+func (c *fsck) report(file, format string, args ...any) {
+	c.problems = append(c.problems, fsckProblem{file: file, problem: fmt.Sprintf(format, args...)})
+}
+
+// repair runs the fix action for the last reported problem if fixing is enabled
+func (c *fsck) repair(action func() error) {
+	if !c.fix {
+		return
+	}
+	p := &c.problems[len(c.problems)-1]
+	if err := action(); err != nil {
+		p.problem += fmt.Sprintf(" (fix failed: %v)", err)
+		return
+	}
+	p.fixed = true
+}
+
+func checkKeyDir(dir string, fix bool) error {
+	c := &fsck{dir: dir, fix: fix}
+	if err := c.run(); err != nil {
+		return err
+	}
+
+	unfixed := 0
+	for _, p := range c.problems {
+		status := ""
+		if p.fixed {
+			status = " [fixed]"
+		} else {
+			unfixed++
+		}
+		fmt.Printf("%s: %s%s\n", p.file, p.problem, status)
+	}
+
+	if unfixed != 0 {
+		return fmt.Errorf("%d problems found in %s", unfixed, dir)
+	}
+	if len(c.problems) == 0 {
+		fmt.Printf("%s: no problems found\n", dir)
+	}
+	return nil
+}
+
+func (c *fsck) run() error {
+	ents, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	var files []*fsckFile
+	for _, e := range ents {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".jwk") {
+			continue
+		}
+		if f := c.checkFile(e); f != nil {
+			files = append(files, f)
+		}
+	}
+
+	// files named after their key go first, so they are the ones kept when duplicates are removed
+	slices.SortStableFunc(files, func(a, b *fsckFile) int {
+		return cmp.Compare(b2i(!c.nameMatches(a)), b2i(!c.nameMatches(b)))
+	})
+
+	c.checkDuplicates(files)
+	c.checkNames(files)
+	c.checkUsableKeys(files)
+
+	return nil
+}
+
+// checkFile verifies permissions and content of a single file. It returns nil if the file has no usable keys.
+func (c *fsck) checkFile(e os.DirEntry) *fsckFile {
+	name := e.Name()
+	fn := path.Join(c.dir, name)
+
+	fi, err := e.Info()
+	if err != nil {
+		c.report(name, "%v", err)
+		return nil
+	}
+
+	if fi.Size() == 0 {
+		c.report(name, "empty file")
+		c.repair(func() error { return os.Remove(fn) })
+		return nil
+	}
+
+	if perm := fi.Mode().Perm(); perm&insecurePerm != 0 {
+		c.report(name, "insecure permissions %04o", perm)
+		c.repair(func() error { return os.Chmod(fn, perm&^insecurePerm) })
+	}
+
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		c.report(name, "%v", err)
+		return nil
+	}
+	set, err := jwk.Parse(data)
+	if err != nil {
+		c.report(name, "corrupt file: %v", err)
+		return nil
+	}
+
+	f := &fsckFile{name: name, advertised: name[0] != '.'}
+	for i := range set.Len() {
+		key, ok := set.Key(i)
+		if !ok {
+			c.report(name, "unable to get key at index %d", i)
+			return nil
+		}
+
+		if _, ok := key.Algorithm(); !ok {
+			c.report(name, "key has no alg")
+		}
+		if _, ok := key.KeyOps(); !ok {
+			c.report(name, "key has no key_ops")
+		}
+		private, err := jwk.IsPrivateKey(key)
+		if err != nil {
+			c.report(name, "%v", err)
+			continue
+		}
+		if !private {
+			c.report(name, "public key only, it cannot be used by the server")
+			continue
+		}
+
+		f.keys = append(f.keys, key)
+	}
+	if set.Len() == 0 {
+		c.report(name, "no keys in file")
+	}
+
+	return f
+}
+
+// checkDuplicates finds keys present in more than one file. A duplicate with the same status and restrictions
+// is redundant and can be removed. Of copies with different status the server keeps the stronger one, or refuses
+// to load the directory with policy.reject-duplicate-keys, the fix removes the weaker copy. Copies with a different
+// approval requirement or validity are merged to the most restrictive of both, they are left to the operator.
+func (c *fsck) checkDuplicates(files []*fsckFile) {
+	type copyOf struct {
+		file *fsckFile
+		key  tang.StoredKey
+	}
+	seen := make(map[string]copyOf)
+
+	for _, f := range files {
+		for _, k := range f.keys {
+			thp, err := defaultThumbprint(k)
+			if err != nil {
+				c.report(f.name, "%v", err)
+				continue
+			}
+			stored, err := storedCopy(k, f.advertised)
+			if err != nil {
+				c.report(f.name, "%v", err)
+				continue
+			}
+			current := copyOf{f, stored}
+
+			first, ok := seen[thp]
+			if !ok {
+				seen[thp] = current
+				continue
+			}
+			if first.file == f {
+				c.report(f.name, "key %s is repeated in the file", thp)
+				continue
+			}
+
+			sameRestrictions := first.key.ApprovalRequired == current.key.ApprovalRequired &&
+				first.key.Validity.Equal(current.key.Validity)
+			if !sameRestrictions {
+				c.report(f.name, "duplicate of key %s with different restrictions: [%s] here, [%s] in %s, the server merges them into [%s]",
+					thp, copyStatus(current.key), copyStatus(first.key), first.file.name, copyStatus(first.key.Merge(current.key)))
+				if current.key.Stronger(first.key) {
+					seen[thp] = current
+				}
+				continue
+			}
+
+			if first.key.Advertised == current.key.Advertised && first.key.State == current.key.State {
+				c.report(f.name, "duplicate of key %s from %s", thp, first.file.name)
+				c.removeCopy(f)
+				continue
+			}
+
+			kept, dropped := first, current
+			if current.key.Stronger(first.key) {
+				kept, dropped = current, first
+				seen[thp] = current
+			}
+			c.report(f.name, "duplicate of key %s from %s with different status, the server keeps the %s copy in %s",
+				thp, first.file.name, copyStatus(kept.key), kept.file.name)
+			c.removeCopy(dropped.file)
+		}
+	}
+}
+
+// storedCopy reads the metadata the server uses to merge the copies of a key
+func storedCopy(k jwk.Key, advertised bool) (tang.StoredKey, error) {
+	state, err := tang.KeyStateOf(k)
+	if err != nil {
+		return tang.StoredKey{}, err
+	}
+	approvalRequired, err := tang.ApprovalRequired(k)
+	if err != nil {
+		return tang.StoredKey{}, err
+	}
+	validity, err := tang.KeyValidityOf(k)
+	if err != nil {
+		return tang.StoredKey{}, err
+	}
+	return tang.StoredKey{Key: k, Advertised: advertised, State: state, ApprovalRequired: approvalRequired, Validity: validity}, nil
+}
+
+// removeCopy removes the file of a duplicate key for the last reported problem, if it holds no other keys
+func (c *fsck) removeCopy(f *fsckFile) {
+	if len(f.keys) != 1 {
+		return
+	}
+	fn := path.Join(c.dir, f.name)
+	c.repair(func() error { return os.Remove(fn) })
+	if c.fix {
+		f.keys = nil
+	}
+}
+
+// copyStatus describes the status and restrictions that decide how copies of a duplicate key are merged
+func copyStatus(k tang.StoredKey) string {
+	status := "hidden " + string(k.State)
+	switch {
+	case k.State == tang.KeyStateRevoked:
+		status = "revoked"
+	case k.Advertised:
+		status = "advertised " + string(k.State)
+	}
+	if k.ApprovalRequired {
+		status += ", approval required"
+	}
+	for _, b := range []struct {
+		name string
+		t    time.Time
+	}{
+		{"not before", k.Validity.NotBefore},
+		{"advertised until", k.Validity.AdvertiseUntil},
+		{"recovers until", k.Validity.RecoverUntil},
+	} {
+		if !b.t.IsZero() {
+			status += fmt.Sprintf(", %s %s", b.name, b.t.UTC().Format(time.RFC3339))
+		}
+	}
+	return status
+}
+
+// checkNames verifies that every single-key file is named after one of the key thumbprints
+func (c *fsck) checkNames(files []*fsckFile) {
+	for _, f := range files {
+		if len(f.keys) > 1 {
+			c.report(f.name, "file contains %d keys, use 'tangctl unpack-key' to split it", len(f.keys))
+			continue
+		}
+		if len(f.keys) == 0 {
+			continue
+		}
+
+		if c.nameMatches(f) {
+			continue
+		}
+
+		thp, err := defaultThumbprint(f.keys[0])
+		if err != nil {
+			c.report(f.name, "%v", err)
+			continue
+		}
+		newName := thp + ".jwk"
+		if !f.advertised {
+			newName = "." + newName
+		}
+		c.report(f.name, "file name does not match any of the key thumbprints, expected %s", newName)
+		from, to := path.Join(c.dir, f.name), path.Join(c.dir, newName)
+		c.repair(func() error {
+			if _, err := os.Stat(to); err == nil {
+				return fmt.Errorf("%s already exists", newName)
+			}
+			return os.Rename(from, to)
+		})
+	}
+}
+
+// nameMatches reports whether f contains a single key and is named after one of its thumbprints
+func (c *fsck) nameMatches(f *fsckFile) bool {
+	if len(f.keys) != 1 {
+		return false
+	}
+	base := strings.TrimSuffix(strings.TrimPrefix(f.name, "."), ".jwk")
+	for _, a := range tang.ThumbprintHashes() {
+		thp, err := f.keys[0].Thumbprint(a)
+		if err == nil && base64.RawURLEncoding.EncodeToString(thp) == base {
+			return true
+		}
+	}
+	return false
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// checkUsableKeys verifies that the directory can be served, i.e. it has sign and derive keys the server advertises
+// now and derive keys that can recover. Keys that are not active or outside of their validity do not count.
+func (c *fsck) checkUsableKeys(files []*fsckFile) {
+	now := time.Now()
+	var sign, derive, recover bool
+	for _, f := range files {
+		for _, k := range f.keys {
+			info, err := describeKey(k)
+			if err != nil {
+				continue
+			}
+			state, err := tang.KeyStateOf(k)
+			if err != nil || state != tang.KeyStateActive {
+				continue
+			}
+			validity, err := tang.KeyValidityOf(k)
+			if err != nil {
+				continue
+			}
+			exchange := info.Derive && info.Alg == "ECMR"
+			recover = recover || (exchange && validity.Recoverable(now) == nil)
+			if !f.advertised || !validity.Advertisable(now) {
+				continue
+			}
+			sign = sign || info.Sign
+			derive = derive || exchange
+		}
+	}
+
+	if !sign {
+		c.report(c.dir, "no advertised sign key")
+	}
+	if !derive {
+		c.report(c.dir, "no advertised derive key")
+	}
+	if !recover {
+		c.report(c.dir, "no derive key can recover")
+	}
+}
+
+// defaultThumbprint computes the thumbprint key files are named after
+func defaultThumbprint(key jwk.Key) (string, error) {
+	thp, err := key.Thumbprint(tang.ThumbprintHash)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(thp), nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/anatol/tang.go"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/stretchr/testify/require"
+)
+
+// createKeyDir unpacks a fresh sign and exchange key into a directory like 'tangctl create | tangctl unpack-key'
+func createKeyDir(t *testing.T) (string, []string) {
+	vk, err := tang.GenerateVerifyKey()
+	require.NoError(t, err)
+	ek, err := tang.GenerateExchangeKey()
+	require.NoError(t, err)
+	set := jwk.NewSet()
+	require.NoError(t, set.AddKey(vk))
+	require.NoError(t, set.AddKey(ek))
+	data, err := json.Marshal(set)
+	require.NoError(t, err)
+	keyFile := path.Join(t.TempDir(), "key.jwk")
+	require.NoError(t, os.WriteFile(keyFile, data, 0o600))
+
+	dir := t.TempDir()
+	require.NoError(t, unpackKey(dir, "", keyFile))
+
+	var names []string
+	for _, k := range []jwk.Key{vk, ek} {
+		thp, err := defaultThumbprint(k)
+		require.NoError(t, err)
+		names = append(names, thp+".jwk")
+	}
+	return dir, names
+}
+
+// runFsck checks the directory and returns the problems by file
+func runFsck(t *testing.T, dir string, fix bool) map[string][]fsckProblem {
+	c := &fsck{dir: dir, fix: fix}
+	require.NoError(t, c.run())
+	problems := make(map[string][]fsckProblem)
+	for _, p := range c.problems {
+		problems[p.file] = append(problems[p.file], p)
+	}
+	return problems
+}
+
+func dirEntries(t *testing.T, dir string) []string {
+	ents, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range ents {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestFsckUnpackedKeys(t *testing.T) {
+	t.Parallel()
+
+	dir, names := createKeyDir(t)
+	for _, name := range names {
+		fi, err := os.Stat(path.Join(dir, name))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	}
+	require.Empty(t, runFsck(t, dir, false))
+	require.NoError(t, checkKeyDir(dir, false))
+}
+
+func TestFsckFix(t *testing.T) {
+	t.Parallel()
+
+	dir, names := createKeyDir(t)
+	sign, exchange := names[0], names[1]
+	read := func(name string) []byte {
+		data, err := os.ReadFile(path.Join(dir, name))
+		require.NoError(t, err)
+		return data
+	}
+	write := func(name string, data []byte, perm os.FileMode) {
+		require.NoError(t, os.WriteFile(path.Join(dir, name), data, perm))
+		require.NoError(t, os.Chmod(path.Join(dir, name), perm))
+	}
+
+	require.NoError(t, os.Chmod(path.Join(dir, sign), 0o644))
+	write("empty.jwk", nil, 0o600)
+	write("corrupt.jwk", []byte("{"), 0o600)
+	write("misnamed.jwk", read(exchange), 0o600)
+	require.NoError(t, os.Rename(path.Join(dir, exchange), path.Join(dir, "."+exchange)))
+	write("notes.txt", []byte("ignored"), 0o644)
+
+	problems := runFsck(t, dir, false)
+	require.Contains(t, problems[sign][0].problem, "insecure permissions 0644")
+	require.Equal(t, "empty file", problems["empty.jwk"][0].problem)
+	require.Contains(t, problems["corrupt.jwk"][0].problem, "corrupt file")
+	// the advertised copy is kept over the hidden one
+	require.Len(t, problems["misnamed.jwk"], 2)
+	require.Contains(t, problems["misnamed.jwk"][0].problem, "from ."+exchange+" with different status, the server keeps the advertised active copy in misnamed.jwk")
+	require.Contains(t, problems["misnamed.jwk"][1].problem, "expected "+exchange)
+	require.NotContains(t, problems, "notes.txt")
+	for _, list := range problems {
+		for _, p := range list {
+			require.False(t, p.fixed)
+		}
+	}
+	require.Error(t, checkKeyDir(dir, false))
+
+	problems = runFsck(t, dir, true)
+	require.False(t, problems["corrupt.jwk"][0].fixed, "corrupt files are left to the operator")
+	for _, file := range []string{sign, "empty.jwk", "misnamed.jwk"} {
+		for _, p := range problems[file] {
+			require.True(t, p.fixed, file)
+		}
+	}
+	require.ElementsMatch(t, []string{"corrupt.jwk", "notes.txt", sign, exchange}, dirEntries(t, dir))
+	fi, err := os.Stat(path.Join(dir, sign))
+	require.NoError(t, err)
+	// the group tangd runs as may keep reading the keys
+	require.Equal(t, os.FileMode(0o640), fi.Mode().Perm())
+
+	require.NoError(t, os.Remove(path.Join(dir, "corrupt.jwk")))
+	require.Empty(t, runFsck(t, dir, false))
+}
+
+func TestFsckDuplicateRestrictions(t *testing.T) {
+	t.Parallel()
+
+	dir, names := createKeyDir(t)
+	exchange := names[1]
+	data, err := os.ReadFile(path.Join(dir, exchange))
+	require.NoError(t, err)
+	key, err := jwk.ParseKey(data)
+	require.NoError(t, err)
+	require.NoError(t, key.Set(tang.ApprovalRequiredParam, true))
+	restricted, err := json.Marshal(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path.Join(dir, "."+exchange), restricted, 0o600))
+
+	// the copies are merged by the server, fsck cannot tell which settings are intended
+	problems := runFsck(t, dir, true)
+	require.Len(t, problems, 1)
+	p := problems[exchange][0]
+	require.Contains(t, p.problem, "with different restrictions")
+	require.Contains(t, p.problem, "merges them into [advertised active, approval required]")
+	require.False(t, p.fixed)
+	require.Len(t, dirEntries(t, dir), 3)
+}
+
+func TestFsckUsableKeys(t *testing.T) {
+	t.Parallel()
+
+	dir, names := createKeyDir(t)
+	for _, name := range names {
+		require.NoError(t, os.Rename(path.Join(dir, name), path.Join(dir, "."+name)))
+	}
+	problems := runFsck(t, dir, true)
+	var list []string
+	for _, p := range problems[dir] {
+		list = append(list, p.problem)
+		require.False(t, p.fixed)
+	}
+	require.Equal(t, []string{"no advertised sign key", "no advertised derive key"}, list)
+	require.ErrorContains(t, checkKeyDir(dir, false), "2 problems found")
+
+	// advertised keys the server does not use are not enough
+	dir, names = createKeyDir(t)
+	sign, exchange := names[0], names[1]
+	setParam := func(name, param string, value any) {
+		data, err := os.ReadFile(path.Join(dir, name))
+		require.NoError(t, err)
+		key, err := jwk.ParseKey(data)
+		require.NoError(t, err)
+		require.NoError(t, key.Set(param, value))
+		data, err = json.Marshal(key)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path.Join(dir, name), data, 0o600))
+	}
+	setParam(sign, tang.KeyStateParam, string(tang.KeyStateRevoked))
+	setParam(exchange, tang.NotBeforeParam, time.Now().Add(time.Hour).Unix())
+	list = nil
+	for _, p := range runFsck(t, dir, false)[dir] {
+		list = append(list, p.problem)
+	}
+	require.Equal(t, []string{"no advertised sign key", "no advertised derive key", "no derive key can recover"}, list)
+
+	setParam(sign, tang.KeyStateParam, string(tang.KeyStateActive))
+	setParam(exchange, tang.NotBeforeParam, time.Now().Add(-2*time.Hour).Unix())
+	setParam(exchange, tang.AdvertiseUntilParam, time.Now().Add(-time.Hour).Unix())
+	list = nil
+	for _, p := range runFsck(t, dir, false)[dir] {
+		list = append(list, p.problem)
+	}
+	require.Equal(t, []string{"no advertised derive key"}, list)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/anatol/tang.go"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConcurrency = 8
+
+// inventory describes a batch of remote hosts to unlock. Host entries inherit
+// unset settings from the top level.
+type inventory struct {
+	inventoryHost `yaml:",inline"`
+	Concurrency   int             `yaml:"concurrency"`
+	Hosts         []inventoryHost `yaml:"hosts"`
+}
+
+type inventoryHost struct {
+	Name       string        `yaml:"name"`
+	Address    string        `yaml:"address"`
+	Keys       []string      `yaml:"keys"`
+	Timeout    time.Duration `yaml:"timeout"`
+	Retry      *int          `yaml:"retry"`
+	TLS        bool          `yaml:"tls"`
+	TLSPin     []string      `yaml:"tls-pin"`
+	TLSPinCert []string      `yaml:"tls-pin-cert"`
+	TokenFile  string        `yaml:"token-file"`
+	AllowThp   []string      `yaml:"allow-thp"`
+	// Thumbprint is the only key the host is expected to recover, it takes precedence over AllowThp
+	Thumbprint string `yaml:"thumbprint"`
+}
+
+// unlockResult is the outcome of unlocking a single host
+type unlockResult struct {
+	Name       string    `json:"name"`
+	Address    string    `json:"address"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+	Started    time.Time `json:"started"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+type unlockReport struct {
+	Started   time.Time      `json:"started"`
+	Total     int            `json:"total"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Hosts     []unlockResult `json:"hosts"`
+}
+
+// readInventory reads the inventory file. Host entries inherit unset settings from the top level of the file,
+// and then from the defaults given on the command line.
+func readInventory(filename string, defaults inventoryHost) (*inventory, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var inv inventory
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&inv); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	if inv.Address != "" || inv.Name != "" || inv.Thumbprint != "" {
+		return nil, fmt.Errorf("%s: name, address and thumbprint are only allowed in host entries", filename)
+	}
+	if len(inv.Hosts) == 0 {
+		return nil, fmt.Errorf("%s: no hosts defined", filename)
+	}
+
+	for i := range inv.Hosts {
+		h := &inv.Hosts[i]
+		if h.Address == "" {
+			return nil, fmt.Errorf("%s: host #%d does not have an address", filename, i+1)
+		}
+		if h.Name == "" {
+			h.Name = h.Address
+		}
+		if h.Thumbprint != "" {
+			h.AllowThp = []string{h.Thumbprint}
+		}
+		h.inherit(inv.inventoryHost)
+		h.inherit(defaults)
+		if len(h.Keys) == 0 {
+			return nil, fmt.Errorf("%s: no keys defined for host %s", filename, h.Name)
+		}
+	}
+
+	return &inv, nil
+}
+
+// inherit fills the settings the host does not set from the defaults. TLS cannot be turned off for a single host.
+func (h *inventoryHost) inherit(defaults inventoryHost) {
+	if len(h.Keys) == 0 {
+		h.Keys = defaults.Keys
+	}
+	if h.Timeout == 0 {
+		h.Timeout = defaults.Timeout
+	}
+	if h.Retry == nil {
+		h.Retry = defaults.Retry
+	}
+	h.TLS = h.TLS || defaults.TLS
+	if len(h.TLSPin) == 0 && len(h.TLSPinCert) == 0 {
+		h.TLSPin = defaults.TLSPin
+		h.TLSPinCert = defaults.TLSPinCert
+	}
+	if h.TokenFile == "" {
+		h.TokenFile = defaults.TokenFile
+	}
+	if len(h.AllowThp) == 0 {
+		h.AllowThp = defaults.AllowThp
+	}
+}
+
+// unlockInventory performs reverse handshakes with all the hosts from the inventory file in parallel, the command
+// line options are the defaults of the hosts. A summary table is printed to stdout, and a JSON report is written
+// to reportFile if it is set ("-" means stdout).
+func unlockInventory(filename string, defaults inventoryHost, concurrency int, reportFile string, audit func(tang.AuditEvent)) error {
+	inv, err := readInventory(filename, defaults)
+	if err != nil {
+		return err
+	}
+
+	if concurrency == 0 {
+		concurrency = inv.Concurrency
+	}
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	// resolve per-host options upfront so configuration errors are reported before anything is unlocked
+	type job struct {
+		host inventoryHost
+		ks   *tang.KeySet
+		opts tang.ReverseOptions
+	}
+	keySets := make(map[string]*tang.KeySet)
+	jobs := make([]job, len(inv.Hosts))
+	for i, h := range inv.Hosts {
+		ksID := strings.Join(h.Keys, "\x00")
+		ks, ok := keySets[ksID]
+		if !ok {
+			ks, err = tang.ReadKeys(h.Keys...)
+			if err != nil {
+				return fmt.Errorf("host %s: %v", h.Name, err)
+			}
+			keySets[ksID] = ks
+		}
+
+		var retry int
+		if h.Retry != nil {
+			retry = *h.Retry
+		}
+		opts, err := reverseOptions(h.Timeout, retry, h.TLS, h.TLSPin, h.TLSPinCert, h.TokenFile, h.AllowThp)
+		if err != nil {
+			return fmt.Errorf("host %s: %v", h.Name, err)
+		}
+		opts.Audit = audit
+
+		jobs[i] = job{h, ks, opts}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report := unlockReport{Started: time.Now(), Total: len(jobs)}
+	report.Hosts = make([]unlockResult, len(jobs))
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, j := range jobs {
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			res := unlockResult{Name: j.host.Name, Address: j.host.Address, Started: time.Now()}
+			err := tang.ReverseTangHandshakeContext(ctx, j.host.Address, j.ks, j.opts)
+			res.DurationMs = time.Since(res.Started).Milliseconds()
+			if err != nil {
+				res.Error = err.Error()
+			} else {
+				res.Success = true
+			}
+			report.Hosts[i] = res
+		})
+	}
+	wg.Wait()
+
+	for _, r := range report.Hosts {
+		if r.Success {
+			report.Succeeded++
+		} else {
+			report.Failed++
+		}
+	}
+
+	if reportFile != "-" {
+		printUnlockSummary(report)
+	}
+	if reportFile != "" {
+		if err := writeUnlockReport(report, reportFile); err != nil {
+			return err
+		}
+	}
+
+	if report.Failed != 0 {
+		return fmt.Errorf("%d of %d hosts failed to unlock", report.Failed, report.Total)
+	}
+	return nil
+}
+
+func printUnlockSummary(report unlockReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tADDRESS\tSTATUS\tDURATION\tERROR")
+	for _, r := range report.Hosts {
+		status := "ok"
+		if !r.Success {
+			status = "FAILED"
+		}
+		duration := (time.Duration(r.DurationMs) * time.Millisecond).String()
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Name, r.Address, status, duration, r.Error)
+	}
+	_ = w.Flush()
+	fmt.Printf("\n%d hosts: %d unlocked, %d failed\n", report.Total, report.Succeeded, report.Failed)
+}
+
+func writeUnlockReport(report unlockReport, filename string) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if filename == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(filename, data, 0o600)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeInventory(t *testing.T, content string) string {
+	filename := path.Join(t.TempDir(), "hosts.yaml")
+	require.NoError(t, os.WriteFile(filename, []byte(content), 0o600))
+	return filename
+}
+
+func TestReadInventory(t *testing.T) {
+	t.Parallel()
+
+	filename := writeInventory(t, `
+keys: [/etc/tang/keys]
+timeout: 10s
+retry: 2
+tls-pin: [top-pin]
+allow-thp: [top-thp]
+hosts:
+  - address: a.example:8609
+  - name: b
+    address: b.example:8609
+    keys: [/etc/tang/b]
+    timeout: 5s
+    retry: 0
+    tls-pin-cert: [b.pem]
+    token-file: b.token
+    thumbprint: b-thp
+`)
+	retry := 7
+	defaults := inventoryHost{
+		Timeout:   30 * time.Second,
+		Retry:     &retry,
+		TLS:       true,
+		TLSPin:    []string{"flag-pin"},
+		TokenFile: "flag.token",
+		AllowThp:  []string{"flag-thp"},
+	}
+	inv, err := readInventory(filename, defaults)
+	require.NoError(t, err)
+	require.Len(t, inv.Hosts, 2)
+
+	// the top level of the file takes precedence over the command line defaults
+	a := inv.Hosts[0]
+	require.Equal(t, "a.example:8609", a.Name)
+	require.Equal(t, []string{"/etc/tang/keys"}, a.Keys)
+	require.Equal(t, 10*time.Second, a.Timeout)
+	require.Equal(t, 2, *a.Retry)
+	require.True(t, a.TLS)
+	require.Equal(t, []string{"top-pin"}, a.TLSPin)
+	require.Empty(t, a.TLSPinCert)
+	require.Equal(t, "flag.token", a.TokenFile)
+	require.Equal(t, []string{"top-thp"}, a.AllowThp)
+
+	// host entries override both
+	b := inv.Hosts[1]
+	require.Equal(t, "b", b.Name)
+	require.Equal(t, []string{"/etc/tang/b"}, b.Keys)
+	require.Equal(t, 5*time.Second, b.Timeout)
+	require.Equal(t, 0, *b.Retry)
+	require.True(t, b.TLS)
+	require.Empty(t, b.TLSPin)
+	require.Equal(t, []string{"b.pem"}, b.TLSPinCert)
+	require.Equal(t, "b.token", b.TokenFile)
+	require.Equal(t, []string{"b-thp"}, b.AllowThp)
+
+	// without settings in the file the command line applies
+	inv, err = readInventory(writeInventory(t, "keys: [k]\nhosts: [{address: c.example:8609}]\n"), defaults)
+	require.NoError(t, err)
+	c := inv.Hosts[0]
+	require.Equal(t, 30*time.Second, c.Timeout)
+	require.Equal(t, 7, *c.Retry)
+	require.True(t, c.TLS)
+	require.Equal(t, []string{"flag-pin"}, c.TLSPin)
+	require.Equal(t, "flag.token", c.TokenFile)
+	require.Equal(t, []string{"flag-thp"}, c.AllowThp)
+}
+
+func TestReadInventoryErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{"keys: [k]\n", "no hosts defined"},
+		{"keys: [k]\naddress: a:1\nhosts: [{address: b:1}]\n", "only allowed in host entries"},
+		{"keys: [k]\nhosts: [{name: a}]\n", "host #1 does not have an address"},
+		{"hosts: [{address: a:1}]\n", "no keys defined for host a:1"},
+		{"keys: [k]\nhosts: [{address: a:1, unknown: 1}]\n", "field unknown not found"},
+	}
+	for _, test := range tests {
+		_, err := readInventory(writeInventory(t, test.content), inventoryHost{})
+		require.ErrorContains(t, err, test.err, test.content)
+	}
+}
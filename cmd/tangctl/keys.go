@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/anatol/tang.go"
+	"github.com/lestrrat-go/jwx/v3/jwa"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+)
+
+// keyInfo describes a single key from a key file
+type keyInfo struct {
+	File       string `json:"file"`
+	Advertised bool   `json:"advertised"`
+	State      string `json:"state,omitempty"`
+	// ApprovalRequired keys recover only after an operator approved the request
+	ApprovalRequired bool              `json:"approval_required,omitempty"`
+	Validity         tang.KeyValidity  `json:"validity,omitzero"`
+	Type             string            `json:"kty,omitempty"`
+	Curve            string            `json:"crv,omitempty"`
+	Alg              string            `json:"alg,omitempty"`
+	KeyOps           []string          `json:"key_ops,omitempty"`
+	Private          bool              `json:"private"`
+	Sign             bool              `json:"sign"`
+	Derive           bool              `json:"derive"`
+	Thumbprints      map[string]string `json:"thumbprints,omitempty"`
+	Error            string            `json:"error,omitempty"`
+}
+
+func listKeys(dir, output string) error {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var infos []keyInfo
+	for _, e := range ents {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".jwk") {
+			continue
+		}
+		infos = append(infos, inspectKeyFile(path.Join(dir, e.Name()))...)
+	}
+
+	if output == "table" {
+		return printKeyTable(os.Stdout, infos)
+	}
+	return printKeyInfos(os.Stdout, infos, output)
+}
+
+// printKeyTable prints one row per key, 'keys inspect' shows all details of a key
+func printKeyTable(w io.Writer, infos []keyInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tSTATUS\tTYPE\tTHP")
+	now := time.Now()
+	for _, info := range infos {
+		typ := info.Alg
+		if typ == "" {
+			typ = info.Type
+		}
+		thp := valueOrNone(info.Thumbprints[tang.HashName(tang.ThumbprintHash)])
+		if info.Error != "" {
+			thp = "error: " + info.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s %s\t%s\n", path.Base(info.File), keyStatus(info, now), valueOrNone(typ), keyUse(info), thp)
+	}
+	return tw.Flush()
+}
+
+func inspectKey(filename, output string) error {
+	infos := inspectKeyFile(filename)
+	if err := printKeyInfos(os.Stdout, infos, output); err != nil {
+		return err
+	}
+	if len(infos) == 1 && infos[0].Error != "" {
+		return fmt.Errorf("%s: %s", filename, infos[0].Error)
+	}
+	return nil
+}
+
+// inspectKeyFile describes every key in the file. A file that cannot be parsed yields a single entry with an error.
+func inspectKeyFile(filename string) []keyInfo {
+	advertised := path.Base(filename)[0] != '.'
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return []keyInfo{{File: filename, Advertised: advertised, Error: err.Error()}}
+	}
+	set, err := jwk.Parse(data)
+	if err != nil {
+		return []keyInfo{{File: filename, Advertised: advertised, Error: err.Error()}}
+	}
+
+	var infos []keyInfo
+	for i := range set.Len() {
+		key, ok := set.Key(i)
+		if !ok {
+			return []keyInfo{{File: filename, Advertised: advertised, Error: fmt.Sprintf("failed to get key at index %d", i)}}
+		}
+		info, err := describeKey(key)
+		if err != nil {
+			info.Error = err.Error()
+		}
+		info.File = filename
+		info.Advertised = advertised
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func describeKey(key jwk.Key) (keyInfo, error) {
+	info := keyInfo{Type: key.KeyType().String()}
+
+	var crv jwa.EllipticCurveAlgorithm
+	if err := key.Get("crv", &crv); err == nil {
+		info.Curve = crv.String()
+	}
+	if alg, ok := key.Algorithm(); ok {
+		info.Alg = alg.String()
+	}
+
+	keyOps, hasKeyOps := key.KeyOps()
+	for _, op := range keyOps {
+		info.KeyOps = append(info.KeyOps, string(op))
+	}
+	// missing key_ops means unrestricted usage, this matches how the server treats keys
+	info.Sign = !hasKeyOps || (slices.Contains(keyOps, jwk.KeyOpSign) && slices.Contains(keyOps, jwk.KeyOpVerify))
+	info.Derive = !hasKeyOps || slices.Contains(keyOps, jwk.KeyOpDeriveKey)
+
+	private, err := jwk.IsPrivateKey(key)
+	if err != nil {
+		return info, err
+	}
+	info.Private = private
+
+	state, err := tang.KeyStateOf(key)
+	if err != nil {
+		return info, err
+	}
+	info.State = string(state)
+
+	if info.ApprovalRequired, err = tang.ApprovalRequired(key); err != nil {
+		return info, err
+	}
+	if info.Validity, err = tang.KeyValidityOf(key); err != nil {
+		return info, err
+	}
+
+	info.Thumbprints = make(map[string]string)
+	for _, a := range tang.ThumbprintHashes() {
+		thp, err := key.Thumbprint(a)
+		if err != nil {
+			return info, err
+		}
+		info.Thumbprints[tang.HashName(a)] = base64.RawURLEncoding.EncodeToString(thp)
+	}
+
+	return info, nil
+}
+
+func printKeyInfos(w io.Writer, infos []keyInfo, output string) error {
+	switch output {
+	case "json":
+		if infos == nil {
+			infos = []keyInfo{}
+		}
+		data, err := json.MarshalIndent(infos, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for i, info := range infos {
+			if i != 0 {
+				fmt.Fprintln(tw)
+			}
+			writeKeyInfo(tw, info)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format: %s", output)
+	}
+}
+
+func writeKeyInfo(w io.Writer, info keyInfo) {
+	fmt.Fprintf(w, "file:\t%s\n", info.File)
+	now := time.Now()
+	fmt.Fprintf(w, "status:\t%s\n", keyStatus(info, now))
+	if info.Error != "" {
+		fmt.Fprintf(w, "error:\t%s\n", info.Error)
+		return
+	}
+	for _, b := range []struct {
+		name string
+		t    time.Time
+	}{
+		{"not before", info.Validity.NotBefore},
+		{"advertise until", info.Validity.AdvertiseUntil},
+		{"recover until", info.Validity.RecoverUntil},
+	} {
+		if !b.t.IsZero() {
+			fmt.Fprintf(w, "%s:\t%s\n", b.name, formatBound(b.t, now))
+		}
+	}
+
+	fmt.Fprintf(w, "type:\t%s %s\n", info.Type, info.Curve)
+	fmt.Fprintf(w, "alg:\t%s\n", valueOrNone(info.Alg))
+	fmt.Fprintf(w, "key_ops:\t%s\n", valueOrNone(strings.Join(info.KeyOps, ",")))
+	fmt.Fprintf(w, "use:\t%s\n", keyUse(info))
+	fmt.Fprintf(w, "private:\t%v\n", info.Private)
+	for _, a := range tang.ThumbprintHashes() {
+		fmt.Fprintf(w, "thp %s:\t%s\n", tang.HashName(a), info.Thumbprints[tang.HashName(a)])
+	}
+}
+
+// keyStatus describes whether the server advertises and recovers with the key
+func keyStatus(info keyInfo, now time.Time) string {
+	status := "advertised"
+	if !info.Advertised {
+		status = "hidden"
+	}
+	if info.State != "" && info.State != string(tang.KeyStateActive) {
+		status += ", " + info.State
+	}
+	if info.ApprovalRequired {
+		status += ", approval required"
+	}
+	switch v := info.Validity; {
+	case errors.Is(v.Recoverable(now), tang.ErrKeyNotYetValid):
+		status += ", not valid yet"
+	case errors.Is(v.Recoverable(now), tang.ErrKeyExpired):
+		status += ", expired"
+	case !v.Advertisable(now):
+		status += ", advertisement ended"
+	}
+	return status
+}
+
+// formatBound formats a validity bound together with the time left until it or passed since it
+func formatBound(t, now time.Time) string {
+	d := t.Sub(now)
+	if d < 0 {
+		return fmt.Sprintf("%s (%s ago)", t.Local().Format(time.RFC3339), roundDuration(-d))
+	}
+	return fmt.Sprintf("%s (in %s)", t.Local().Format(time.RFC3339), roundDuration(d))
+}
+
+func roundDuration(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	default:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+}
+
+// setKeyValidity changes the validity bounds of a key in the directory. Empty bounds are kept,
+// "none" removes a bound.
+func setKeyValidity(dir, thp, notBefore, advertiseUntil, recoverUntil string) error {
+	store := tang.NewKeyStore(dir)
+	keys, err := store.Keys()
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(keys, func(k tang.StoredKey) bool { return k.Thumbprint == thp })
+	if i == -1 {
+		return fmt.Errorf("key '%s' not found in %s", thp, dir)
+	}
+
+	v := keys[i].Validity
+	now := time.Now()
+	for _, b := range []struct {
+		value string
+		t     *time.Time
+	}{
+		{notBefore, &v.NotBefore},
+		{advertiseUntil, &v.AdvertiseUntil},
+		{recoverUntil, &v.RecoverUntil},
+	} {
+		if b.value == "" {
+			continue
+		}
+		if *b.t, err = parseBound(b.value, now); err != nil {
+			return err
+		}
+	}
+
+	if err := v.Check(); err != nil {
+		return fmt.Errorf("key %s: %v", thp, err)
+	}
+	if err := store.SetValidity(thp, v); err != nil {
+		return err
+	}
+	infos := inspectKeyFile(path.Join(dir, keys[i].Filename))
+	if err := printKeyInfos(os.Stdout, infos, "table"); err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.Error != "" {
+			return fmt.Errorf("%s: %s", info.File, info.Error)
+		}
+	}
+	return nil
+}
+
+// parseBound parses a validity bound given as time, as duration relative to now like "+720h", or as "none"
+func parseBound(s string, now time.Time) (time.Time, error) {
+	if s == "none" {
+		return time.Time{}, nil
+	}
+	if rel, ok := strings.CutPrefix(s, "+"); ok {
+		d, err := time.ParseDuration(rel)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid duration '%s': %v", s, err)
+		}
+		return now.Add(d), nil
+	}
+	return parseQueryTime(s)
+}
+
+func keyUse(info keyInfo) string {
+	var uses []string
+	if info.Sign {
+		uses = append(uses, "sign")
+	}
+	if info.Derive {
+		uses = append(uses, "derive")
+	}
+	return valueOrNone(strings.Join(uses, ","))
+}
+
+func valueOrNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
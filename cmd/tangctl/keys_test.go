@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anatol/tang.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectKeyFile(t *testing.T) {
+	t.Parallel()
+
+	dir, names := createKeyDir(t)
+	sign, exchange := names[0], names[1]
+
+	infos := inspectKeyFile(path.Join(dir, sign))
+	require.Len(t, infos, 1)
+	info := infos[0]
+	require.Empty(t, info.Error)
+	require.True(t, info.Advertised)
+	require.True(t, info.Private)
+	require.True(t, info.Sign)
+	require.False(t, info.Derive)
+	require.Equal(t, "ES512", info.Alg)
+	require.Equal(t, string(tang.KeyStateActive), info.State)
+	// the thumbprints follow the hashes the server looks keys up by
+	require.Len(t, info.Thumbprints, len(tang.ThumbprintHashes()))
+	for _, h := range tang.ThumbprintHashes() {
+		require.NotEmpty(t, info.Thumbprints[tang.HashName(h)], tang.HashName(h))
+	}
+	require.Equal(t, sign, info.Thumbprints[tang.HashName(tang.ThumbprintHash)]+".jwk")
+
+	require.NoError(t, os.Rename(path.Join(dir, exchange), path.Join(dir, "."+exchange)))
+	info = inspectKeyFile(path.Join(dir, "."+exchange))[0]
+	require.False(t, info.Advertised)
+	require.False(t, info.Sign)
+	require.True(t, info.Derive)
+	require.Equal(t, "ECMR", info.Alg)
+
+	corrupt := path.Join(dir, "corrupt.jwk")
+	require.NoError(t, os.WriteFile(corrupt, []byte("{"), 0o600))
+	infos = inspectKeyFile(corrupt)
+	require.Len(t, infos, 1)
+	require.NotEmpty(t, infos[0].Error)
+	require.Error(t, inspectKey(corrupt, "json"))
+}
+
+func TestPrintKeyTable(t *testing.T) {
+	t.Parallel()
+
+	dir, names := createKeyDir(t)
+	sign, exchange := names[0], names[1]
+	require.NoError(t, os.Rename(path.Join(dir, exchange), path.Join(dir, "."+exchange)))
+	require.NoError(t, os.WriteFile(path.Join(dir, "corrupt.jwk"), []byte("{"), 0o600))
+
+	var infos []keyInfo
+	for _, name := range []string{sign, "." + exchange, "corrupt.jwk"} {
+		infos = append(infos, inspectKeyFile(path.Join(dir, name))...)
+	}
+	var out bytes.Buffer
+	require.NoError(t, printKeyTable(&out, infos))
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	require.Len(t, lines, 4)
+	require.Regexp(t, `^FILE +STATUS +TYPE +THP$`, lines[0])
+	require.Regexp(t, `^`+sign+` +advertised +ES512 sign +`+strings.TrimSuffix(sign, ".jwk")+`$`, lines[1])
+	require.Regexp(t, `^\.`+exchange+` +hidden +ECMR derive +`+strings.TrimSuffix(exchange, ".jwk")+`$`, lines[2])
+	require.Regexp(t, `^corrupt\.jwk +advertised +- +- +error: `, lines[3])
+}
+
+func TestUnpackKeyHash(t *testing.T) {
+	t.Parallel()
+
+	dir, names := createKeyDir(t)
+	out := t.TempDir()
+	require.NoError(t, unpackKey(out, "sha1", path.Join(dir, names[0])))
+	info := inspectKeyFile(path.Join(dir, names[0]))[0]
+	_, err := os.Stat(path.Join(out, info.Thumbprints["sha1"]+".jwk"))
+	require.NoError(t, err)
+	thp, err := base64.RawURLEncoding.DecodeString(info.Thumbprints["sha1"])
+	require.NoError(t, err)
+	require.Len(t, thp, 20)
+
+	require.ErrorContains(t, unpackKey(out, "md5", path.Join(dir, names[0])), "unsupported thumbprint hash")
+}
+
+func TestSetKeyValidity(t *testing.T) {
+	t.Parallel()
+
+	dir, names := createKeyDir(t)
+	exchange := names[1]
+	thp := strings.TrimSuffix(exchange, ".jwk")
+	// keys are found under any file name
+	require.NoError(t, os.Rename(path.Join(dir, exchange), path.Join(dir, "exchange.jwk")))
+	original, err := os.ReadFile(path.Join(dir, "exchange.jwk"))
+	require.NoError(t, err)
+
+	require.ErrorContains(t, setKeyValidity(dir, thp, "+48h", "", "+24h"), "tang_nbf has to be before tang_recover_until")
+	require.ErrorContains(t, setKeyValidity(dir, thp, "", "+48h", "+24h"), "tang_advertise_until cannot be after tang_recover_until")
+	data, err := os.ReadFile(path.Join(dir, "exchange.jwk"))
+	require.NoError(t, err)
+	require.Equal(t, original, data)
+	_, err = tang.NewKeyStore(dir).Load()
+	require.NoError(t, err)
+
+	require.NoError(t, setKeyValidity(dir, thp, "", "+24h", "+48h"))
+	info := inspectKeyFile(path.Join(dir, "exchange.jwk"))[0]
+	require.Empty(t, info.Error)
+	require.WithinDuration(t, time.Now().Add(24*time.Hour), info.Validity.AdvertiseUntil, time.Minute)
+	require.WithinDuration(t, time.Now().Add(48*time.Hour), info.Validity.RecoverUntil, time.Minute)
+	// a bound inconsistent with the stored ones is rejected as well
+	require.ErrorContains(t, setKeyValidity(dir, thp, "+72h", "", ""), "tang_nbf has to be before tang_advertise_until")
+
+	require.ErrorContains(t, setKeyValidity(dir, "unknown", "", "+1h", ""), "key 'unknown' not found")
+}
@@ -1,29 +1,44 @@
 package main
 
 import (
-	"crypto"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"expvar"
 	"fmt"
+	"log"
+	"net"
+	"net/http"
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/anatol/tang.go"
 	"github.com/jessevdk/go-flags"
+	"github.com/lestrrat-go/jwx/v3/jwa"
 	"github.com/lestrrat-go/jwx/v3/jwk"
 )
 
-const (
-	defaultAlgo = crypto.SHA256
-)
+// hashOptions are the options that select a thumbprint hash, their choices are the hashes keys are looked up by
+var hashOptions = []struct{ command, option string }{
+	{"unpack-key", "alg"},
+	{"thp", "alg"},
+}
 
 func main() {
 	var opts struct {
-		Create    struct{} `command:"create" description:"Generate a private key"`
+		Create struct {
+			SignAlg string `long:"sign-alg" default:"es512" choice:"es512" choice:"eddsa" description:"Algorithm of the sign key"`
+		} `command:"create" description:"Generate a private key"`
 		UnpackKey struct {
 			OutputDir string `long:"output-dir" default:"." description:"Output directory"`
-			Alg       string `long:"alg" description:"Hash algorithm" default:"sha256" choice:"sha1" choice:"sha256"`
+			Alg       string `long:"alg" description:"Hash algorithm"`
 			Args      struct {
 				Key string `positional-arg-name:"key" required:"true"`
 			} `positional-args:"true"`
@@ -34,24 +49,179 @@ func main() {
 			} `positional-args:"true"`
 		} `command:"public" description:"Generate a public key (advertisement)"`
 		Thumbprint struct {
-			Alg  string `long:"alg" description:"Hash algorithm" default:"sha256" choice:"sha1" choice:"sha256"`
+			Alg  string `long:"alg" description:"Hash algorithm"`
+			All  bool   `long:"all" description:"Print thumbprints for all hash algorithms"`
 			Args struct {
 				Key string `positional-arg-name:"key" required:"true"`
 			} `positional-args:"true"`
 		} `command:"thp" description:"Compute key thumbprint"`
-		Server struct {
-			Port int      `long:"port" description:"Http port"`
-			Key  []string `long:"key" description:"Private key"`
-		} `command:"server" description:"Run Tang server"`
+		Server serverFlags `command:"server" description:"Run Tang server"`
 		Unlock struct {
-			Args struct {
-				Address string   `positional-arg-name:"address" required:"true"`
-				Key     []string `positional-arg-name:"key" required:"true"`
+			Timeout    time.Duration `long:"timeout" default:"30s" description:"Time limit for connecting and for the handshake itself"`
+			Retry      int           `long:"retry" description:"Number of retries if the remote is not reachable yet"`
+			TLS        bool          `long:"tls" description:"Connect using TLS, verify the remote certificate against system CAs unless pinned"`
+			TLSPin     []string      `long:"tls-pin" description:"Base64 SHA-256 fingerprint of the remote certificate or its public key, implies --tls"`
+			TLSPinCert []string      `long:"tls-pin-cert" description:"PEM certificate the remote has to present, implies --tls"`
+			TokenFile  string        `long:"token-file" description:"File with a pre-shared token the remote has to present"`
+			AllowThp   []string      `long:"allow-thp" description:"Thumbprint of a key the remote may recover, any key if not set"`
+			AuditLog   string        `long:"audit-log" description:"Append recoveries to this hash chained log"`
+			// batch mode
+			Inventory   string `long:"inventory" description:"YAML file with hosts to unlock in parallel, replaces the address and key arguments, the other options are defaults of the hosts"`
+			Concurrency int    `long:"concurrency" description:"Maximum number of hosts unlocked at the same time in inventory mode"`
+			Report      string `long:"report" description:"Write a JSON report of the inventory unlock to the file, '-' for stdout"`
+			Args        struct {
+				Address string   `positional-arg-name:"address"`
+				Key     []string `positional-arg-name:"key"`
 			} `positional-args:"true"`
 		} `command:"unlock" description:"Unlock remote client"`
+		ReverseListen struct {
+			Port      int           `long:"port" default:"8609" description:"TCP port to accept remote clients on"`
+			Timeout   time.Duration `long:"timeout" default:"30s" description:"Time limit for a single handshake"`
+			TLSCert   string        `long:"tls-cert" description:"PEM certificate to serve TLS with"`
+			TLSKey    string        `long:"tls-key" description:"PEM private key of the TLS certificate"`
+			TokenFile string        `long:"token-file" description:"File with a pre-shared token remote clients have to present"`
+			AllowThp  []string      `long:"allow-thp" description:"Thumbprint of a key remote clients may recover, any key if not set"`
+			AuditLog  string        `long:"audit-log" description:"Append recoveries to this hash chained log"`
+			Args      struct {
+				Key []string `positional-arg-name:"key" required:"true"`
+			} `positional-args:"true"`
+		} `command:"reverse-listen" description:"Accept connections from remote clients and unlock them"`
+		Keys struct {
+			List struct {
+				Output string `long:"output" default:"table" choice:"table" choice:"json" description:"Output format"`
+				Args   struct {
+					Dir string `positional-arg-name:"dir" required:"true"`
+				} `positional-args:"true"`
+			} `command:"list" description:"Show all keys in a directory"`
+			Inspect struct {
+				Output string `long:"output" default:"table" choice:"table" choice:"json" description:"Output format"`
+				Args   struct {
+					Key string `positional-arg-name:"key" required:"true"`
+				} `positional-args:"true"`
+			} `command:"inspect" description:"Show details of a key file"`
+			SetValidity struct {
+				NotBefore      string `long:"not-before" description:"Time the key starts to be used, e.g. 2026-01-01, an RFC 3339 time, +24h or none"`
+				AdvertiseUntil string `long:"advertise-until" description:"Time the key stops being advertised, it keeps recovering existing bindings"`
+				RecoverUntil   string `long:"recover-until" description:"Time the key stops recovering"`
+				Args           struct {
+					Dir string `positional-arg-name:"dir" required:"true"`
+					Thp string `positional-arg-name:"thp" required:"true"`
+				} `positional-args:"true"`
+			} `command:"set-validity" description:"Bound the time a key is used, a running server picks the change up on reload"`
+		} `command:"keys" description:"Inspect key files"`
+		Fsck struct {
+			Fix  bool `long:"fix" description:"Repair the problems that can be fixed safely"`
+			Args struct {
+				Dir string `positional-arg-name:"dir" required:"true"`
+			} `positional-args:"true"`
+		} `command:"fsck" description:"Check consistency of a key directory"`
+		Migrate struct {
+			From   string `long:"from" required:"true" description:"Legacy tangd key directory"`
+			To     string `long:"to" required:"true" description:"Output directory"`
+			Cache  string `long:"cache" description:"Legacy tangd cache directory to verify the migrated keys against"`
+			DryRun bool   `long:"dry-run" description:"Print the mapping without writing any files"`
+		} `command:"migrate" description:"Convert a legacy tangd key directory into one key per file layout"`
+		Backup struct {
+			Output         string `short:"o" long:"output" required:"true" description:"Backup file, '-' for stdout"`
+			PassphraseFile string `long:"passphrase-file" description:"File with the backup passphrase, TANG_BACKUP_PASSPHRASE is used if not set"`
+			Shares         int    `long:"shares" description:"Encrypt with a random key split into this many Shamir shares instead of a passphrase, they are written to OUTPUT.share-N"`
+			Threshold      int    `long:"threshold" description:"Number of shares required to restore the backup"`
+			Args           struct {
+				Dir string `positional-arg-name:"dir" required:"true"`
+			} `positional-args:"true"`
+		} `command:"backup" description:"Create an encrypted backup of a key directory"`
+		Restore struct {
+			PassphraseFile string   `long:"passphrase-file" description:"File with the backup passphrase, TANG_BACKUP_PASSPHRASE is used if not set"`
+			Share          []string `long:"share" description:"File with Shamir shares of the backup key, one per line, '-' for stdin, repeat for every file"`
+			Force          bool     `long:"force" description:"Overwrite keys that already exist in the directory"`
+			Args           struct {
+				Backup string `positional-arg-name:"backup" required:"true"`
+				Dir    string `positional-arg-name:"dir" required:"true"`
+			} `positional-args:"true"`
+		} `command:"restore" description:"Restore keys from an encrypted backup"`
+		SplitKey struct {
+			Shares    int    `long:"shares" required:"true" description:"Number of Tang instances that share the exchange keys"`
+			OutputDir string `long:"output-dir" default:"." description:"Directory to create the share-N key directories in"`
+			Args      struct {
+				Dir string `positional-arg-name:"dir" required:"true"`
+			} `positional-args:"true"`
+		} `command:"split-key" description:"Split exchange keys additively across several Tang instances (experimental)"`
+		Replication struct {
+			Status struct {
+				Output string        `long:"output" default:"table" choice:"table" choice:"json" description:"Output format"`
+				MaxLag time.Duration `long:"max-lag" description:"Fail if the follower has not synced within this time"`
+				Args   struct {
+					Dir string `positional-arg-name:"dir" required:"true"`
+				} `positional-args:"true"`
+			} `command:"status" description:"Show the replication state of a follower key directory"`
+		} `command:"replication" description:"Inspect key replication"`
+		Audit struct {
+			Verify struct {
+				Args struct {
+					Log string `positional-arg-name:"logfile" required:"true"`
+				} `positional-args:"true"`
+			} `command:"verify" description:"Check the hash chain of an audit log"`
+			Repair struct {
+				Args struct {
+					Log string `positional-arg-name:"logfile" required:"true"`
+				} `positional-args:"true"`
+			} `command:"repair" description:"Remove an incomplete last record left by a crash from an audit log"`
+			Query struct {
+				Thp    string `long:"thp" description:"Only records about the key with this thumbprint"`
+				Client string `long:"client" description:"Only records of this client address or identity"`
+				Action string `long:"action" description:"Only records of this action, e.g. recover or reverse-recover"`
+				Since  string `long:"since" description:"Only records at or after this time (RFC 3339 or YYYY-MM-DD)"`
+				Until  string `long:"until" description:"Only records before this time (RFC 3339 or YYYY-MM-DD)"`
+				Output string `long:"output" default:"table" choice:"table" choice:"json" description:"Output format"`
+				Args   struct {
+					Log string `positional-arg-name:"logfile" required:"true"`
+				} `positional-args:"true"`
+			} `command:"query" description:"Show audit records matching the filters"`
+		} `command:"audit" description:"Inspect audit logs"`
+		Config struct {
+			Check struct {
+				Show bool `long:"show" description:"Print the effective configuration including environment overrides"`
+				Args struct {
+					Config string `positional-arg-name:"config" required:"true"`
+				} `positional-args:"true"`
+			} `command:"check" description:"Validate a server configuration file without starting the server"`
+		} `command:"config" description:"Manage the server configuration"`
+		Approvals struct {
+			AdminURL   string `long:"admin-url" default:"http://localhost:8443" description:"URL of the server admin API"`
+			TokenFile  string `long:"token-file" description:"File with the admin bearer token"`
+			CACert     string `long:"ca-cert" description:"PEM CA certificates to verify the admin TLS certificate against"`
+			ClientCert string `long:"client-cert" description:"PEM client certificate to authenticate with"`
+			ClientKey  string `long:"client-key" description:"PEM private key of the client certificate"`
+			List       struct {
+				Output string `long:"output" default:"table" choice:"table" choice:"json" description:"Output format"`
+			} `command:"list" description:"Show recoveries waiting for a decision"`
+			Approve struct {
+				Args struct {
+					ID string `positional-arg-name:"id" required:"true"`
+				} `positional-args:"true"`
+			} `command:"approve" description:"Allow a held recovery"`
+			Deny struct {
+				Args struct {
+					ID string `positional-arg-name:"id" required:"true"`
+				} `positional-args:"true"`
+			} `command:"deny" description:"Reject a held recovery"`
+			Require struct {
+				Disable bool `long:"disable" description:"Recover without approvals again"`
+				Args    struct {
+					Thp string `positional-arg-name:"thp" required:"true"`
+				} `positional-args:"true"`
+			} `command:"require" description:"Require operator approvals for recoveries with a key"`
+		} `command:"approvals" description:"Decide on recoveries of approval-required keys"`
 	}
 
 	parser := flags.NewParser(&opts, flags.Default)
+	for _, o := range hashOptions {
+		option := parser.Find(o.command).FindOptionByLongName(o.option)
+		for _, h := range tang.ThumbprintHashes() {
+			option.Choices = append(option.Choices, tang.HashName(h))
+		}
+		option.Default = []string{tang.HashName(tang.ThumbprintHash)}
+	}
 	_, err := parser.Parse()
 	if err != nil {
 		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
@@ -63,17 +233,111 @@ func main() {
 
 	switch parser.Active.Name {
 	case "create":
-		err = createKey()
+		err = createKey(opts.Create.SignAlg)
 	case "unpack-key":
 		err = unpackKey(opts.UnpackKey.OutputDir, opts.UnpackKey.Alg, opts.UnpackKey.Args.Key)
 	case "public":
 		err = generateAdvertisement(opts.Public.Args.Key)
 	case "thp":
-		err = generateThumbprint(opts.Thumbprint.Alg, opts.Thumbprint.Args.Key)
+		err = generateThumbprint(opts.Thumbprint.Alg, opts.Thumbprint.All, opts.Thumbprint.Args.Key)
 	case "server":
-		err = startTangServer(opts.Server.Port, opts.Server.Key)
+		var cfg *serverConfig
+		cfg, err = readServerConfig(opts.Server.Config)
+		if err == nil {
+			applyServerFlags(cfg, opts.Server, func(name string) bool {
+				o := parser.Active.FindOptionByLongName(name)
+				return o != nil && o.IsSet() && !o.IsSetDefault()
+			})
+			err = startTangServer(cfg)
+		}
 	case "unlock":
-		err = unlock(opts.Unlock.Args.Address, opts.Unlock.Args.Key)
+		o := opts.Unlock
+		var audit func(tang.AuditEvent)
+		audit, err = auditHook(o.AuditLog, false)
+		switch {
+		case err != nil:
+		case o.Inventory != "":
+			if o.Args.Address != "" {
+				err = fmt.Errorf("address and key arguments cannot be used together with --inventory")
+				break
+			}
+			defaults := inventoryHost{
+				Timeout:    o.Timeout,
+				Retry:      &o.Retry,
+				TLS:        o.TLS,
+				TLSPin:     o.TLSPin,
+				TLSPinCert: o.TLSPinCert,
+				TokenFile:  o.TokenFile,
+				AllowThp:   o.AllowThp,
+			}
+			err = unlockInventory(o.Inventory, defaults, o.Concurrency, o.Report, audit)
+		case o.Args.Address == "" || len(o.Args.Key) == 0:
+			err = fmt.Errorf("address and key arguments are required")
+		default:
+			var revOpts tang.ReverseOptions
+			revOpts, err = reverseOptions(o.Timeout, o.Retry, o.TLS, o.TLSPin, o.TLSPinCert, o.TokenFile, o.AllowThp)
+			if err == nil {
+				revOpts.Audit = audit
+				err = unlock(o.Args.Address, o.Args.Key, revOpts)
+			}
+		}
+	case "reverse-listen":
+		o := opts.ReverseListen
+		err = reverseListen(o.Port, o.Timeout, o.TLSCert, o.TLSKey, o.TokenFile, o.AllowThp, o.AuditLog, o.Args.Key)
+	case "keys":
+		switch parser.Active.Active.Name {
+		case "list":
+			err = listKeys(opts.Keys.List.Args.Dir, opts.Keys.List.Output)
+		case "inspect":
+			err = inspectKey(opts.Keys.Inspect.Args.Key, opts.Keys.Inspect.Output)
+		case "set-validity":
+			o := opts.Keys.SetValidity
+			err = setKeyValidity(o.Args.Dir, o.Args.Thp, o.NotBefore, o.AdvertiseUntil, o.RecoverUntil)
+		}
+	case "fsck":
+		err = checkKeyDir(opts.Fsck.Args.Dir, opts.Fsck.Fix)
+	case "migrate":
+		err = migrateKeys(opts.Migrate.From, opts.Migrate.To, opts.Migrate.Cache, opts.Migrate.DryRun)
+	case "backup":
+		o := opts.Backup
+		if o.Shares != 0 || o.Threshold != 0 {
+			err = sharedBackupKeys(o.Args.Dir, o.Output, o.Shares, o.Threshold)
+		} else {
+			err = backupKeys(o.Args.Dir, o.Output, o.PassphraseFile)
+		}
+	case "restore":
+		o := opts.Restore
+		err = restoreKeys(o.Args.Backup, o.Args.Dir, o.PassphraseFile, o.Share, o.Force)
+	case "split-key":
+		err = splitKeys(opts.SplitKey.Args.Dir, opts.SplitKey.OutputDir, opts.SplitKey.Shares)
+	case "replication":
+		o := opts.Replication.Status
+		err = replicationStatus(o.Args.Dir, o.Output, o.MaxLag)
+	case "audit":
+		switch parser.Active.Active.Name {
+		case "verify":
+			err = verifyAuditLog(opts.Audit.Verify.Args.Log)
+		case "repair":
+			err = repairAuditLog(opts.Audit.Repair.Args.Log)
+		case "query":
+			o := opts.Audit.Query
+			err = queryAuditLog(o.Args.Log, auditFilter{thp: o.Thp, client: o.Client, action: o.Action, since: o.Since, until: o.Until}, o.Output)
+		}
+	case "config":
+		err = checkConfig(opts.Config.Check.Args.Config, opts.Config.Check.Show)
+	case "approvals":
+		o := opts.Approvals
+		client := adminClientOptions{url: o.AdminURL, tokenFile: o.TokenFile, caCert: o.CACert, clientCert: o.ClientCert, clientKey: o.ClientKey}
+		switch parser.Active.Active.Name {
+		case "list":
+			err = listApprovals(client, o.List.Output)
+		case "approve":
+			err = decideApproval(client, o.Approve.Args.ID, true)
+		case "deny":
+			err = decideApproval(client, o.Deny.Args.ID, false)
+		case "require":
+			err = requireApproval(client, o.Require.Args.Thp, !o.Require.Disable)
+		}
 	}
 
 	if err != nil {
@@ -92,11 +356,9 @@ func unpackKey(outDir, alg, key string) error {
 		return err
 	}
 
-	var h crypto.Hash
-	if alg == "" {
-		h = defaultAlgo
-	} else {
-		h, err = byHashName(alg)
+	h := tang.ThumbprintHash
+	if alg != "" {
+		h, err = tang.ParseThumbprintHash(alg)
 		if err != nil {
 			return err
 		}
@@ -118,7 +380,7 @@ func unpackKey(outDir, alg, key string) error {
 			return err
 		}
 		name := base64.RawURLEncoding.EncodeToString(thp)
-		if err := os.WriteFile(path.Join(outDir, name+".jwk"), keyData, 0o644); err != nil {
+		if err := os.WriteFile(path.Join(outDir, name+".jwk"), keyData, 0o600); err != nil {
 			return err
 		}
 	}
@@ -126,39 +388,207 @@ func unpackKey(outDir, alg, key string) error {
 	return nil
 }
 
-func unlock(address string, key []string) error {
+func unlock(address string, key []string, opts tang.ReverseOptions) error {
 	ks, err := tang.ReadKeys(key...)
 	if err != nil {
 		return err
 	}
 
-	return tang.ReverseTangHandshake(address, ks)
+	return tang.ReverseTangHandshakeContext(context.Background(), address, ks, opts)
+}
+
+// reverseOptions builds reverse handshake options out of the command line flags
+func reverseOptions(timeout time.Duration, retry int, useTLS bool, pins, pinCerts []string, tokenFile string, allowedThps []string) (tang.ReverseOptions, error) {
+	opts := tang.ReverseOptions{
+		DialTimeout:        timeout,
+		IOTimeout:          timeout,
+		Retries:            retry,
+		AllowedThumbprints: allowedThps,
+	}
+
+	var pinBytes [][]byte
+	for _, p := range pins {
+		b, err := base64.StdEncoding.DecodeString(p)
+		if err != nil {
+			return opts, fmt.Errorf("invalid pin %s: %v", p, err)
+		}
+		if len(b) != sha256.Size {
+			return opts, fmt.Errorf("invalid pin %s: expected SHA-256 fingerprint", p)
+		}
+		pinBytes = append(pinBytes, b)
+	}
+	for _, fn := range pinCerts {
+		cert, err := readCertificate(fn)
+		if err != nil {
+			return opts, err
+		}
+		pin := sha256.Sum256(cert.Raw)
+		pinBytes = append(pinBytes, pin[:])
+	}
+
+	if len(pinBytes) != 0 {
+		opts.TLSConfig = tang.PinnedTLSConfig(pinBytes...)
+	} else if useTLS {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	if tokenFile != "" {
+		token, err := readToken(tokenFile)
+		if err != nil {
+			return opts, err
+		}
+		opts.Token = token
+	}
+
+	return opts, nil
+}
+
+func readCertificate(filename string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no PEM certificate found", filename)
+	}
+	return x509.ParseCertificate(block.Bytes)
 }
 
-func startTangServer(port int, key []string) error {
+func readToken(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%s: token is empty", filename)
+	}
+	return token, nil
+}
+
+func reverseListen(port int, timeout time.Duration, tlsCert, tlsKey, tokenFile string, allowedThps []string, auditLog string, key []string) error {
 	var err error
 
-	srv := tang.NewServer()
+	srv := tang.NewReverseServer()
 	srv.Keys, err = tang.ReadKeys(key...)
 	if err != nil {
 		return err
 	}
+	if srv.Audit, err = auditHook(auditLog, false); err != nil {
+		return err
+	}
 	srv.Addr = ":" + strconv.Itoa(port)
+	srv.Timeout = timeout
+	srv.AllowedThumbprints = allowedThps
+
+	if tlsCert != "" || tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	if tokenFile != "" {
+		srv.Token, err = readToken(tokenFile)
+		if err != nil {
+			return err
+		}
+	}
+
 	return srv.ListenAndServe()
 }
 
-func byHashName(name string) (crypto.Hash, error) {
-	switch name {
-	case "sha1":
-		return crypto.SHA1, nil
-	case "sha256":
-		return crypto.SHA256, nil
-	default:
-		return 0, fmt.Errorf("unknown hash algorithm: %s", name)
+func startTangServer(cfg *serverConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if cfg.Log.File != "" {
+		f, err := os.OpenFile(cfg.Log.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(f)
+	}
+
+	var err error
+	srv := tang.NewServer()
+	if srv.Audit, err = auditHook(cfg.Log.Audit, cfg.Log.AuditRepair); err != nil {
+		return err
+	}
+	srv.Approvals = tang.NewApprovalQueue()
+	srv.Approvals.Window, srv.Approvals.Timeout = cfg.Policy.ApprovalWindow, cfg.Policy.ApprovalTimeout
+	srv.Approvals.MaxPending, srv.Approvals.MaxPendingPerRemote = cfg.Policy.MaxPendingApprovals, cfg.Policy.MaxPendingApprovalsPerRemote
+	srv.MaxAge = cfg.Advertise.MaxAge
+	srv.ReadHeaderTimeout = cfg.Limits.ReadHeaderTimeout
+	srv.ReadTimeout = cfg.Limits.ReadTimeout
+	srv.WriteTimeout = cfg.Limits.WriteTimeout
+	srv.IdleTimeout = cfg.Limits.IdleTimeout
+	srv.MaxHeaderBytes = cfg.Limits.MaxHeaderBytes
+
+	policy, err := cfg.Policy.keyPolicy()
+	if err != nil {
+		return err
+	}
+	// a follower loads its keys after the initial replication
+	if cfg.Replication.Primary == "" {
+		keys, err := policy.load(cfg.Keys...)
+		if err != nil {
+			return err
+		}
+		srv.SetKeys(keys)
+	}
+
+	var replicationErr, adminErr, metricsErr <-chan error
+	if cfg.Replication.Port != 0 || cfg.Replication.Primary != "" {
+		replicationErr, err = startReplication(srv, cfg.Keys, policy, cfg.Replication)
+		if err != nil {
+			return err
+		}
 	}
+	if cfg.Admin.Port != 0 {
+		adminErr, err = startAdmin(srv, cfg.Keys, policy, cfg.Admin)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Metrics.Port != 0 {
+		metricsErr = startMetrics(cfg.Metrics)
+	}
+	srv.Addr = net.JoinHostPort(cfg.Listen.Address, strconv.Itoa(cfg.Listen.Port))
+
+	errCh := make(chan error, 1)
+	go func() {
+		if cfg.Listen.TLS.enabled() {
+			errCh <- srv.ListenAndServeTLS(cfg.Listen.TLS.Cert, cfg.Listen.TLS.Key)
+		} else {
+			errCh <- srv.ListenAndServe()
+		}
+	}()
+	select {
+	case err = <-errCh:
+	case err = <-replicationErr:
+		err = fmt.Errorf("replication: %v", err)
+	case err = <-adminErr:
+		err = fmt.Errorf("admin API: %v", err)
+	case err = <-metricsErr:
+		err = fmt.Errorf("metrics: %v", err)
+	}
+	return err
 }
 
-func generateThumbprint(alg string, key string) error {
+// startMetrics serves the expvar metrics of the process
+func startMetrics(cfg metricsConfig) <-chan error {
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Path, expvar.Handler())
+	metrics := &http.Server{Addr: ":" + strconv.Itoa(cfg.Port), Handler: mux}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- metrics.ListenAndServe() }()
+	return errCh
+}
+
+func generateThumbprint(alg string, all bool, key string) error {
 	data, err := os.ReadFile(key)
 	if err != nil {
 		return err
@@ -168,11 +598,9 @@ func generateThumbprint(alg string, key string) error {
 		return err
 	}
 
-	var h crypto.Hash
-	if alg == "" {
-		h = defaultAlgo
-	} else {
-		h, err = byHashName(alg)
+	h := tang.ThumbprintHash
+	if alg != "" {
+		h, err = tang.ParseThumbprintHash(alg)
 		if err != nil {
 			return err
 		}
@@ -184,6 +612,20 @@ func generateThumbprint(alg string, key string) error {
 			return fmt.Errorf("failed to get key at index %d", i)
 		}
 
+		if all {
+			if i != 0 {
+				fmt.Println()
+			}
+			for _, a := range tang.ThumbprintHashes() {
+				thp, err := key.Thumbprint(a)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s\t%s\n", tang.HashName(a), base64.RawURLEncoding.EncodeToString(thp))
+			}
+			continue
+		}
+
 		thp, err := key.Thumbprint(h)
 		if err != nil {
 			return err
@@ -204,8 +646,12 @@ func generateAdvertisement(keys []string) error {
 	return nil
 }
 
-func createKey() error {
-	vk, err := tang.GenerateVerifyKey()
+func createKey(signAlg string) error {
+	alg := jwa.ES512()
+	if signAlg == "eddsa" {
+		alg = jwa.EdDSA()
+	}
+	vk, err := tang.GenerateSignKey(alg)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/anatol/tang.go"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+)
+
+// migratedKey maps a key from a legacy directory to its file in the new layout
+type migratedKey struct {
+	source     string
+	index      int
+	key        jwk.Key
+	thumbprint string
+	advertised bool
+}
+
+// migrateKeys converts a legacy tangd key directory (jose generated files, possibly with multiple
+// keys per file) into the one-key-per-file layout and verifies that the resulting key set is identical.
+// If cacheDir is set, the precomputed tangd cache is checked against the migrated keys as well.
+func migrateKeys(from, to, cacheDir string, dryRun bool) error {
+	keys, skipped, err := readLegacyKeys(from)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys found in %s", from)
+	}
+
+	if !dryRun {
+		if err := os.MkdirAll(to, 0o750); err != nil {
+			return err
+		}
+		store := tang.NewKeyStore(to)
+		for _, k := range keys {
+			if _, err := store.Put(k.key, k.advertised); err != nil {
+				return fmt.Errorf("%s: %v", k.source, err)
+			}
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tSTATUS\tDESTINATION")
+	for _, k := range keys {
+		source := k.source
+		if k.index != 0 {
+			source = fmt.Sprintf("%s[%d]", k.source, k.index)
+		}
+		status := "advertised"
+		name := k.thumbprint + ".jwk"
+		if !k.advertised {
+			status = "hidden"
+			name = "." + name
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", source, status, path.Join(to, name))
+	}
+	for _, s := range skipped {
+		fmt.Fprintf(w, "%s\tskipped\t-\n", s)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if cacheDir != "" {
+		if err := verifyLegacyCache(cacheDir, keys); err != nil {
+			return err
+		}
+		fmt.Printf("cache %s matches the migrated keys\n", cacheDir)
+	}
+
+	if dryRun {
+		return nil
+	}
+	if err := verifyMigration(to, keys); err != nil {
+		return err
+	}
+	fmt.Printf("verified %d keys in %s\n", len(keys), to)
+	return nil
+}
+
+// readLegacyKeys reads all private keys from *.jwk files of the directory. Each key is returned once,
+// a key present in several files has to have the same advertised state in all of them.
+func readLegacyKeys(dir string) ([]migratedKey, []string, error) {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var keys []migratedKey
+	var skipped []string
+	byThp := make(map[string]int)
+
+	for _, e := range ents {
+		fn := path.Join(dir, e.Name())
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".jwk") {
+			skipped = append(skipped, fn)
+			continue
+		}
+
+		data, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, nil, err
+		}
+		set, err := jwk.Parse(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", fn, err)
+		}
+
+		advertised := e.Name()[0] != '.'
+		for i := range set.Len() {
+			key, ok := set.Key(i)
+			if !ok {
+				return nil, nil, fmt.Errorf("unable to get key from set %s", fn)
+			}
+			private, err := jwk.IsPrivateKey(key)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", fn, err)
+			}
+			if !private {
+				skipped = append(skipped, fmt.Sprintf("%s[%d] (public key)", fn, i))
+				continue
+			}
+
+			thp, err := defaultThumbprint(key)
+			if err != nil {
+				return nil, nil, err
+			}
+			if idx, ok := byThp[thp]; ok {
+				if keys[idx].advertised != advertised {
+					return nil, nil, fmt.Errorf("key %s is both advertised and hidden: %s and %s", thp, keys[idx].source, fn)
+				}
+				skipped = append(skipped, fmt.Sprintf("%s[%d] (duplicate of %s)", fn, i, keys[idx].source))
+				continue
+			}
+
+			byThp[thp] = len(keys)
+			keys = append(keys, migratedKey{
+				source:     fn,
+				index:      i,
+				key:        key,
+				thumbprint: thp,
+				advertised: advertised,
+			})
+		}
+	}
+
+	return keys, skipped, nil
+}
+
+// verifyMigration checks that the destination contains exactly the migrated keys with the same state
+func verifyMigration(dir string, keys []migratedKey) error {
+	stored, err := tang.NewKeyStore(dir).Keys()
+	if err != nil {
+		return err
+	}
+
+	byThp := make(map[string]tang.StoredKey)
+	for _, s := range stored {
+		byThp[s.Thumbprint] = s
+	}
+
+	for _, k := range keys {
+		s, ok := byThp[k.thumbprint]
+		if !ok {
+			return fmt.Errorf("verification failed: key %s is missing in %s", k.thumbprint, dir)
+		}
+		if !jwk.Equal(s.Key, k.key) {
+			return fmt.Errorf("verification failed: key %s differs from %s", s.Filename, k.source)
+		}
+		if s.Advertised != k.advertised {
+			return fmt.Errorf("verification failed: key %s has different advertised state than %s", s.Filename, k.source)
+		}
+		delete(byThp, k.thumbprint)
+	}
+	for _, s := range byThp {
+		return fmt.Errorf("verification failed: %s contains key %s that is not in the source directory", dir, s.Filename)
+	}
+
+	// make sure the server is able to start with the new directory
+	_, err = tang.ReadKeys(dir)
+	return err
+}
+
+// verifyLegacyCache checks the files precomputed by old tangd versions against the migrated keys:
+// default.jws has to advertise exactly the advertised keys, and every cached <thp>.jws and <thp>.jwk
+// has to refer to a migrated key.
+func verifyLegacyCache(cacheDir string, keys []migratedKey) error {
+	// thumbprints of all hashes, tangd versions differ in the hash used for cache file names
+	known := make(map[string]*migratedKey)
+	for i := range keys {
+		for _, a := range tang.ThumbprintHashes() {
+			thp, err := keys[i].key.Thumbprint(a)
+			if err != nil {
+				return err
+			}
+			known[base64.RawURLEncoding.EncodeToString(thp)] = &keys[i]
+		}
+	}
+
+	ents, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range ents {
+		name := e.Name()
+		switch {
+		case name == "default.jws":
+			if err := verifyCachedAdvertisement(path.Join(cacheDir, name), keys); err != nil {
+				return err
+			}
+		case strings.HasSuffix(name, ".jws") || strings.HasSuffix(name, ".jwk"):
+			thp := strings.TrimSuffix(strings.TrimSuffix(name, ".jws"), ".jwk")
+			if _, ok := known[thp]; !ok {
+				return fmt.Errorf("cache file %s refers to a key that is not migrated", name)
+			}
+		}
+	}
+	return nil
+}
+
+func verifyCachedAdvertisement(filename string, keys []migratedKey) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	set, err := tang.VerifyAdvertisement(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+
+	advertised := make(map[string]bool)
+	for _, k := range keys {
+		if k.advertised {
+			advertised[k.thumbprint] = true
+		}
+	}
+
+	for i := range set.Len() {
+		key, _ := set.Key(i)
+		thp, err := defaultThumbprint(key)
+		if err != nil {
+			return err
+		}
+		if !advertised[thp] {
+			return fmt.Errorf("%s advertises key %s that is not advertised after migration", filename, thp)
+		}
+		delete(advertised, thp)
+	}
+	for thp := range advertised {
+		return fmt.Errorf("key %s is advertised after migration but not in %s", thp, filename)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/anatol/tang.go"
+)
+
+// replicationOptions configures the server as a replication primary or follower
+type replicationOptions struct {
+	// Port of the snapshot listener of a primary
+	Port int `yaml:"port"`
+	// Primary is the URL of the primary a follower replicates from
+	Primary    string        `yaml:"primary"`
+	SecretFile string        `yaml:"secret-file"`
+	Interval   time.Duration `yaml:"interval"`
+}
+
+// serverKeyStore returns the key store of a server that manages its keys, it has to be the only key directory
+func serverKeyStore(key []string, policy keyPolicy, feature string) (*tang.KeyStore, error) {
+	if len(key) != 1 {
+		return nil, fmt.Errorf("%s requires exactly one key directory", feature)
+	}
+	fi, err := os.Stat(key[0])
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s requires a key directory, %s is a file", feature, key[0])
+	}
+	return policy.store(key[0]), nil
+}
+
+// startReplication starts serving snapshots or following the primary. A follower loads the keys
+// into the server after the initial replication, so a new follower starts with the keys of the primary.
+func startReplication(srv *tang.Server, key []string, policy keyPolicy, opts replicationOptions) (<-chan error, error) {
+	secret, err := readToken(opts.SecretFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := tang.CheckReplicationSecret([]byte(secret)); err != nil {
+		return nil, fmt.Errorf("%s: %v", opts.SecretFile, err)
+	}
+	store, err := serverKeyStore(key, policy, "replication")
+	if err != nil {
+		return nil, err
+	}
+
+	errCh := make(chan error, 1)
+	if opts.Port != 0 {
+		source := &http.Server{
+			Addr:    ":" + strconv.Itoa(opts.Port),
+			Handler: tang.NewReplicationSource(store, []byte(secret)),
+		}
+		go func() { errCh <- source.ListenAndServe() }()
+		return errCh, nil
+	}
+
+	follower := tang.NewReplicationFollower(opts.Primary, store, []byte(secret))
+	if opts.Interval != 0 {
+		follower.Interval = opts.Interval
+	}
+	if _, err := follower.Sync(context.Background()); err != nil {
+		log.Printf("initial replication from %s failed, serving local keys: %v", opts.Primary, err)
+	}
+	keys, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	srv.SetKeys(keys)
+
+	follower.OnUpdate = srv.SetKeys
+	go func() { errCh <- follower.Run(context.Background()) }()
+	return errCh, nil
+}
+
+// replicationStatus prints the replication state of a follower key directory. If maxLag is set,
+// an error is returned when the follower has not synced within that time.
+func replicationStatus(dir, output string, maxLag time.Duration) error {
+	status, err := tang.ReadReplicationStatus(tang.NewKeyStore(dir))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s is not a replication follower", dir)
+	} else if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	lag := status.Lag(now)
+	switch output {
+	case "json":
+		data, err := json.MarshalIndent(struct {
+			*tang.ReplicationStatus
+			LagSeconds float64 `json:"lag_seconds"`
+		}{status, lag.Seconds()}, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "primary:\t%s\n", status.Primary)
+		fmt.Fprintf(w, "last attempt:\t%s\n", formatTime(status.LastAttempt))
+		fmt.Fprintf(w, "last sync:\t%s\n", formatTime(status.LastSync))
+		fmt.Fprintf(w, "snapshot created:\t%s\n", formatTime(status.SnapshotCreated))
+		if status.LastSync.IsZero() {
+			fmt.Fprintf(w, "lag:\tnever synced\n")
+		} else {
+			fmt.Fprintf(w, "lag:\t%s\n", lag.Round(time.Second))
+		}
+		fmt.Fprintf(w, "keys:\t%d\n", status.Keys)
+		fmt.Fprintf(w, "last error:\t%s\n", valueOrNone(status.LastError))
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if maxLag != 0 && (status.LastSync.IsZero() || lag > maxLag) {
+		return fmt.Errorf("replication lag exceeds %v", maxLag)
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format(time.RFC3339)
+}
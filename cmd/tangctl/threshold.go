@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/anatol/tang.go"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+)
+
+// splitKeys creates a key directory for each of the n Tang instances of a threshold setup.
+// Exchange keys are split into partial keys, all other keys are copied to every instance.
+func splitKeys(dir, outDir string, n int) error {
+	keys, err := tang.NewKeyStore(dir).Keys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys found in %s", dir)
+	}
+
+	stores := make([]*tang.KeyStore, n)
+	for i := range stores {
+		shareDir := path.Join(outDir, fmt.Sprintf("share-%d", i+1))
+		if err := os.MkdirAll(shareDir, 0o750); err != nil {
+			return err
+		}
+		stores[i] = tang.NewKeyStore(shareDir)
+	}
+
+	for _, k := range keys {
+		parts := make([]jwk.Key, n)
+		if isExchangeKey(k.Key) {
+			parts, err = tang.SplitExchangeKey(k.Key, n)
+			if err != nil {
+				return fmt.Errorf("%s: %v", k.Filename, err)
+			}
+			fmt.Printf("%s: split into %d parts\n", k.Thumbprint, n)
+		} else {
+			for i := range parts {
+				parts[i] = k.Key
+			}
+			fmt.Printf("%s: copied\n", k.Thumbprint)
+		}
+
+		for i, s := range stores {
+			if _, err := s.Put(parts[i], k.Advertised); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Printf("serve each of %s/share-1 .. share-%d with its own Tang instance\n", outDir, n)
+	return nil
+}
+
+func isExchangeKey(k jwk.Key) bool {
+	alg, ok := k.Algorithm()
+	if !ok || alg.String() != "ECMR" {
+		return false
+	}
+	ops, ok := k.KeyOps()
+	if !ok {
+		return true
+	}
+	return slices.Contains(ops, jwk.KeyOpDeriveKey)
+}
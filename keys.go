@@ -1,18 +1,22 @@
 package tang
 
 import (
-	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/lestrrat-go/jwx/v3/jwa"
 	"github.com/lestrrat-go/jwx/v3/jwk"
@@ -33,23 +37,52 @@ var algos = []crypto.Hash{
 	crypto.SHA512, /* S512 */
 }
 
+var (
+	// ErrThumbprintHashNotAllowed is returned when a key is looked up by a thumbprint of a hash outside KeySet.ThumbprintHashes
+	ErrThumbprintHashNotAllowed = errors.New("thumbprint hash is not allowed")
+	// ErrDuplicateKey is returned by AppendKey for a key that is already in the set if KeySet.RejectDuplicates is set
+	ErrDuplicateKey = errors.New("duplicate key")
+)
+
 // KeySet represents a set of all keys handled by Tang
 type KeySet struct {
-	keys                 []*tangKey
-	byThumbprint         map[string]*tangKey // base64(thumbprint)->key map
+	keys           []*tangKey
+	byThumbprint   map[string]*tangKey    // base64(thumbprint)->key map
+	thumbprintHash map[string]crypto.Hash // base64(thumbprint)->hash map
+	// ThumbprintHashes are the hashes clients may identify keys with, nil allows all supported hashes.
+	// It has to be set before the set is served.
+	ThumbprintHashes []crypto.Hash
+	// RejectDuplicates makes AppendKey fail for keys already in the set, otherwise the copy with the stronger
+	// status is kept. It has to be set before keys are added.
+	RejectDuplicates     bool
 	DefaultAdvertisement []byte
+	// defaultETag is the entity tag of DefaultAdvertisement
+	defaultETag string
+	// defaultSigner is the key signing the single-signature serializations of the default advertisement
+	defaultSigner *tangKey
+	// nextChange is the first validity bound of a key after the advertisements were computed
+	nextChange time.Time
 }
 
 type tangKey struct {
 	jwk.Key
-	advertised    bool
-	advertisement []byte
+	advertised bool
+	state      KeyState
+	// approvalRequired keys recover only after an operator approved the request
+	approvalRequired bool
+	validity         KeyValidity
+	advertisement    []byte
+	etag             string
+	// flattened and compact are the advertisement signed by this key only
+	flattened serialization
+	compact   serialization
 }
 
 // NewKeySet creates a new KeySet instance
 func NewKeySet() *KeySet {
 	set := &KeySet{}
 	set.byThumbprint = make(map[string]*tangKey)
+	set.thumbprintHash = make(map[string]crypto.Hash)
 	return set
 }
 
@@ -69,9 +102,25 @@ func (ks *KeySet) addKey(filename string, advertised bool) error {
 			return fmt.Errorf("unable to get key from set %s", filename)
 		}
 
-		if err := ks.AppendKey(key, advertised); err != nil {
+		thp, err := thumbprint(key, ThumbprintHash)
+		if err != nil {
 			return err
 		}
+		k, err := newTangKey(key, advertised)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+		existing, duplicate := ks.byThumbprint[thp]
+		restricted := duplicate && !existing.sameRestrictions(k)
+		if err := ks.appendKey(k); err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+		if duplicate {
+			log.Printf("key %s in %s is loaded already, keeping the %s copy", thp, filename, existing.status())
+		}
+		if restricted {
+			log.Printf("key %s in %s has a different approval requirement or validity than the loaded copy, the most restrictive of both applies", thp, filename)
+		}
 	}
 
 	return nil
@@ -82,17 +131,24 @@ func (ks *KeySet) addKey(filename string, advertised bool) error {
 // In case of directory scanning only files with *.jwk suffix are parsed as keys, other files are ignored
 func ReadKeys(keyOrDir ...string) (*KeySet, error) {
 	ks := NewKeySet()
+	if err := ks.Load(keyOrDir...); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
 
+// Load adds the keys of the files and directories to the set like ReadKeys does and recomputes the advertisements
+func (ks *KeySet) Load(keyOrDir ...string) error {
 	for _, k := range keyOrDir {
 		fi, err := os.Stat(k)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		if fi.IsDir() {
 			ents, err := os.ReadDir(k)
 			if err != nil {
-				return nil, fmt.Errorf("unable to read keys from %s: %v", k, err)
+				return fmt.Errorf("unable to read keys from %s: %v", k, err)
 			}
 
 			for _, e := range ents {
@@ -102,31 +158,39 @@ func ReadKeys(keyOrDir ...string) (*KeySet, error) {
 				fn := path.Join(k, e.Name())
 				advertised := e.Name()[0] != '.'
 				if err := ks.addKey(fn, advertised); err != nil {
-					return nil, err
+					return err
 				}
 			}
 		} else {
 			advertised := path.Base(k)[0] != '.'
 			if err := ks.addKey(k, advertised); err != nil {
-				return nil, err
+				return err
 			}
 		}
 	}
 
-	if err := ks.RecomputeAdvertisements(); err != nil {
-		return nil, err
-	}
-
-	return ks, nil
+	return ks.RecomputeAdvertisements()
 }
 
-// RecomputeAdvertisements recomputes advertisement files for the keys and default for the KeySet itself
+// RecomputeAdvertisements recomputes advertisement files for the keys and default for the KeySet itself.
+// Keys outside of their validity bounds at the time of the call are not advertised.
 func (ks *KeySet) RecomputeAdvertisements() error {
+	return ks.recomputeAdvertisements(time.Now())
+}
+
+func (ks *KeySet) recomputeAdvertisements(now time.Time) error {
 	advertisedKeys := jwk.NewSet()
 	signKeys := jwk.NewSet()
 
+	ks.nextChange = time.Time{}
+	for _, k := range ks.keys {
+		if next := k.validity.nextChange(now); !next.IsZero() && (ks.nextChange.IsZero() || next.Before(ks.nextChange)) {
+			ks.nextChange = next
+		}
+	}
+
 	for _, k := range ks.keys {
-		if k.advertised {
+		if k.advertised && k.state == KeyStateActive && k.validity.Advertisable(now) {
 			if keyValidForUse(k, []jwk.KeyOperation{jwk.KeyOpVerify, jwk.KeyOpSign}) {
 				signKeys.AddKey(k)
 				advertisedKeys.AddKey(k)
@@ -148,6 +212,9 @@ func (ks *KeySet) RecomputeAdvertisements() error {
 	if err != nil {
 		return err
 	}
+	if err := stripPrivateParams(advertisedKeys); err != nil {
+		return err
+	}
 
 	payload, err := json.Marshal(advertisedKeys)
 	if err != nil {
@@ -160,11 +227,24 @@ func (ks *KeySet) RecomputeAdvertisements() error {
 	}
 
 	ks.DefaultAdvertisement = defaultAdvertisement
+	ks.defaultETag = advertisementETag(defaultAdvertisement)
+	ks.defaultSigner = nil
 
 	for _, k := range ks.keys {
+		k.advertisement, k.etag = nil, ""
+		k.flattened, k.compact = serialization{}, serialization{}
+		if k.state == KeyStateRevoked || k.validity.Recoverable(now) != nil {
+			continue
+		}
 		if keyValidForUse(k, []jwk.KeyOperation{jwk.KeyOpSign}) {
-			if k.advertised {
-				k.advertisement = ks.DefaultAdvertisement
+			if k.flattened, k.compact, err = signSingle(payload, k); err != nil {
+				return err
+			}
+			if k.advertised && k.state == KeyStateActive && k.validity.Advertisable(now) {
+				k.advertisement, k.etag = ks.DefaultAdvertisement, ks.defaultETag
+				if ks.defaultSigner == nil {
+					ks.defaultSigner = k
+				}
 			} else {
 				// non-advertised sets need to additionally sign payload with advertised key
 				signSet, err := signKeys.Clone()
@@ -176,7 +256,7 @@ func (ks *KeySet) RecomputeAdvertisements() error {
 				if err != nil {
 					return err
 				}
-				k.advertisement = advertisement
+				k.advertisement, k.etag = advertisement, advertisementETag(advertisement)
 			}
 		}
 	}
@@ -184,28 +264,240 @@ func (ks *KeySet) RecomputeAdvertisements() error {
 	return nil
 }
 
+// advertisementETag returns a strong entity tag of the advertisement derived from its content. The signatures
+// are randomized and a reload signs every advertisement again, so a reload invalidates all tags, also the ones
+// of advertisements whose keys did not change.
+func advertisementETag(advertisement []byte) string {
+	sum := sha256.Sum256(advertisement)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:]) + `"`
+}
+
+// stale reports whether a validity bound of a key has passed since the advertisements were computed
+func (ks *KeySet) stale(now time.Time) bool {
+	return !ks.nextChange.IsZero() && !now.Before(ks.nextChange)
+}
+
+// refreshed returns a copy of the key set with the advertisements recomputed for the given time. If no key
+// can be advertised anymore, the copy has no advertisements but still recovers with the keys that are valid.
+func (ks *KeySet) refreshed(now time.Time) *KeySet {
+	fresh := NewKeySet()
+	fresh.ThumbprintHashes, fresh.RejectDuplicates = ks.ThumbprintHashes, ks.RejectDuplicates
+	for _, k := range ks.keys {
+		fresh.appendKey(&tangKey{Key: k.Key, advertised: k.advertised, state: k.state, approvalRequired: k.approvalRequired, validity: k.validity})
+	}
+	if err := fresh.recomputeAdvertisements(now); err != nil {
+		log.Printf("unable to recompute advertisements after a key validity change: %v", err)
+	}
+	return fresh
+}
+
 // AppendKey appends the given key to the KeySet. Advertisements are not recalculated.
+// Keys that are deprecated or revoked according to their metadata are never advertised.
 func (ks *KeySet) AppendKey(jwkKey jwk.Key, advertised bool) error {
-	k := &tangKey{jwkKey, advertised, nil}
+	k, err := newTangKey(jwkKey, advertised)
+	if err != nil {
+		return err
+	}
+	return ks.appendKey(k)
+}
 
-	ks.keys = append(ks.keys, k)
+// newTangKey reads the lifecycle metadata of the key
+func newTangKey(jwkKey jwk.Key, advertised bool) (*tangKey, error) {
+	state, err := KeyStateOf(jwkKey)
+	if err != nil {
+		return nil, err
+	}
+	approvalRequired, err := ApprovalRequired(jwkKey)
+	if err != nil {
+		return nil, err
+	}
+	validity, err := KeyValidityOf(jwkKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tangKey{Key: jwkKey, advertised: advertised, state: state, approvalRequired: approvalRequired, validity: validity}, nil
+}
 
-	for _, a := range algos {
-		thpBytes, err := k.Thumbprint(a)
+func (ks *KeySet) appendKey(k *tangKey) error {
+	thps := make([]string, len(algos))
+	for i, a := range algos {
+		thp, err := thumbprint(k, a)
 		if err != nil {
 			return err
 		}
-		thp := base64.RawURLEncoding.EncodeToString(thpBytes)
+		thps[i] = thp
+	}
+
+	canonical, err := thumbprint(k, ThumbprintHash)
+	if err != nil {
+		return err
+	}
+	if existing, found := ks.byThumbprint[canonical]; found {
+		if ks.RejectDuplicates {
+			return fmt.Errorf("%w: %s", ErrDuplicateKey, canonical)
+		}
+		// the copy is replaced in place, so the lookups and the order of the keys stay the same
+		*existing = *existing.merge(k)
+		return nil
+	}
+	for i, thp := range thps {
+		if _, found := ks.byThumbprint[thp]; found {
+			return fmt.Errorf("%s thumbprint %s of key %s belongs to another key", HashName(algos[i]), thp, canonical)
+		}
+	}
+
+	ks.keys = append(ks.keys, k)
+	for i, thp := range thps {
 		ks.byThumbprint[thp] = k
+		ks.thumbprintHash[thp] = algos[i]
 	}
 
 	return nil
 }
 
-// RecoverKey performs server-side recover of the ECMR algorithm
-func (ks *KeySet) RecoverKey(thp string, webKey jwk.Key) (jwk.Key, error) {
+// stronger reports whether k has a stronger status than the other copy of the same key, see strongerStatus
+func (k *tangKey) stronger(other *tangKey) bool {
+	return strongerStatus(k.advertised, k.state, other.advertised, other.state)
+}
+
+// merge returns the copy of a key the set keeps: the stronger one, see strongerStatus, with the restrictions
+// of both. A stale copy cannot lift an approval requirement or widen the validity bounds of the key.
+func (k *tangKey) merge(other *tangKey) *tangKey {
+	merged := *k
+	if other.stronger(k) {
+		merged = *other
+	}
+	merged.approvalRequired = k.approvalRequired || other.approvalRequired
+	merged.validity = k.validity.Merge(other.validity)
+	return &merged
+}
+
+// sameRestrictions reports whether both copies of a key have the same approval requirement and validity
+func (k *tangKey) sameRestrictions(other *tangKey) bool {
+	return k.approvalRequired == other.approvalRequired && k.validity.Equal(other.validity)
+}
+
+// strongerStatus decides which of two copies of a key is kept. A revocation is the strongest status, so
+// a stale copy cannot bring a revoked key back, then advertised beats hidden and active beats deprecated.
+// Of two copies with the same status the first one is kept.
+func strongerStatus(advertised bool, state KeyState, otherAdvertised bool, otherState KeyState) bool {
+	if revoked := state == KeyStateRevoked; revoked != (otherState == KeyStateRevoked) {
+		return revoked
+	}
+	if advertised != otherAdvertised {
+		return advertised
+	}
+	return state == KeyStateActive && otherState == KeyStateDeprecated
+}
+
+// status describes the advertised and lifecycle state of the key for logs
+func (k *tangKey) status() string {
+	switch {
+	case k.state == KeyStateRevoked:
+		return "revoked"
+	case !k.advertised:
+		return "hidden " + string(k.state)
+	default:
+		return "advertised " + string(k.state)
+	}
+}
+
+// thumbprint computes base64 encoded key thumbprint
+func thumbprint(k jwk.Key, h crypto.Hash) (string, error) {
+	thp, err := k.Thumbprint(h)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(thp), nil
+}
+
+// lookup returns the key identified by thp, or nil if there is none. A thumbprint of a hash outside
+// ThumbprintHashes is refused with ErrThumbprintHashNotAllowed.
+func (ks *KeySet) lookup(thp string) (*tangKey, error) {
 	key, found := ks.byThumbprint[thp]
 	if !found {
+		return nil, nil
+	}
+	if h := ks.thumbprintHash[thp]; ks.ThumbprintHashes != nil && !slices.Contains(ks.ThumbprintHashes, h) {
+		return nil, fmt.Errorf("%w: %s thumbprint %s", ErrThumbprintHashNotAllowed, HashName(h), thp)
+	}
+	return key, nil
+}
+
+// countedLookup is lookup for requests of clients, it counts the hash of the thumbprint
+func (ks *KeySet) countedLookup(thp string) (*tangKey, error) {
+	key, err := ks.lookup(thp)
+	if h, found := ks.thumbprintHash[thp]; found {
+		countThumbprintHash(h, err == nil)
+	}
+	return key, err
+}
+
+// ThumbprintHashes returns the hashes keys are looked up by, in the order of their strength
+func ThumbprintHashes() []crypto.Hash {
+	return slices.Clone(algos)
+}
+
+// HashName returns the name of a thumbprint hash as used in configurations, e.g. "sha256"
+func HashName(h crypto.Hash) string {
+	return strings.ToLower(strings.ReplaceAll(h.String(), "-", ""))
+}
+
+// ParseThumbprintHash returns the thumbprint hash with the given name
+func ParseThumbprintHash(name string) (crypto.Hash, error) {
+	for _, h := range algos {
+		if HashName(h) == name {
+			return h, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported thumbprint hash %q", name)
+}
+
+// thumbprintAllowed checks whether thp identifies the same key as any of the allowed thumbprints.
+// An empty allow-list permits every key.
+func (ks *KeySet) thumbprintAllowed(thp string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	key, found := ks.byThumbprint[thp]
+	if !found {
+		return false
+	}
+	for _, a := range allowed {
+		if k, ok := ks.byThumbprint[a]; ok && k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalThumbprint returns the ThumbprintHash thumbprint of the key identified by thp,
+// or thp itself if the key is unknown
+func (ks *KeySet) canonicalThumbprint(thp string) string {
+	key, found := ks.byThumbprint[thp]
+	if !found {
+		return thp
+	}
+	canonical, err := thumbprint(key, ThumbprintHash)
+	if err != nil {
+		return thp
+	}
+	return canonical
+}
+
+// approvalRequired reports whether recoveries with the key identified by thp need an operator approval
+func (ks *KeySet) approvalRequired(thp string) bool {
+	key, err := ks.lookup(thp)
+	return err == nil && key != nil && key.approvalRequired
+}
+
+// RecoverKey performs server-side recover of the ECMR algorithm
+func (ks *KeySet) RecoverKey(thp string, webKey jwk.Key) (jwk.Key, error) {
+	key, err := ks.countedLookup(thp)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
 		return nil, fmt.Errorf("key '%s' not found", thp)
 	}
 
@@ -221,6 +513,16 @@ func (ks *KeySet) RecoverKey(thp string, webKey jwk.Key) (jwk.Key, error) {
 		return nil, fmt.Errorf("key '%s' is not ECMR", thp)
 	}
 
+	switch key.state {
+	case KeyStateRevoked:
+		return nil, fmt.Errorf("%w: %s", ErrKeyRevoked, thp)
+	case KeyStateDeprecated:
+		log.Printf("recovery with deprecated key %s", thp)
+	}
+	if err := key.validity.Recoverable(time.Now()); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, thp)
+	}
+
 	return key.exchange(webKey)
 }
 
@@ -300,65 +602,100 @@ func keyValidForUse(k jwk.Key, use []jwk.KeyOperation) bool {
 	return true
 }
 
+// signPayload returns the general JSON serialization of the payload signed with every key of the set, also
+// if the set has a single key. The protected headers are serialized with sorted members, so only the signatures
+// differ between advertisements of the same keys.
 func signPayload(payload []byte, signKeys jwk.Set) ([]byte, error) {
-	m := jws.NewMessage()
-	m.SetPayload(payload)
+	type signature struct {
+		Protected string `json:"protected"`
+		Signature string `json:"signature"`
+	}
+	var general struct {
+		Payload    string      `json:"payload"`
+		Signatures []signature `json:"signatures"`
+	}
 	for i := range signKeys.Len() {
 		key, ok := signKeys.Key(i)
 		if !ok {
 			return nil, fmt.Errorf("unable to get key from set")
 		}
-
-		h := jws.NewHeaders()
-		alg, ok := key.Algorithm()
-		if !ok {
-			return nil, fmt.Errorf("key does not have an algorithm")
-		}
-		if err := h.Set(jws.AlgorithmKey, alg); err != nil {
-			return nil, err
-		}
-		if err := h.Set(jws.ContentTypeKey, "jwk-set+json"); err != nil {
-			return nil, err
-		}
-
-		marshalledProtected, err := json.Marshal(h)
+		option, err := signOption(key)
 		if err != nil {
 			return nil, err
 		}
-		var p bytes.Buffer
-		p.WriteString(base64.RawURLEncoding.EncodeToString(marshalledProtected))
-		p.WriteByte('.')
-		p.WriteString(base64.RawURLEncoding.EncodeToString(payload))
-
-		signer, err := jws.SignerFor(alg.(jwa.SignatureAlgorithm))
+		// jws.Sign flattens the JSON serialization of a single signature, so it is assembled from compact ones
+		compact, err := jws.Sign(payload, option)
 		if err != nil {
 			return nil, err
 		}
-		signature, err := signer.Sign(key, p.Bytes())
+		protected, encodedPayload, sig, err := compactParts(compact)
 		if err != nil {
 			return nil, err
 		}
+		general.Payload = encodedPayload
+		general.Signatures = append(general.Signatures, signature{protected, sig})
+	}
+	if len(general.Signatures) == 0 {
+		return nil, fmt.Errorf("no sign keys")
+	}
+	return json.Marshal(general)
+}
 
-		sig := jws.NewSignature()
-		sig.SetProtectedHeaders(h)
-		sig.SetSignature(signature)
-		m.AppendSignature(sig)
+// compactParts splits a compact JWS into its protected header, payload and signature
+func compactParts(compact []byte) (string, string, string, error) {
+	parts := strings.Split(string(compact), ".")
+	if len(parts) != 3 {
+		return "", "", "", fmt.Errorf("malformed compact JWS")
 	}
+	return parts[0], parts[1], parts[2], nil
+}
 
-	advertisement, err := m.MarshalJSON()
+// signOption returns the option signing with the key, its protected header names the key by its thumbprint
+func signOption(key jwk.Key) (jws.SignOption, error) {
+	alg, ok := key.Algorithm()
+	if !ok {
+		return nil, fmt.Errorf("key does not have an algorithm")
+	}
+	signAlg, ok := alg.(jwa.SignatureAlgorithm)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a signature algorithm", alg)
+	}
+	kid, err := thumbprint(key, ThumbprintHash)
 	if err != nil {
 		return nil, err
 	}
-	return advertisement, nil
+
+	h := jws.NewHeaders()
+	if err := h.Set(jws.ContentTypeKey, "jwk-set+json"); err != nil {
+		return nil, err
+	}
+	if err := h.Set(jws.KeyIDKey, kid); err != nil {
+		return nil, err
+	}
+	return jws.WithKey(signAlg, key, jws.WithProtectedHeaders(h)), nil
 }
 
 // GenerateVerifyKey generates a verify/sign key for Tang
 func GenerateVerifyKey() (jwk.Key, error) {
-	k, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	return GenerateSignKey(jwa.ES512())
+}
+
+// GenerateSignKey generates a verify/sign key for the ES512 or EdDSA (Ed25519) algorithm
+func GenerateSignKey(alg jwa.SignatureAlgorithm) (jwk.Key, error) {
+	var raw any
+	var err error
+	switch alg {
+	case jwa.ES512():
+		raw, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case jwa.EdDSA():
+		_, raw, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported sign algorithm %s", alg)
+	}
 	if err != nil {
 		return nil, err
 	}
-	sig, err := jwk.Import(k)
+	sig, err := jwk.Import(raw)
 	if err != nil {
 		return nil, err
 	}
@@ -366,7 +703,7 @@ func GenerateVerifyKey() (jwk.Key, error) {
 	if err := sig.Set(jwk.KeyOpsKey, []jwk.KeyOperation{jwk.KeyOpVerify, jwk.KeyOpSign}); err != nil {
 		return nil, err
 	}
-	if err := sig.Set(jwk.AlgorithmKey, jwa.ES512()); err != nil {
+	if err := sig.Set(jwk.AlgorithmKey, alg); err != nil {
 		return nil, err
 	}
 
@@ -10,10 +10,14 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"math/big"
+	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/lestrrat-go/jwx/v3/jwa"
 	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jws"
 	"github.com/stretchr/testify/require"
 )
 
@@ -39,7 +43,25 @@ func TestReadKeysFromDir(t *testing.T) {
 	sigs := props["signatures"].([]any)
 	require.Equal(t, encodedPayload, props["payload"])
 	protected := sigs[0].(map[string]any)["protected"].(string)
-	require.Equal(t, "eyJhbGciOiJFUzUxMiIsImN0eSI6Imp3ay1zZXQranNvbiJ9", protected)
+	require.Equal(t, "eyJhbGciOiJFUzUxMiIsImN0eSI6Imp3ay1zZXQranNvbiIsImtpZCI6IkQ5UGhiVXNvUlI4WDdKcGxUdGJhMVpFaGdnX05LZl81d2F4SzlrX2dqTGcifQ", protected)
+
+	// every signature verifies on its own with the key named by its kid
+	require.Len(t, sigs, 2)
+	for _, s := range sigs {
+		sig := s.(map[string]any)
+		compact := sig["protected"].(string) + "." + encodedPayload + "." + sig["signature"].(string)
+		msg, err := jws.Parse([]byte(compact))
+		require.NoError(t, err)
+		kid, ok := msg.Signatures()[0].ProtectedHeaders().KeyID()
+		require.True(t, ok)
+		key, ok := keys.byThumbprint[kid]
+		require.True(t, ok, kid)
+		pub, err := key.PublicKey()
+		require.NoError(t, err)
+		verified, err := jws.Verify([]byte(compact), jws.WithKey(jwa.ES512(), pub))
+		require.NoError(t, err)
+		require.Equal(t, payload, string(verified))
+	}
 }
 
 func TestKeySetAdvertisement(t *testing.T) {
@@ -262,3 +284,134 @@ func TestRecomputeAdvertisementsNoSignKeys(t *testing.T) {
 	err = ks.RecomputeAdvertisements()
 	require.ErrorContains(t, err, "no sign keys found")
 }
+
+func TestEdDSASignKey(t *testing.T) {
+	t.Parallel()
+
+	ed, err := GenerateSignKey(jwa.EdDSA())
+	require.NoError(t, err)
+	require.Equal(t, jwa.OKP(), ed.KeyType())
+	es, err := GenerateVerifyKey()
+	require.NoError(t, err)
+	ek, err := GenerateExchangeKey()
+	require.NoError(t, err)
+
+	ks := NewKeySet()
+	for _, k := range []jwk.Key{ed, es, ek} {
+		require.NoError(t, ks.AppendKey(k, true))
+	}
+	require.NoError(t, ks.RecomputeAdvertisements())
+
+	set, err := VerifyAdvertisement(ks.DefaultAdvertisement)
+	require.NoError(t, err)
+	require.Equal(t, 3, set.Len())
+	edThp, err := thumbprint(ed, ThumbprintHash)
+	require.NoError(t, err)
+	_, err = VerifyAdvertisement(ks.byThumbprint[edThp].compact.data)
+	require.NoError(t, err)
+	_, err = VerifyAdvertisement(ks.byThumbprint[edThp].flattened.data)
+	require.NoError(t, err)
+
+	// an advertisement missing the signature of one of its verify keys is rejected
+	props := make(map[string]any)
+	require.NoError(t, json.Unmarshal(ks.DefaultAdvertisement, &props))
+	props["signatures"] = props["signatures"].([]any)[:1]
+	data, err := json.Marshal(props)
+	require.NoError(t, err)
+	_, err = VerifyAdvertisement(data)
+	require.Error(t, err)
+
+	_, err = GenerateSignKey(jwa.HS256())
+	require.Error(t, err)
+}
+
+func TestKeySetDuplicateKeys(t *testing.T) {
+	t.Parallel()
+
+	vk, err := GenerateVerifyKey()
+	require.NoError(t, err)
+	ek, err := GenerateExchangeKey()
+	require.NoError(t, err)
+	thp, err := thumbprint(ek, ThumbprintHash)
+	require.NoError(t, err)
+	revoked, err := ek.Clone()
+	require.NoError(t, err)
+	require.NoError(t, setKeyState(revoked, KeyStateRevoked))
+
+	tests := []struct {
+		name       string
+		copies     []jwk.Key
+		advertised []bool
+		kept       string
+	}{
+		{"hidden first", []jwk.Key{ek, ek}, []bool{false, true}, "advertised active"},
+		{"advertised first", []jwk.Key{ek, ek}, []bool{true, false}, "advertised active"},
+		{"same status", []jwk.Key{ek, ek}, []bool{false, false}, "hidden active"},
+		{"revoked wins", []jwk.Key{ek, revoked}, []bool{true, false}, "revoked"},
+	}
+	for _, test := range tests {
+		ks := NewKeySet()
+		require.NoError(t, ks.AppendKey(vk, true))
+		for i, k := range test.copies {
+			require.NoError(t, ks.AppendKey(k, test.advertised[i]), test.name)
+		}
+		require.Len(t, ks.keys, 2, test.name)
+		require.Equal(t, test.kept, ks.byThumbprint[thp].status(), test.name)
+		// every thumbprint finds the kept copy
+		for _, a := range algos {
+			other, err := thumbprint(ek, a)
+			require.NoError(t, err)
+			require.Same(t, ks.byThumbprint[thp], ks.byThumbprint[other])
+		}
+	}
+
+	// a key loaded from an advertised and a hidden file is advertised once
+	dir := t.TempDir()
+	for _, k := range []jwk.Key{vk, ek} {
+		data, err := json.Marshal(k)
+		require.NoError(t, err)
+		name, err := thumbprint(k, ThumbprintHash)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path.Join(dir, name+".jwk"), data, 0o600))
+		require.NoError(t, os.WriteFile(path.Join(dir, "."+name+".jwk"), data, 0o600))
+	}
+	ks, err := ReadKeys(dir)
+	require.NoError(t, err)
+	require.Len(t, ks.keys, 2)
+	set, err := VerifyAdvertisement(ks.DefaultAdvertisement)
+	require.NoError(t, err)
+	require.Equal(t, 2, set.Len())
+
+	strict := NewKeySet()
+	strict.RejectDuplicates = true
+	err = strict.Load(dir)
+	require.ErrorIs(t, err, ErrDuplicateKey)
+	require.ErrorContains(t, err, dir)
+
+	// a stale copy keeps the status rule but cannot lift restrictions set on the other copy
+	now := time.Now().Truncate(time.Second)
+	restricted, err := ek.Clone()
+	require.NoError(t, err)
+	require.NoError(t, setApprovalRequired(restricted, true))
+	validity := KeyValidity{NotBefore: now.Add(-time.Hour), RecoverUntil: now.Add(time.Hour)}
+	require.NoError(t, setKeyValidity(restricted, validity))
+	stale, err := ek.Clone()
+	require.NoError(t, err)
+	require.NoError(t, setKeyValidity(stale, KeyValidity{AdvertiseUntil: now.Add(time.Minute), RecoverUntil: now.Add(2 * time.Hour)}))
+	for _, copies := range [][]jwk.Key{{restricted, stale}, {stale, restricted}} {
+		ks := NewKeySet()
+		require.NoError(t, ks.AppendKey(copies[0], copies[0] == stale))
+		require.NoError(t, ks.AppendKey(copies[1], copies[1] == stale))
+		merged := ks.byThumbprint[thp]
+		require.Equal(t, "advertised active", merged.status())
+		require.True(t, merged.approvalRequired)
+		require.True(t, ks.approvalRequired(thp))
+		require.True(t, merged.validity.Equal(KeyValidity{NotBefore: now.Add(-time.Hour), AdvertiseUntil: now.Add(time.Minute), RecoverUntil: now.Add(time.Hour)}))
+	}
+	require.Equal(t, StoredKey{Advertised: true, State: KeyStateActive, ApprovalRequired: true, Validity: validity},
+		StoredKey{State: KeyStateActive, ApprovalRequired: true, Validity: validity}.Merge(StoredKey{Advertised: true, State: KeyStateActive}))
+
+	require.True(t, StoredKey{Advertised: true, State: KeyStateActive}.Stronger(StoredKey{State: KeyStateActive}))
+	require.True(t, StoredKey{State: KeyStateRevoked}.Stronger(StoredKey{Advertised: true, State: KeyStateActive}))
+	require.False(t, StoredKey{State: KeyStateDeprecated}.Stronger(StoredKey{State: KeyStateActive}))
+}
@@ -0,0 +1,318 @@
+package tang
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwk"
+)
+
+// KeyState is the lifecycle state of a key. Active keys are advertised or hidden depending on their
+// file name, deprecated and revoked keys are never advertised.
+type KeyState string
+
+const (
+	// KeyStateActive is the state of keys without lifecycle metadata
+	KeyStateActive KeyState = "active"
+	// KeyStateDeprecated keys still recover existing bindings, but should be replaced by rebinding clients
+	KeyStateDeprecated KeyState = "deprecated"
+	// KeyStateRevoked keys refuse recovery
+	KeyStateRevoked KeyState = "revoked"
+)
+
+// privateParamPrefix marks the JWK members Tang uses for key metadata, they are never advertised
+const privateParamPrefix = "tang_"
+
+// KeyStateParam is the private JWK member that holds the lifecycle state of a key
+const KeyStateParam = privateParamPrefix + "state"
+
+// ApprovalRequiredParam is the private JWK member that marks keys whose recoveries need an operator approval
+const ApprovalRequiredParam = privateParamPrefix + "approval_required"
+
+// The private JWK members that bound the validity of a key, the values are seconds since the epoch like
+// the JWT "nbf" and "exp" claims
+const (
+	NotBeforeParam      = privateParamPrefix + "nbf"
+	AdvertiseUntilParam = privateParamPrefix + "advertise_until"
+	RecoverUntilParam   = privateParamPrefix + "recover_until"
+)
+
+var (
+	// ErrKeyRevoked is returned when a revoked key is asked to recover
+	ErrKeyRevoked = errors.New("key is revoked")
+	// ErrKeyNotYetValid is returned when a key is asked to recover before its not-before time
+	ErrKeyNotYetValid = errors.New("key is not valid yet")
+	// ErrKeyExpired is returned when a key is asked to recover after its recover-until time
+	ErrKeyExpired = errors.New("key recovery period has ended")
+)
+
+// ParseKeyState parses the name of a lifecycle state
+func ParseKeyState(s string) (KeyState, error) {
+	switch state := KeyState(s); state {
+	case KeyStateActive, KeyStateDeprecated, KeyStateRevoked:
+		return state, nil
+	case "":
+		return KeyStateActive, nil
+	default:
+		return "", fmt.Errorf("unknown key state '%s'", s)
+	}
+}
+
+// KeyStateOf returns the lifecycle state stored in the key
+func KeyStateOf(k jwk.Key) (KeyState, error) {
+	if !k.Has(KeyStateParam) {
+		return KeyStateActive, nil
+	}
+	var s string
+	if err := k.Get(KeyStateParam, &s); err != nil {
+		return "", fmt.Errorf("invalid %s: %v", KeyStateParam, err)
+	}
+	return ParseKeyState(s)
+}
+
+// setKeyState stores the lifecycle state in the key, the active state is stored as absence of metadata
+func setKeyState(k jwk.Key, state KeyState) error {
+	if state == KeyStateActive {
+		if k.Has(KeyStateParam) {
+			return k.Remove(KeyStateParam)
+		}
+		return nil
+	}
+	return k.Set(KeyStateParam, string(state))
+}
+
+// ApprovalRequired reports whether recoveries with the key have to be approved by an operator
+func ApprovalRequired(k jwk.Key) (bool, error) {
+	if !k.Has(ApprovalRequiredParam) {
+		return false, nil
+	}
+	var required bool
+	if err := k.Get(ApprovalRequiredParam, &required); err != nil {
+		return false, fmt.Errorf("invalid %s: %v", ApprovalRequiredParam, err)
+	}
+	return required, nil
+}
+
+// setApprovalRequired stores the approval flag in the key, keys without the flag do not need approvals
+func setApprovalRequired(k jwk.Key, required bool) error {
+	if !required {
+		if k.Has(ApprovalRequiredParam) {
+			return k.Remove(ApprovalRequiredParam)
+		}
+		return nil
+	}
+	return k.Set(ApprovalRequiredParam, true)
+}
+
+// KeyValidity bounds the time a key is used, zero times are unbounded
+type KeyValidity struct {
+	// NotBefore is the time the key starts to be advertised and to recover
+	NotBefore time.Time `json:"not_before,omitzero"`
+	// AdvertiseUntil is the time the key stops being advertised, it keeps recovering existing bindings
+	AdvertiseUntil time.Time `json:"advertise_until,omitzero"`
+	// RecoverUntil is the time the key stops recovering
+	RecoverUntil time.Time `json:"recover_until,omitzero"`
+}
+
+// IsZero reports whether the validity is unbounded
+func (v KeyValidity) IsZero() bool {
+	return v.NotBefore.IsZero() && v.AdvertiseUntil.IsZero() && v.RecoverUntil.IsZero()
+}
+
+// Advertisable reports whether the key may be advertised at the given time
+func (v KeyValidity) Advertisable(now time.Time) bool {
+	return v.Recoverable(now) == nil && (v.AdvertiseUntil.IsZero() || now.Before(v.AdvertiseUntil))
+}
+
+// Recoverable returns ErrKeyNotYetValid or ErrKeyExpired if the key may not recover at the given time
+func (v KeyValidity) Recoverable(now time.Time) error {
+	if !v.NotBefore.IsZero() && now.Before(v.NotBefore) {
+		return ErrKeyNotYetValid
+	}
+	if !v.RecoverUntil.IsZero() && !now.Before(v.RecoverUntil) {
+		return ErrKeyExpired
+	}
+	return nil
+}
+
+// Check verifies that the bounds are consistent: not-before has to be before the ends and advertising
+// cannot end after recovery
+func (v KeyValidity) Check() error {
+	for _, c := range []struct {
+		first, second         time.Time
+		firstName, secondName string
+		equalAllowed          bool
+	}{
+		{v.NotBefore, v.AdvertiseUntil, NotBeforeParam, AdvertiseUntilParam, false},
+		{v.NotBefore, v.RecoverUntil, NotBeforeParam, RecoverUntilParam, false},
+		{v.AdvertiseUntil, v.RecoverUntil, AdvertiseUntilParam, RecoverUntilParam, true},
+	} {
+		if c.first.IsZero() || c.second.IsZero() || c.first.Before(c.second) || (c.equalAllowed && c.first.Equal(c.second)) {
+			continue
+		}
+		if c.equalAllowed {
+			return fmt.Errorf("%s cannot be after %s", c.firstName, c.secondName)
+		}
+		return fmt.Errorf("%s has to be before %s", c.firstName, c.secondName)
+	}
+	return nil
+}
+
+// Equal reports whether both validities have the same bounds
+func (v KeyValidity) Equal(other KeyValidity) bool {
+	return v.NotBefore.Equal(other.NotBefore) && v.AdvertiseUntil.Equal(other.AdvertiseUntil) &&
+		v.RecoverUntil.Equal(other.RecoverUntil)
+}
+
+// Merge returns the tightest bounds of both validities: the latest start and the earliest ends
+func (v KeyValidity) Merge(other KeyValidity) KeyValidity {
+	if other.NotBefore.After(v.NotBefore) {
+		v.NotBefore = other.NotBefore
+	}
+	v.AdvertiseUntil = earliestBound(v.AdvertiseUntil, other.AdvertiseUntil)
+	v.RecoverUntil = earliestBound(v.RecoverUntil, other.RecoverUntil)
+	return v
+}
+
+// earliestBound returns the earlier of two end bounds, a zero time is unbounded
+func earliestBound(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// nextChange returns the first bound after now, or the zero time if none is left
+func (v KeyValidity) nextChange(now time.Time) time.Time {
+	var next time.Time
+	for _, t := range []time.Time{v.NotBefore, v.AdvertiseUntil, v.RecoverUntil} {
+		if t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	return next
+}
+
+// KeyValidityOf returns the validity bounds stored in the key
+func KeyValidityOf(k jwk.Key) (KeyValidity, error) {
+	var v KeyValidity
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{
+		{NotBeforeParam, &v.NotBefore},
+		{AdvertiseUntilParam, &v.AdvertiseUntil},
+		{RecoverUntilParam, &v.RecoverUntil},
+	} {
+		if !k.Has(p.name) {
+			continue
+		}
+		var value any
+		if err := k.Get(p.name, &value); err != nil {
+			return v, fmt.Errorf("invalid %s: %v", p.name, err)
+		}
+		t, err := numericDate(value)
+		if err != nil {
+			return v, fmt.Errorf("invalid %s: %v", p.name, err)
+		}
+		*p.t = t
+	}
+	return v, v.Check()
+}
+
+// setKeyValidity stores the validity bounds in the key, zero times are removed
+func setKeyValidity(k jwk.Key, v KeyValidity) error {
+	for _, p := range []struct {
+		name string
+		t    time.Time
+	}{
+		{NotBeforeParam, v.NotBefore},
+		{AdvertiseUntilParam, v.AdvertiseUntil},
+		{RecoverUntilParam, v.RecoverUntil},
+	} {
+		var err error
+		switch {
+		case !p.t.IsZero():
+			err = k.Set(p.name, p.t.Unix())
+		case k.Has(p.name):
+			err = k.Remove(p.name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// numericDate converts a JSON number of seconds since the epoch into a time
+func numericDate(value any) (time.Time, error) {
+	var sec float64
+	switch n := value.(type) {
+	case float64:
+		sec = n
+	case int64:
+		sec = float64(n)
+	case int:
+		sec = float64(n)
+	case json.Number:
+		f, err := n.Float64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		sec = f
+	default:
+		return time.Time{}, fmt.Errorf("expected seconds since the epoch, got %T", value)
+	}
+	if math.IsNaN(sec) || sec <= 0 || sec > float64(math.MaxInt64/int64(time.Second)) {
+		return time.Time{}, fmt.Errorf("time %v is out of range", value)
+	}
+	return time.Unix(int64(sec), 0).UTC(), nil
+}
+
+// privateParams returns the Tang metadata stored in the key
+func privateParams(k jwk.Key) map[string]any {
+	params := make(map[string]any)
+	for _, name := range k.Keys() {
+		if strings.HasPrefix(name, privateParamPrefix) {
+			var v any
+			if err := k.Get(name, &v); err == nil {
+				params[name] = v
+			}
+		}
+	}
+	return params
+}
+
+// copyPrivateParams replaces the Tang metadata of dst with the one of src
+func copyPrivateParams(dst, src jwk.Key) error {
+	for name := range privateParams(dst) {
+		if err := dst.Remove(name); err != nil {
+			return err
+		}
+	}
+	for name, v := range privateParams(src) {
+		if err := dst.Set(name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stripPrivateParams removes the Tang metadata from keys that are going to be published
+func stripPrivateParams(set jwk.Set) error {
+	for i := range set.Len() {
+		k, _ := set.Key(i)
+		for _, name := range k.Keys() {
+			if strings.HasPrefix(name, privateParamPrefix) {
+				if err := k.Remove(name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package tang
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jws"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySetKeyStates(t *testing.T) {
+	t.Parallel()
+
+	vk, err := GenerateVerifyKey()
+	require.NoError(t, err)
+	require.NoError(t, vk.Set(privateParamPrefix+"note", "private metadata"))
+	active, err := GenerateExchangeKey()
+	require.NoError(t, err)
+	revoked, err := GenerateExchangeKey()
+	require.NoError(t, err)
+	require.NoError(t, setKeyState(revoked, KeyStateRevoked))
+
+	ks := NewKeySet()
+	require.NoError(t, ks.AppendKey(vk, true))
+	require.NoError(t, ks.AppendKey(active, true))
+	require.NoError(t, ks.AppendKey(revoked, true))
+	require.NoError(t, ks.RecomputeAdvertisements())
+
+	activeThp, err := thumbprint(active, ThumbprintHash)
+	require.NoError(t, err)
+	revokedThp, err := thumbprint(revoked, ThumbprintHash)
+	require.NoError(t, err)
+
+	// revoked keys are not advertised even if their file name says so
+	advertised := advertisedThumbprints(t, ks)
+	require.Len(t, advertised, 2)
+	require.Contains(t, advertised, activeThp)
+	require.NotContains(t, advertised, revokedThp)
+
+	// the metadata of the keys is not published
+	msg, err := jws.Parse(ks.DefaultAdvertisement)
+	require.NoError(t, err)
+	require.False(t, strings.Contains(string(msg.Payload()), privateParamPrefix))
+
+	_, err = ks.RecoverKey(revokedThp, thresholdTestRequest(t))
+	require.ErrorIs(t, err, ErrKeyRevoked)
+	_, err = ks.RecoverKey(activeThp, thresholdTestRequest(t))
+	require.NoError(t, err)
+
+	require.NoError(t, revoked.Set(KeyStateParam, "unknown"))
+	require.Error(t, NewKeySet().AppendKey(revoked, false))
+}
+
+func TestKeySetValidity(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().Truncate(time.Second)
+	vk, err := GenerateVerifyKey()
+	require.NoError(t, err)
+	keys := map[string]KeyValidity{
+		"current":    {RecoverUntil: now.Add(time.Hour)},
+		"not yet":    {NotBefore: now.Add(time.Hour)},
+		"advertised": {AdvertiseUntil: now.Add(-time.Hour), RecoverUntil: now.Add(time.Hour)},
+		"expired":    {RecoverUntil: now.Add(-time.Hour)},
+	}
+	thps := make(map[string]string)
+
+	ks := NewKeySet()
+	require.NoError(t, ks.AppendKey(vk, true))
+	for name, v := range keys {
+		k, err := GenerateExchangeKey()
+		require.NoError(t, err)
+		require.NoError(t, setKeyValidity(k, v))
+
+		// the bounds survive serialization
+		data, err := json.Marshal(k)
+		require.NoError(t, err)
+		parsed, err := jwk.ParseKey(data)
+		require.NoError(t, err)
+		stored, err := KeyValidityOf(parsed)
+		require.NoError(t, err)
+		require.True(t, v.NotBefore.Equal(stored.NotBefore) && v.AdvertiseUntil.Equal(stored.AdvertiseUntil) && v.RecoverUntil.Equal(stored.RecoverUntil), name)
+
+		require.NoError(t, ks.AppendKey(parsed, true))
+		thps[name], err = thumbprint(k, ThumbprintHash)
+		require.NoError(t, err)
+	}
+	require.NoError(t, ks.RecomputeAdvertisements())
+
+	advertised := advertisedThumbprints(t, ks)
+	require.Len(t, advertised, 2)
+	require.Contains(t, advertised, thps["current"])
+	require.True(t, ks.nextChange.Equal(now.Add(time.Hour)))
+
+	_, err = ks.RecoverKey(thps["current"], thresholdTestRequest(t))
+	require.NoError(t, err)
+	_, err = ks.RecoverKey(thps["advertised"], thresholdTestRequest(t))
+	require.NoError(t, err)
+	_, err = ks.RecoverKey(thps["not yet"], thresholdTestRequest(t))
+	require.ErrorIs(t, err, ErrKeyNotYetValid)
+	_, err = ks.RecoverKey(thps["expired"], thresholdTestRequest(t))
+	require.ErrorIs(t, err, ErrKeyExpired)
+
+	// an hour later the key that was not valid yet replaces the current one
+	later := now.Add(time.Hour)
+	require.False(t, ks.stale(now))
+	require.True(t, ks.stale(later))
+	fresh := ks.refreshed(later)
+	advertised = advertisedThumbprints(t, fresh)
+	require.Len(t, advertised, 2)
+	require.Contains(t, advertised, thps["not yet"])
+	require.True(t, fresh.nextChange.IsZero())
+
+	invalid, err := GenerateExchangeKey()
+	require.NoError(t, err)
+	require.NoError(t, setKeyValidity(invalid, KeyValidity{NotBefore: now, RecoverUntil: now.Add(-time.Hour)}))
+	require.Error(t, NewKeySet().AppendKey(invalid, true))
+	require.NoError(t, setKeyValidity(invalid, KeyValidity{AdvertiseUntil: now.Add(time.Hour), RecoverUntil: now}))
+	require.Error(t, NewKeySet().AppendKey(invalid, true))
+	require.NoError(t, setKeyValidity(invalid, KeyValidity{NotBefore: now, AdvertiseUntil: now, RecoverUntil: now.Add(time.Hour)}))
+	require.Error(t, NewKeySet().AppendKey(invalid, true))
+	require.NoError(t, invalid.Set(RecoverUntilParam, "tomorrow"))
+	require.Error(t, NewKeySet().AppendKey(invalid, true))
+}
+
+func TestServerAdvertiseUntil(t *testing.T) {
+	t.Parallel()
+
+	vk, err := GenerateVerifyKey()
+	require.NoError(t, err)
+	current, err := GenerateExchangeKey()
+	require.NoError(t, err)
+	ending, err := GenerateExchangeKey()
+	require.NoError(t, err)
+	require.NoError(t, setKeyValidity(ending, KeyValidity{AdvertiseUntil: time.Now().Add(time.Second)}))
+	endingThp, err := thumbprint(ending, ThumbprintHash)
+	require.NoError(t, err)
+
+	ks := NewKeySet()
+	for _, k := range []jwk.Key{vk, current, ending} {
+		require.NoError(t, ks.AppendKey(k, true))
+	}
+	require.NoError(t, ks.RecomputeAdvertisements())
+
+	srv := NewServer()
+	srv.Keys = ks
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	advertisement := func() *KeySet {
+		resp, err := http.Get(ts.URL + "/adv")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return &KeySet{DefaultAdvertisement: data}
+	}
+	require.Contains(t, advertisedThumbprints(t, advertisement()), endingThp)
+
+	time.Sleep(time.Until(ks.nextChange))
+	require.NotContains(t, advertisedThumbprints(t, advertisement()), endingThp)
+}
@@ -0,0 +1,25 @@
+package tang
+
+import (
+	"crypto"
+	"expvar"
+)
+
+// metrics holds the counters of all servers in the process. They are published by expvar under
+// the name "tang", e.g. "recover.ok" or "advertise.not_found", expvar.Handler serves them.
+var metrics = expvar.NewMap("tang")
+
+// countRequest counts a request of the action with the given result
+func countRequest(action, result string) {
+	metrics.Add(action+"."+result, 1)
+}
+
+// countThumbprintHash counts a key lookup by a thumbprint of the hash, e.g. "thumbprint.sha1" or
+// "thumbprint.sha1.refused" if the hash is not allowed
+func countThumbprintHash(h crypto.Hash, allowed bool) {
+	name := "thumbprint." + HashName(h)
+	if !allowed {
+		name += ".refused"
+	}
+	metrics.Add(name, 1)
+}
@@ -0,0 +1,106 @@
+package tang
+
+import (
+	"crypto"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/stretchr/testify/require"
+)
+
+func metricValue(name string) int64 {
+	if v, ok := metrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	ks, err := ReadKeys("testdata/keys")
+	require.NoError(t, err)
+	srv := NewServer()
+	srv.Keys = ks
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	advertised, recovered, failed := metricValue("advertise.ok"), metricValue("recover.ok"), metricValue("recover.failed")
+
+	resp, err := http.Get(ts.URL + "/adv")
+	require.NoError(t, err)
+	resp.Body.Close()
+	resp, err = http.Post(ts.URL+"/rec/"+reverseTestThp, "application/jwk+json", strings.NewReader(reverseTestXferKey))
+	require.NoError(t, err)
+	resp.Body.Close()
+	resp, err = http.Post(ts.URL+"/rec/unknown", "application/jwk+json", strings.NewReader(reverseTestXferKey))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// other tests may count requests at the same time
+	require.GreaterOrEqual(t, metricValue("advertise.ok")-advertised, int64(1))
+	require.GreaterOrEqual(t, metricValue("recover.ok")-recovered, int64(1))
+	require.GreaterOrEqual(t, metricValue("recover.failed")-failed, int64(1))
+	require.NotNil(t, expvar.Get("tang"))
+}
+
+func TestThumbprintHashPolicy(t *testing.T) {
+	ks, err := ReadKeys("testdata/keys")
+	require.NoError(t, err)
+	ks.ThumbprintHashes = []crypto.Hash{crypto.SHA256}
+	sha1Thp, err := thumbprint(ks.byThumbprint[reverseTestThp], crypto.SHA1)
+	require.NoError(t, err)
+	xfrKey, err := jwk.ParseKey([]byte(reverseTestXferKey))
+	require.NoError(t, err)
+
+	_, err = ks.RecoverKey(reverseTestThp, xfrKey)
+	require.NoError(t, err)
+	_, err = ks.RecoverKey(sha1Thp, xfrKey)
+	require.ErrorIs(t, err, ErrThumbprintHashNotAllowed)
+	require.ErrorContains(t, err, "sha1")
+	_, err = ks.RecoverKey("unknown", xfrKey)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrThumbprintHashNotAllowed)
+
+	srv := NewServer()
+	srv.Keys = ks
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	allowed, refused := metricValue("thumbprint.sha256"), metricValue("thumbprint.sha1.refused")
+	resp, err := http.Post(ts.URL+"/rec/"+sha1Thp, "application/jwk+json", strings.NewReader(reverseTestXferKey))
+	require.NoError(t, err)
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Contains(t, string(data), ErrThumbprintHashNotAllowed.Error())
+
+	resp, err = http.Get(ts.URL + "/adv/" + sha1Thp)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Post(ts.URL+"/rec/"+reverseTestThp, "application/jwk+json", strings.NewReader(reverseTestXferKey))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.GreaterOrEqual(t, metricValue("thumbprint.sha256")-allowed, int64(1))
+	require.GreaterOrEqual(t, metricValue("thumbprint.sha1.refused")-refused, int64(2))
+
+	// the policy survives the recomputation after a validity change
+	require.Equal(t, ks.ThumbprintHashes, ks.refreshed(time.Now()).ThumbprintHashes)
+
+	for _, h := range algos {
+		parsed, err := ParseThumbprintHash(HashName(h))
+		require.NoError(t, err)
+		require.Equal(t, h, parsed)
+	}
+	_, err = ParseThumbprintHash("md5")
+	require.Error(t, err)
+}
@@ -0,0 +1,366 @@
+package tang
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+	"github.com/lestrrat-go/jwx/v3/jwe"
+)
+
+const (
+	// ReplicationPath is the URL path the primary serves key snapshots on
+	ReplicationPath = "/replication/snapshot"
+	// ReplicationStateFile is the file in the follower key directory that records the replication status.
+	// It does not have the *.jwk suffix, so it is ignored when the keys are read.
+	ReplicationStateFile = ".replication.json"
+	// DefaultReplicationInterval is the default time between two snapshots fetched by a follower
+	DefaultReplicationInterval = time.Minute
+	// MinReplicationSecretLength is the minimum length of the secret shared by the primary and its followers
+	MinReplicationSecretLength = 16
+)
+
+// ErrReplicationSecretTooShort is returned for a replication secret shorter than MinReplicationSecretLength
+var ErrReplicationSecretTooShort = fmt.Errorf("replication secret has to be at least %d bytes long", MinReplicationSecretLength)
+
+// CheckReplicationSecret returns ErrReplicationSecretTooShort if the secret is too short to protect the snapshots
+func CheckReplicationSecret(secret []byte) error {
+	if len(secret) < MinReplicationSecretLength {
+		return ErrReplicationSecretTooShort
+	}
+	return nil
+}
+
+// replicationToken is the bearer token followers authenticate with. It is derived from the secret,
+// so the secret itself is never sent to the primary.
+func replicationToken(secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("tang replication"))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// maxSnapshotSize limits the size of a snapshot a follower accepts
+const maxSnapshotSize = 16 * 1024 * 1024
+
+// ReplicationSource serves snapshots of a key store to followers. A snapshot has the format of a backup
+// created by CreateBackup: it is encrypted and authenticated with the secret shared by the primary and
+// its followers, so it can be transferred over plain HTTP. Only followers that present a bearer token
+// derived from the secret get a snapshot.
+type ReplicationSource struct {
+	Store  *KeyStore
+	Secret []byte
+}
+
+// NewReplicationSource creates a handler that serves snapshots of the store at ReplicationPath
+func NewReplicationSource(store *KeyStore, secret []byte) *ReplicationSource {
+	return &ReplicationSource{Store: store, Secret: secret}
+}
+
+func (rs *ReplicationSource) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != ReplicationPath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := CheckReplicationSecret(rs.Secret); err != nil {
+		log.Printf("replication snapshot for %s refused: %v", req.RemoteAddr, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	token, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), []byte(replicationToken(rs.Secret))) != 1 {
+		log.Printf("replication snapshot for %s refused: invalid token", req.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	snapshot, err := CreateBackup(rs.Store, rs.Secret)
+	if err != nil {
+		log.Printf("replication snapshot for %s failed: %v", req.RemoteAddr, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jose")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(snapshot)
+}
+
+// ReplicationStatus is the replication state of a follower, it is stored in ReplicationStateFile
+type ReplicationStatus struct {
+	Primary string `json:"primary"`
+	// LastAttempt is the time of the last snapshot request
+	LastAttempt time.Time `json:"last_attempt"`
+	// LastSync is the time the last snapshot was applied successfully
+	LastSync time.Time `json:"last_sync"`
+	// SnapshotCreated is the time the primary created the last applied snapshot, in the primary clock
+	SnapshotCreated time.Time `json:"snapshot_created"`
+	// Keys is the number of keys in the last applied snapshot
+	Keys      int    `json:"keys"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Lag returns how much the follower may be behind the primary at the given time
+func (s *ReplicationStatus) Lag(now time.Time) time.Duration {
+	if s.LastSync.IsZero() {
+		return 0
+	}
+	return now.Sub(s.LastSync)
+}
+
+// ReadReplicationStatus reads the replication status of the follower that uses the store
+func ReadReplicationStatus(store *KeyStore) (*ReplicationStatus, error) {
+	data, err := os.ReadFile(path.Join(store.Dir, ReplicationStateFile))
+	if err != nil {
+		return nil, err
+	}
+	var status ReplicationStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("%s: %v", ReplicationStateFile, err)
+	}
+	return &status, nil
+}
+
+// ReplicationChanges describes how a snapshot changed the follower store
+type ReplicationChanges struct {
+	// Added are the thumbprints of keys that were new to the follower
+	Added []string
+	// Advertised are the thumbprints of keys the follower started advertising
+	Advertised []string
+	// Hidden are the thumbprints of keys the follower stopped advertising
+	Hidden []string
+	// StateChanged are the thumbprints of keys whose metadata changed, e.g. the lifecycle state or validity
+	StateChanged []string
+}
+
+// Empty reports whether the snapshot left the store unchanged
+func (c *ReplicationChanges) Empty() bool {
+	return len(c.Added) == 0 && len(c.Advertised) == 0 && len(c.Hidden) == 0 && len(c.StateChanged) == 0
+}
+
+// ReplicationFollower periodically fetches snapshots from the primary and applies them to its store.
+// Keys get the advertised state and the metadata they have on the primary, and a key is advertised only
+// while the primary advertises it. Keys are never removed, so data encrypted to them stays recoverable.
+type ReplicationFollower struct {
+	// Primary is the base URL of the replication listener of the primary
+	Primary string
+	Store   *KeyStore
+	Secret  []byte
+	// Interval is the time between two snapshots, DefaultReplicationInterval if not set
+	Interval time.Duration
+	// Client is used to fetch snapshots, http.DefaultClient if not set
+	Client *http.Client
+	// OnUpdate is called with the reloaded keys whenever a snapshot changed the store
+	OnUpdate func(ks *KeySet)
+}
+
+// NewReplicationFollower creates a follower that replicates keys from the primary into the store
+func NewReplicationFollower(primary string, store *KeyStore, secret []byte) *ReplicationFollower {
+	return &ReplicationFollower{
+		Primary:  primary,
+		Store:    store,
+		Secret:   secret,
+		Interval: DefaultReplicationInterval,
+	}
+}
+
+// Run applies snapshots until the context is canceled. Failed attempts are logged and recorded
+// in the replication status, the follower keeps serving its current keys meanwhile.
+func (f *ReplicationFollower) Run(ctx context.Context) error {
+	interval := f.Interval
+	if interval <= 0 {
+		interval = DefaultReplicationInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		changes, err := f.Sync(ctx)
+		if err != nil {
+			log.Printf("replication from %s failed: %v", f.Primary, err)
+		} else if !changes.Empty() {
+			log.Printf("replication from %s: %d keys added, %d advertised, %d hidden, %d changed state",
+				f.Primary, len(changes.Added), len(changes.Advertised), len(changes.Hidden), len(changes.StateChanged))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync fetches a single snapshot from the primary and applies it to the store
+func (f *ReplicationFollower) Sync(ctx context.Context) (*ReplicationChanges, error) {
+	status, err := ReadReplicationStatus(f.Store)
+	if os.IsNotExist(err) {
+		status = &ReplicationStatus{}
+	} else if err != nil {
+		return nil, err
+	}
+	status.Primary = f.Primary
+	status.LastAttempt = time.Now().UTC()
+
+	changes, err := f.sync(ctx, status)
+	if err != nil {
+		status.LastError = err.Error()
+	} else {
+		status.LastError = ""
+		status.LastSync = status.LastAttempt
+	}
+	if serr := f.writeStatus(status); serr != nil && err == nil {
+		err = serr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !changes.Empty() && f.OnUpdate != nil {
+		ks, err := f.Store.Load()
+		if err != nil {
+			return changes, err
+		}
+		f.OnUpdate(ks)
+	}
+	return changes, nil
+}
+
+func (f *ReplicationFollower) sync(ctx context.Context, status *ReplicationStatus) (*ReplicationChanges, error) {
+	snapshot, err := f.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := jwe.Decrypt(snapshot, jwe.WithKey(jwa.PBES2_HS512_A256KW(), f.Secret))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt snapshot, check the replication secret: %v", err)
+	}
+	archive, keys, err := parseArchive(data)
+	if err != nil {
+		return nil, err
+	}
+	// a replayed snapshot must not revert the state to an older one
+	if archive.Created.Before(status.SnapshotCreated) {
+		return nil, fmt.Errorf("snapshot created at %v is older than the applied one from %v", archive.Created, status.SnapshotCreated)
+	}
+
+	stored, err := f.Store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	local := make(map[string]bool)
+	metadata := make(map[string]map[string]any)
+	for _, k := range stored {
+		// keys stored in multiple files are advertised if any of the files is
+		local[k.Thumbprint] = local[k.Thumbprint] || k.Advertised
+		metadata[k.Thumbprint] = privateParams(k.Key)
+	}
+
+	changes := &ReplicationChanges{}
+	primary := make(map[string]bool)
+	for i, e := range archive.Keys {
+		primary[e.Thumbprint] = true
+
+		advertised, exists := local[e.Thumbprint]
+		if exists && !reflect.DeepEqual(privateParams(keys[i]), metadata[e.Thumbprint]) {
+			state, err := KeyStateOf(keys[i])
+			if err != nil {
+				return changes, err
+			}
+			if err := f.Store.SetMetadata(e.Thumbprint, keys[i]); err != nil {
+				return changes, err
+			}
+			changes.StateChanged = append(changes.StateChanged, e.Thumbprint)
+			advertised = advertised && state == KeyStateActive
+		}
+
+		switch {
+		case !exists:
+			if _, err := f.Store.Put(keys[i], e.Advertised); err != nil {
+				return changes, err
+			}
+			changes.Added = append(changes.Added, e.Thumbprint)
+		case advertised != e.Advertised:
+			if err := f.Store.SetAdvertised(e.Thumbprint, e.Advertised); err != nil {
+				return changes, err
+			}
+			if e.Advertised {
+				changes.Advertised = append(changes.Advertised, e.Thumbprint)
+			} else {
+				changes.Hidden = append(changes.Hidden, e.Thumbprint)
+			}
+		}
+	}
+
+	// keys unknown to the primary are kept for recovery but must not be advertised
+	for thp, advertised := range local {
+		if primary[thp] || !advertised {
+			continue
+		}
+		if err := f.Store.SetAdvertised(thp, false); err != nil {
+			return changes, err
+		}
+		changes.Hidden = append(changes.Hidden, thp)
+	}
+
+	status.SnapshotCreated = archive.Created
+	status.Keys = len(archive.Keys)
+	return changes, nil
+}
+
+func (f *ReplicationFollower) fetch(ctx context.Context) ([]byte, error) {
+	url := strings.TrimSuffix(f.Primary, "/") + ReplicationPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+replicationToken(f.Secret))
+
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSnapshotSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSnapshotSize {
+		return nil, fmt.Errorf("snapshot is larger than %d bytes", maxSnapshotSize)
+	}
+	return data, nil
+}
+
+func (f *ReplicationFollower) writeStatus(status *ReplicationStatus) error {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(f.Store.Dir, ReplicationStateFile), data, 0o640)
+}
@@ -0,0 +1,160 @@
+package tang
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplication(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("replication secret")
+	primary, state := createTestStore(t)
+	ts := httptest.NewServer(NewReplicationSource(primary, secret))
+	defer ts.Close()
+
+	follower := NewReplicationFollower(ts.URL, NewKeyStore(t.TempDir()), secret)
+	var updated *KeySet
+	follower.OnUpdate = func(ks *KeySet) { updated = ks }
+
+	changes, err := follower.Sync(context.Background())
+	require.NoError(t, err)
+	require.Len(t, changes.Added, 3)
+	require.Equal(t, state, storeState(t, follower.Store))
+	require.NotNil(t, updated)
+	require.Len(t, updated.keys, 3)
+
+	status, err := ReadReplicationStatus(follower.Store)
+	require.NoError(t, err)
+	require.Equal(t, ts.URL, status.Primary)
+	require.Equal(t, 3, status.Keys)
+	require.Empty(t, status.LastError)
+	require.False(t, status.LastSync.IsZero())
+
+	// nothing changed on the primary
+	updated = nil
+	changes, err = follower.Sync(context.Background())
+	require.NoError(t, err)
+	require.True(t, changes.Empty())
+	require.Nil(t, updated)
+
+	// rotation: a new key is advertised and an old one is hidden
+	key, err := GenerateExchangeKey()
+	require.NoError(t, err)
+	newThp, err := primary.Put(key, true)
+	require.NoError(t, err)
+	keys, err := primary.Keys()
+	require.NoError(t, err)
+	for _, k := range keys {
+		if alg, _ := k.Algorithm(); k.Advertised && k.Thumbprint != newThp && alg.String() == "ECMR" {
+			require.NoError(t, primary.SetAdvertised(k.Thumbprint, false))
+			break
+		}
+	}
+	changes, err = follower.Sync(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{newThp}, changes.Added)
+	require.Len(t, changes.Hidden, 1)
+	require.Equal(t, storeState(t, primary), storeState(t, follower.Store))
+	require.Len(t, updated.keys, 4)
+
+	// a key the follower advertises on its own is hidden until the primary advertises it
+	local, err := GenerateExchangeKey()
+	require.NoError(t, err)
+	localThp, err := follower.Store.Put(local, true)
+	require.NoError(t, err)
+	changes, err = follower.Sync(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{localThp}, changes.Hidden)
+	require.False(t, storeState(t, follower.Store)[localThp])
+
+	// metadata changes of existing keys are replicated
+	validity := KeyValidity{RecoverUntil: time.Now().Add(24 * time.Hour).Truncate(time.Second).UTC()}
+	require.NoError(t, primary.SetValidity(newThp, validity))
+	changes, err = follower.Sync(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{newThp}, changes.StateChanged)
+	keys, err = follower.Store.Keys()
+	require.NoError(t, err)
+	for _, k := range keys {
+		if k.Thumbprint == newThp {
+			require.Equal(t, validity, k.Validity)
+		}
+	}
+}
+
+func TestReplicationWrongSecret(t *testing.T) {
+	t.Parallel()
+
+	primary, _ := createTestStore(t)
+	ts := httptest.NewServer(NewReplicationSource(primary, []byte("replication secret")))
+	defer ts.Close()
+
+	follower := NewReplicationFollower(ts.URL, NewKeyStore(t.TempDir()), []byte("wrong secret"))
+	_, err := follower.Sync(context.Background())
+	require.Error(t, err)
+	require.Empty(t, storeState(t, follower.Store))
+
+	status, err := ReadReplicationStatus(follower.Store)
+	require.NoError(t, err)
+	require.NotEmpty(t, status.LastError)
+	require.True(t, status.LastSync.IsZero())
+}
+
+func TestReplicationAuthentication(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("replication secret")
+	primary, _ := createTestStore(t)
+	ts := httptest.NewServer(NewReplicationSource(primary, secret))
+	defer ts.Close()
+
+	for _, token := range []string{"", "Bearer ", "Bearer " + replicationToken([]byte("wrong secret")), string(secret)} {
+		req, err := http.NewRequest("GET", ts.URL+ReplicationPath, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode, token)
+		require.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"))
+	}
+
+	require.ErrorIs(t, CheckReplicationSecret([]byte("short")), ErrReplicationSecretTooShort)
+	short := httptest.NewServer(NewReplicationSource(primary, []byte("short")))
+	defer short.Close()
+	follower := NewReplicationFollower(short.URL, NewKeyStore(t.TempDir()), []byte("short"))
+	_, err := follower.Sync(context.Background())
+	require.ErrorContains(t, err, "500")
+}
+
+func TestReplicationRejectsOlderSnapshot(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("replication secret")
+	primary, _ := createTestStore(t)
+	old, err := CreateBackup(primary, secret)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(NewReplicationSource(primary, secret))
+	defer ts.Close()
+	follower := NewReplicationFollower(ts.URL, NewKeyStore(t.TempDir()), secret)
+	_, err = follower.Sync(context.Background())
+	require.NoError(t, err)
+
+	// replay the snapshot created before the applied one
+	replay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(old)
+	}))
+	defer replay.Close()
+	follower.Primary = replay.URL
+	_, err = follower.Sync(context.Background())
+	require.ErrorContains(t, err, "older")
+}
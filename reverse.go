@@ -2,17 +2,216 @@ package tang
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net"
+	"sync"
+	"time"
 )
 
+const (
+	// DefaultReverseTimeout is the default time limit for a single handshake accepted by ReverseServer
+	DefaultReverseTimeout = 30 * time.Second
+	// DefaultMaxLineSize is the default limit for a line received from the peer of a reverse handshake.
+	// It is large enough for a thumbprint or an exchange key of any supported curve.
+	DefaultMaxLineSize = 4096
+	// DefaultRetryBackoff is the default delay before the first retry of a failed reverse handshake
+	DefaultRetryBackoff = time.Second
+	// maxRetryBackoff caps the exponential backoff between retries
+	maxRetryBackoff = 30 * time.Second
+)
+
+var (
+	// ErrLineTooLong is returned when the peer of a reverse handshake sends a line longer than allowed
+	ErrLineTooLong = errors.New("line is too long")
+	// ErrInvalidToken is returned when the peer of a reverse handshake does not present the expected pre-shared token
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrThumbprintNotAllowed is returned when the peer of a reverse handshake asks for a key outside of the allow-list
+	ErrThumbprintNotAllowed = errors.New("thumbprint is not allowed")
+)
+
+// ReverseOptions configures ReverseTangHandshakeContext. The zero value is valid and means no timeouts,
+// no retries and the default line size limit.
+type ReverseOptions struct {
+	// DialTimeout limits the time spent establishing a connection. Zero means no limit.
+	DialTimeout time.Duration
+	// IOTimeout limits the duration of the handshake once the connection is established. Zero means no limit.
+	IOTimeout time.Duration
+	// MaxLineSize limits the size of a line received from the peer, DefaultMaxLineSize if zero
+	MaxLineSize int
+	// Retries is the number of additional attempts made when the remote is unreachable or drops the connection,
+	// e.g. because its initramfs has not finished booting yet
+	Retries int
+	// RetryBackoff is the delay before the first retry, DefaultRetryBackoff if zero. It doubles after each attempt.
+	RetryBackoff time.Duration
+	// TLSConfig enables TLS for the connection when set. See PinnedTLSConfig for pinning the remote certificate.
+	TLSConfig *tls.Config
+	// Token is a pre-shared secret the remote has to send before any key is recovered for it.
+	// Empty means the remote is not authenticated.
+	Token string
+	// AllowedThumbprints restricts the keys the remote may recover. A key is allowed if any of
+	// its thumbprints is in the list. Empty means any key of the KeySet may be used.
+	AllowedThumbprints []string
+	// Audit receives an event for every recovery attempt of the remote
+	Audit func(AuditEvent)
+}
+
+// handshakeConfig holds the parameters of the reverse protocol shared by the dialing and the listening side
+type handshakeConfig struct {
+	maxLineSize        int
+	token              string
+	allowedThumbprints []string
+	audit              func(AuditEvent)
+	// refuseApprovalRequired is set when remote clients initiate the handshake, they cannot wait for an approval
+	refuseApprovalRequired bool
+}
+
+// record counts the recovery attempt and sends an audit event about it if auditing is enabled
+func (cfg handshakeConfig) record(conn net.Conn, ks *KeySet, thp, result string, err error) {
+	countRequest("reverse-recover", result)
+	if cfg.audit == nil {
+		return
+	}
+	e := AuditEvent{
+		Time:   time.Now().UTC(),
+		Remote: conn.RemoteAddr().String(),
+		Action: "reverse-recover",
+		Result: result,
+	}
+	if thp != "" {
+		e.Keys = []string{ks.canonicalThumbprint(thp)}
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	cfg.audit(e)
+}
+
+// PinnedTLSConfig returns a TLS client configuration that trusts the remote only if it presents a certificate
+// whose SHA-256 fingerprint, or the SHA-256 fingerprint of whose public key (DER encoded SubjectPublicKeyInfo),
+// is one of the given pins. The pins replace the usual CA based verification.
+func PinnedTLSConfig(pins ...[]byte) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// the certificate chain is verified against the pins in VerifyPeerCertificate below
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("remote did not present a certificate")
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			certPin := sha256.Sum256(cert.Raw)
+			keyPin := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, p := range pins {
+				if bytes.Equal(p, certPin[:]) || bytes.Equal(p, keyPin[:]) {
+					return nil
+				}
+			}
+			return fmt.Errorf("remote certificate does not match any of the pins")
+		},
+	}
+}
+
 // ReverseTangHandshake performs a key exchange with "remote" clevis client
 func ReverseTangHandshake(address string, ks *KeySet) error {
-	conn, err := net.Dial("tcp", address)
+	return ReverseTangHandshakeContext(context.Background(), address, ks, ReverseOptions{})
+}
+
+// ReverseTangHandshakeContext performs a key exchange with "remote" clevis client.
+// The context bounds the whole operation including all the retries.
+func ReverseTangHandshakeContext(ctx context.Context, address string, ks *KeySet, opts ReverseOptions) error {
+	backoff := opts.RetryBackoff
+	if backoff == 0 {
+		backoff = DefaultRetryBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := reverseHandshakeOnce(ctx, address, ks, opts)
+		if err == nil || attempt >= opts.Retries || !isRetryable(err) {
+			return err
+		}
+		log.Printf("reverse handshake with %s failed, retrying in %v: %v", address, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+func reverseHandshakeOnce(ctx context.Context, address string, ks *KeySet, opts ReverseOptions) error {
+	dialer := net.Dialer{Timeout: opts.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 
+	if opts.IOTimeout != 0 {
+		if err := conn.SetDeadline(time.Now().Add(opts.IOTimeout)); err != nil {
+			return err
+		}
+	}
+	// unblock pending IO as soon as the context is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if opts.TLSConfig != nil {
+		cfg := opts.TLSConfig
+		if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+			cfg = cfg.Clone()
+			cfg.ServerName, _, _ = net.SplitHostPort(address)
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return err
+		}
+		conn = tlsConn
+	}
+
+	err = reverseHandshake(conn, ks, handshakeConfig{
+		maxLineSize:        opts.MaxLineSize,
+		token:              opts.Token,
+		allowedThumbprints: opts.AllowedThumbprints,
+		audit:              opts.Audit,
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// isRetryable reports whether a failed handshake is worth another attempt.
+// Network failures are, while protocol and recovery errors are not.
+func isRetryable(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// reverseHandshake runs the newline-framed reverse Tang protocol over an established connection:
+// the advertisement is sent first, then the peer replies with its token (if one is configured),
+// a thumbprint and an exchange key, and the recovered key is sent back.
+func reverseHandshake(conn net.Conn, ks *KeySet, cfg handshakeConfig) error {
+	maxLineSize := cfg.maxLineSize
+	if maxLineSize == 0 {
+		maxLineSize = DefaultMaxLineSize
+	}
+
 	if _, err := conn.Write(ks.DefaultAdvertisement); err != nil {
 		return err
 	}
@@ -20,21 +219,52 @@ func ReverseTangHandshake(address string, ks *KeySet) error {
 		return err
 	}
 
-	buff := bufio.NewReader(conn)
-	t, _, err := buff.ReadLine()
+	// the buffer fits the longest allowed line together with its CRLF terminator
+	buff := bufio.NewReaderSize(conn, maxLineSize+2)
+	if cfg.token != "" {
+		token, err := readLine(buff, maxLineSize)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare(token, []byte(cfg.token)) != 1 {
+			cfg.record(conn, ks, "", AuditDenied, ErrInvalidToken)
+			return ErrInvalidToken
+		}
+	}
+
+	t, err := readLine(buff, maxLineSize)
 	if err != nil {
 		return err
 	}
 	thp := string(t)
-	xchgKey, _, err := buff.ReadLine()
+	xchgKey, err := readLine(buff, maxLineSize)
 	if err != nil {
 		return err
 	}
 
+	if !ks.thumbprintAllowed(thp, cfg.allowedThumbprints) {
+		log.Printf("reverse handshake with %s: refusing to recover key %s", conn.RemoteAddr(), thp)
+		err := fmt.Errorf("%w: %s", ErrThumbprintNotAllowed, thp)
+		cfg.record(conn, ks, thp, AuditDenied, err)
+		return err
+	}
+
+	if cfg.refuseApprovalRequired && ks.approvalRequired(thp) {
+		err := fmt.Errorf("%w: %s", ErrApprovalRequired, thp)
+		cfg.record(conn, ks, thp, AuditDenied, err)
+		return err
+	}
+
 	out, err := ks.Recover(thp, xchgKey)
+	if errors.Is(err, ErrThumbprintHashNotAllowed) {
+		cfg.record(conn, ks, thp, AuditDenied, err)
+		return err
+	}
 	if err != nil {
+		cfg.record(conn, ks, thp, AuditFailed, err)
 		return err
 	}
+	cfg.record(conn, ks, thp, AuditOK, nil)
 
 	_, err = conn.Write(out)
 	if err != nil {
@@ -47,3 +277,166 @@ func ReverseTangHandshake(address string, ks *KeySet) error {
 
 	return nil
 }
+
+// readLine reads a single line of at most maxLineSize bytes
+func readLine(r *bufio.Reader, maxLineSize int) ([]byte, error) {
+	line, isPrefix, err := r.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	if isPrefix || len(line) > maxLineSize {
+		return nil, ErrLineTooLong
+	}
+	return line, nil
+}
+
+// ReverseServer accepts connections from remote clevis clients and performs reverse Tang handshakes with them.
+// It is the listening counterpart of ReverseTangHandshake and is useful when the clients are not reachable
+// from the Tang host, e.g. when they are behind NAT.
+type ReverseServer struct {
+	// Addr is the TCP address to listen on, ":8609" if empty
+	Addr string
+	Keys *KeySet
+	// Timeout limits the duration of a single handshake. Zero means no limit.
+	Timeout time.Duration
+	// MaxLineSize limits the size of a line received from the peer, DefaultMaxLineSize if zero
+	MaxLineSize int
+	// TLSConfig enables TLS for the accepted connections when set, it has to contain the server certificate
+	TLSConfig *tls.Config
+	// Token is a pre-shared secret the remote has to send before any key is recovered for it.
+	// Empty means the remote is not authenticated.
+	Token string
+	// AllowedThumbprints restricts the keys remote clients may recover, see ReverseOptions
+	AllowedThumbprints []string
+	// Audit receives an event for every recovery attempt of a remote client
+	Audit func(AuditEvent)
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewReverseServer creates a new instance of reverse Tang server
+func NewReverseServer() *ReverseServer {
+	return &ReverseServer{Timeout: DefaultReverseTimeout}
+}
+
+// ListenAndServe listens on s.Addr and serves incoming handshakes
+func (s *ReverseServer) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":8609"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the listener and performs a handshake for each of them in a separate goroutine.
+// Serve returns nil after the server is closed.
+func (s *ReverseServer) Serve(l net.Listener) error {
+	if !s.trackListener(l) {
+		_ = l.Close()
+		return nil
+	}
+	defer s.untrackListener(l)
+
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !s.trackConnection() {
+			_ = conn.Close()
+			return nil
+		}
+		go func() {
+			defer s.wg.Done()
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+// Close stops all listeners and waits for handshakes in flight to finish
+func (s *ReverseServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && !errors.Is(cerr, net.ErrClosed) {
+			err = cerr
+		}
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *ReverseServer) trackListener(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+// trackConnection registers a new handshake unless the server is being closed
+func (s *ReverseServer) trackConnection() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *ReverseServer) untrackListener(l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.listeners, l)
+}
+
+func (s *ReverseServer) handleConnection(conn net.Conn) {
+	// conn is replaced with a TLS connection below, close whichever is current
+	defer func() { _ = conn.Close() }()
+
+	if s.Timeout != 0 {
+		if err := conn.SetDeadline(time.Now().Add(s.Timeout)); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	if s.TLSConfig != nil {
+		conn = tls.Server(conn, s.TLSConfig)
+	}
+
+	cfg := handshakeConfig{
+		maxLineSize:        s.MaxLineSize,
+		token:              s.Token,
+		allowedThumbprints: s.AllowedThumbprints,
+		audit:              s.Audit,
+		// an operator approves the handshakes it initiates, but not the ones of remote clients
+		refuseApprovalRequired: true,
+	}
+	if err := reverseHandshake(conn, s.Keys, cfg); err != nil {
+		log.Printf("reverse handshake with %s failed: %v", conn.RemoteAddr(), err)
+	}
+}
@@ -2,14 +2,106 @@ package tang
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"net"
 	"strconv"
-	"sync"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
+const (
+	reverseTestThp     = "dFS8kG4bYnFTimBT8X6z-CuOpiKzrQeqeSdPV8GA_5M"
+	reverseTestXferKey = `{"alg":"ECMR","crv":"P-521","kty":"EC","x":"AJHmF7pamkUGBoBoYiOHPz3GzeD8kexttzWvJ2BsQLslgwcZkhODKCo_OJ2WYnDPy4o4b3NIIpdpg8hgklxVjJVe","y":"AJi3YqTPNJOeboS7etpeqCrv3hWfI2yRL0JPVmPMm98lfxZfemkzSAYvuBX0a0hRXQw_HGULBsESUNaMYmxtj7GZ"}`
+	reverseTestResult  = `{"alg":"ECMR","crv":"P-521","key_ops":["deriveKey"],"kty":"EC","x":"AU9g1_ZVW3Ar3iB9d4FMQ3HuTKP6qc7Fww8dGY5rOXn1TCqd6LRXmxsDGbvZX2EmzJwI0BBERymAtOvKBram2QIU","y":"AXHt-jUcqX-D9qch4ZGDudbD--PIhHHq9UhEqhvoUws9-RYbd8JJTFYe2PQCF4qs2XTh27hnAMbOhGSbsLEYRJR4"}`
+)
+
+// runReverseClient plays the clevis side of the reverse protocol over conn. It runs outside of the test
+// goroutine, so it returns errors for the test to check instead of failing it.
+func runReverseClient(conn net.Conn, ks *KeySet) error {
+	return runReverseClientWithToken(conn, ks, "")
+}
+
+func runReverseClientWithToken(conn net.Conn, ks *KeySet, token string) error {
+	buff := bufio.NewReader(conn)
+	adv, _, err := buff.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(ks.DefaultAdvertisement, adv) {
+		return fmt.Errorf("unexpected advertisement %s", adv)
+	}
+
+	if token != "" {
+		if _, err := conn.Write([]byte(token + "\n")); err != nil {
+			return err
+		}
+	}
+
+	if _, err := conn.Write([]byte(reverseTestThp + "\n")); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte(reverseTestXferKey + "\n")); err != nil {
+		return err
+	}
+
+	returnKey, _, err := buff.ReadLine()
+	if err != nil {
+		return err
+	}
+	if string(returnKey) != reverseTestResult {
+		return fmt.Errorf("unexpected key %s", returnKey)
+	}
+	return nil
+}
+
+// runRefusedReverseClient sends a recovery request the handshake has to refuse, no key may be sent back
+func runRefusedReverseClient(conn net.Conn, request string) error {
+	buff := bufio.NewReader(conn)
+	if _, _, err := buff.ReadLine(); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return err
+	}
+	if _, err := buff.ReadByte(); !errors.Is(err, io.EOF) {
+		return fmt.Errorf("expected the connection to be closed, got %v", err)
+	}
+	return nil
+}
+
+// acceptReverseClient accepts a single connection and runs the client on it. The result is sent to the
+// returned channel, so the test goroutine can check it.
+func acceptReverseClient(l net.Listener, client func(conn net.Conn) error) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		errs <- client(conn)
+	}()
+	return errs
+}
+
 func TestReverseTangHandshake(t *testing.T) {
 	ks, err := ReadKeys("testdata/keys")
 	require.NoError(t, err)
@@ -18,28 +110,389 @@ func TestReverseTangHandshake(t *testing.T) {
 	require.NoError(t, err)
 	port := l.Addr().(*net.TCPAddr).Port
 
-	wg := sync.WaitGroup{}
-	wg.Go(func() {
+	errs := acceptReverseClient(l, func(conn net.Conn) error { return runReverseClient(conn, ks) })
+
+	require.NoError(t, ReverseTangHandshake(":"+strconv.Itoa(port), ks))
+	require.NoError(t, <-errs)
+}
+
+func TestReverseTangHandshakeContextRetry(t *testing.T) {
+	t.Parallel()
+
+	ks, err := ReadKeys("testdata/keys")
+	require.NoError(t, err)
+
+	// reserve a port and release it, the "remote" starts listening on it later
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	errs := make(chan error, 1)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer l.Close()
+		errs <- <-acceptReverseClient(l, func(conn net.Conn) error { return runReverseClient(conn, ks) })
+	}()
+
+	opts := ReverseOptions{
+		DialTimeout:  time.Second,
+		IOTimeout:    5 * time.Second,
+		Retries:      20,
+		RetryBackoff: 50 * time.Millisecond,
+	}
+	require.NoError(t, ReverseTangHandshakeContext(context.Background(), addr, ks, opts))
+	require.NoError(t, <-errs)
+}
+
+func TestReverseTangHandshakeContextIOTimeout(t *testing.T) {
+	t.Parallel()
+
+	ks, err := ReadKeys("testdata/keys")
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		// accept the connection and never answer
 		conn, err := l.Accept()
-		require.NoError(t, err)
+		if err == nil {
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
 
-		buff := bufio.NewReader(conn)
-		adv, _, err := buff.ReadLine()
-		require.NoError(t, err)
-		require.Equal(t, ks.DefaultAdvertisement, adv)
+	err = ReverseTangHandshakeContext(context.Background(), l.Addr().String(), ks, ReverseOptions{IOTimeout: 100 * time.Millisecond})
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	require.True(t, netErr.Timeout())
+}
 
-		_, err = conn.Write([]byte("dFS8kG4bYnFTimBT8X6z-CuOpiKzrQeqeSdPV8GA_5M\n"))
-		require.NoError(t, err)
-		xferKey := `{"alg":"ECMR","crv":"P-521","kty":"EC","x":"AJHmF7pamkUGBoBoYiOHPz3GzeD8kexttzWvJ2BsQLslgwcZkhODKCo_OJ2WYnDPy4o4b3NIIpdpg8hgklxVjJVe","y":"AJi3YqTPNJOeboS7etpeqCrv3hWfI2yRL0JPVmPMm98lfxZfemkzSAYvuBX0a0hRXQw_HGULBsESUNaMYmxtj7GZ"}`
-		_, err = conn.Write([]byte(xferKey + "\n"))
-		require.NoError(t, err)
+func TestReverseTangHandshakeContextCancel(t *testing.T) {
+	t.Parallel()
 
-		returnKey, _, err := buff.ReadLine()
-		require.NoError(t, err)
-		require.Equal(t, `{"alg":"ECMR","crv":"P-521","key_ops":["deriveKey"],"kty":"EC","x":"AU9g1_ZVW3Ar3iB9d4FMQ3HuTKP6qc7Fww8dGY5rOXn1TCqd6LRXmxsDGbvZX2EmzJwI0BBERymAtOvKBram2QIU","y":"AXHt-jUcqX-D9qch4ZGDudbD--PIhHHq9UhEqhvoUws9-RYbd8JJTFYe2PQCF4qs2XTh27hnAMbOhGSbsLEYRJR4"}`, string(returnKey))
+	ks, err := ReadKeys("testdata/keys")
+	require.NoError(t, err)
 
-	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
 
-	require.NoError(t, ReverseTangHandshake(":"+strconv.Itoa(port), ks))
-	wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// nobody listens on the address, so the handshake keeps retrying until the context expires
+	err = ReverseTangHandshakeContext(ctx, addr, ks, ReverseOptions{Retries: 1000, RetryBackoff: 10 * time.Millisecond})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestReverseTangHandshakeLineTooLong(t *testing.T) {
+	t.Parallel()
+
+	ks, err := ReadKeys("testdata/keys")
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte(strings.Repeat("x", 100) + "\n"))
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	opts := ReverseOptions{IOTimeout: 5 * time.Second, MaxLineSize: 64, Retries: 3}
+	err = ReverseTangHandshakeContext(context.Background(), l.Addr().String(), ks, opts)
+	require.ErrorIs(t, err, ErrLineTooLong)
+}
+
+// generateTestCertificate creates a self-signed certificate for a TLS server
+func generateTestCertificate(t *testing.T) tls.Certificate {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "remote"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"remote"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv, Leaf: leaf}
+}
+
+func TestReverseTangHandshakeTLS(t *testing.T) {
+	t.Parallel()
+
+	ks, err := ReadKeys("testdata/keys")
+	require.NoError(t, err)
+
+	cert := generateTestCertificate(t)
+	certPin := sha256.Sum256(cert.Leaf.Raw)
+	keyPin := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	wrongPin := sha256.Sum256([]byte("something else"))
+
+	tests := []struct {
+		name    string
+		pin     []byte
+		success bool
+	}{
+		{"certificate pin", certPin[:], true},
+		{"public key pin", keyPin[:], true},
+		{"wrong pin", wrongPin[:], false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+			require.NoError(t, err)
+			defer l.Close()
+
+			errs := acceptReverseClient(l, func(conn net.Conn) error {
+				if test.success {
+					return runReverseClient(conn, ks)
+				}
+				// the handshake fails on the client side, the connection is dropped
+				if _, err := io.Copy(io.Discard, conn); err == nil {
+					return errors.New("expected the TLS handshake to fail")
+				}
+				return nil
+			})
+
+			opts := ReverseOptions{IOTimeout: 5 * time.Second, TLSConfig: PinnedTLSConfig(test.pin)}
+			err = ReverseTangHandshakeContext(context.Background(), l.Addr().String(), ks, opts)
+			if test.success {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, "does not match any of the pins")
+			}
+			require.NoError(t, <-errs)
+		})
+	}
+}
+
+func TestReverseTangHandshakeToken(t *testing.T) {
+	t.Parallel()
+
+	ks, err := ReadKeys("testdata/keys")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		clientToken string
+		err         error
+	}{
+		{"valid token", "s3cret", nil},
+		{"invalid token", "guess", ErrInvalidToken},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer l.Close()
+
+			errs := acceptReverseClient(l, func(conn net.Conn) error {
+				if test.err == nil {
+					return runReverseClientWithToken(conn, ks, test.clientToken)
+				}
+				return runRefusedReverseClient(conn, test.clientToken+"\n"+reverseTestThp+"\n"+reverseTestXferKey+"\n")
+			})
+
+			opts := ReverseOptions{IOTimeout: 5 * time.Second, Token: "s3cret"}
+			err = ReverseTangHandshakeContext(context.Background(), l.Addr().String(), ks, opts)
+			if test.err == nil {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, test.err)
+			}
+			require.NoError(t, <-errs)
+		})
+	}
+}
+
+func TestReverseTangHandshakeAllowedThumbprints(t *testing.T) {
+	t.Parallel()
+
+	ks, err := ReadKeys("testdata/keys")
+	require.NoError(t, err)
+
+	// the same key referenced by its SHA-1 thumbprint
+	thpBytes, err := ks.byThumbprint[reverseTestThp].Thumbprint(crypto.SHA1)
+	require.NoError(t, err)
+	sha1Thp := base64.RawURLEncoding.EncodeToString(thpBytes)
+
+	tests := []struct {
+		name    string
+		allowed []string
+		success bool
+	}{
+		{"no restrictions", nil, true},
+		{"same thumbprint", []string{reverseTestThp}, true},
+		{"other hash of the same key", []string{"unknown", sha1Thp}, true},
+		{"other key", []string{"pTCu5WAbp69L1WqIOYdjRzQ004EdLQNgA0EioUqdFho"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer l.Close()
+
+			errs := acceptReverseClient(l, func(conn net.Conn) error {
+				if test.success {
+					return runReverseClient(conn, ks)
+				}
+				return runRefusedReverseClient(conn, reverseTestThp+"\n"+reverseTestXferKey+"\n")
+			})
+
+			opts := ReverseOptions{IOTimeout: 5 * time.Second, AllowedThumbprints: test.allowed}
+			err = ReverseTangHandshakeContext(context.Background(), l.Addr().String(), ks, opts)
+			if test.success {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, ErrThumbprintNotAllowed)
+			}
+			require.NoError(t, <-errs)
+		})
+	}
+}
+
+func startReverseServer(t *testing.T, ks *KeySet, timeout time.Duration) (string, *ReverseServer) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := NewReverseServer()
+	srv.Keys = ks
+	srv.Timeout = timeout
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return l.Addr().String(), srv
+}
+
+func TestReverseServer(t *testing.T) {
+	t.Parallel()
+
+	ks, err := ReadKeys("testdata/keys")
+	require.NoError(t, err)
+
+	addr, _ := startReverseServer(t, ks, DefaultReverseTimeout)
+
+	const clients = 10
+	errs := make(chan error, clients)
+	for range clients {
+		go func() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			errs <- runReverseClient(conn, ks)
+		}()
+	}
+	for range clients {
+		require.NoError(t, <-errs)
+	}
+}
+
+func TestReverseServerTimeout(t *testing.T) {
+	t.Parallel()
+
+	ks, err := ReadKeys("testdata/keys")
+	require.NoError(t, err)
+
+	addr, _ := startReverseServer(t, ks, 100*time.Millisecond)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the client never answers, so the server has to drop the connection after the advertisement
+	buff := bufio.NewReader(conn)
+	_, _, err = buff.ReadLine()
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = buff.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestReverseServerTLSAndToken(t *testing.T) {
+	t.Parallel()
+
+	ks, err := ReadKeys("testdata/keys")
+	require.NoError(t, err)
+
+	cert := generateTestCertificate(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := NewReverseServer()
+	srv.Keys = ks
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.Token = "s3cret"
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	defer srv.Close()
+
+	keyPin := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	conn, err := tls.Dial("tcp", l.Addr().String(), PinnedTLSConfig(keyPin[:]))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, runReverseClientWithToken(conn, ks, "s3cret"))
+}
+
+func TestReverseServerClose(t *testing.T) {
+	t.Parallel()
+
+	ks, err := ReadKeys("testdata/keys")
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := NewReverseServer()
+	srv.Keys = ks
+	done := make(chan error)
+	go func() {
+		done <- srv.Serve(l)
+	}()
+
+	// make sure the listener is accepting before closing it
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, runReverseClient(conn, ks))
+	_ = conn.Close()
+
+	require.NoError(t, srv.Close())
+	require.NoError(t, <-done)
 }
@@ -1,19 +1,81 @@
 package tang
 
 import (
+	"errors"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Server is a HTTP server instance that handles Tang exchange requests
 type Server struct {
 	http.Server
+	// Keys is the initial key set, use SetKeys to replace it while the server is running
 	Keys *KeySet
+	// Audit receives an event for every recovery request
+	Audit func(AuditEvent)
+	// Approvals holds the recoveries of approval-required keys, such recoveries are refused if it is nil
+	Approvals *ApprovalQueue
+	// MaxAge is the time clients and caches may use an advertisement without revalidating it
+	MaxAge time.Duration
+
+	mu sync.RWMutex
+}
+
+// SetKeys atomically replaces the key set used to serve requests
+func (srv *Server) SetKeys(ks *KeySet) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.Keys = ks
+	metrics.Add("keys.updates", 1)
 }
 
+// keySet returns the current key set, its advertisements are recomputed once a validity bound of a key has passed
+func (srv *Server) keySet() *KeySet {
+	srv.mu.RLock()
+	ks := srv.Keys
+	srv.mu.RUnlock()
+
+	now := time.Now()
+	if ks == nil || !ks.stale(now) {
+		return ks
+	}
+	fresh := ks.refreshed(now)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	// another request may have replaced the keys in the meantime
+	if srv.Keys == ks {
+		srv.Keys = fresh
+	}
+	return srv.Keys
+}
+
+// advertiseKey serves the default advertisement on /adv and the advertisement of a sign key on /adv/{thp}.
+// The single-signature formats of /adv are signed by the first advertised sign key, those of /adv/{thp}
+// by the key itself.
+//
+// Like tangd, /adv/{thp} answers by the class of the key with any supported thumbprint hash:
+//
+//	advertised sign key    the default advertisement
+//	hidden sign key        the default payload signed by the advertised sign keys and the key itself
+//	exchange key           404, exchange keys are listed in the payload but sign nothing
+//	unknown key            404
+//
+// Revoked keys and keys outside their validity period are treated as unknown.
 func (srv *Server) advertiseKey(w http.ResponseWriter, req *http.Request) {
-	uri := req.RequestURI
+	uri := req.URL.Path
+	keys := srv.keySet()
+
+	format, err := negotiateAdvertisementFormat(req)
+	if err != nil {
+		countRequest("advertise", "bad_request")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	var thumbprint string
 	if strings.HasPrefix(uri, "/adv/") {
@@ -21,22 +83,78 @@ func (srv *Server) advertiseKey(w http.ResponseWriter, req *http.Request) {
 	}
 
 	if thumbprint != "" {
-		key, found := srv.Keys.byThumbprint[thumbprint]
-		if !found {
+		key, err := keys.countedLookup(thumbprint)
+		if err != nil {
+			countRequest("advertise", "bad_request")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if key == nil {
+			countRequest("advertise", "not_found")
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		if key.advertisement == nil {
+		adv := key.serialized(format)
+		if adv.data == nil {
+			countRequest("advertise", "not_found")
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		_, _ = w.Write(key.advertisement)
+		srv.writeAdvertisement(w, req, format, adv)
 	} else {
-		_, _ = w.Write(srv.Keys.DefaultAdvertisement)
+		if keys.DefaultAdvertisement == nil {
+			countRequest("advertise", "unavailable")
+			http.Error(w, "no valid keys to advertise", http.StatusServiceUnavailable)
+			return
+		}
+		adv := serialization{keys.DefaultAdvertisement, keys.defaultETag}
+		if format != AdvertisementGeneral {
+			if keys.defaultSigner == nil {
+				countRequest("advertise", "unavailable")
+				http.Error(w, "no single-signature advertisement available", http.StatusNotAcceptable)
+				return
+			}
+			adv = keys.defaultSigner.serialized(format)
+		}
+		srv.writeAdvertisement(w, req, format, adv)
 	}
 }
 
+// writeAdvertisement sends the advertisement with its caching headers, or 304 if the client has it already
+func (srv *Server) writeAdvertisement(w http.ResponseWriter, req *http.Request, format AdvertisementFormat, adv serialization) {
+	h := w.Header()
+	h.Set("Content-Type", format.ContentType())
+	h.Set("Vary", "Accept")
+	if srv.MaxAge > 0 {
+		h.Set("Cache-Control", "max-age="+strconv.Itoa(int(srv.MaxAge.Seconds())))
+	} else {
+		h.Set("Cache-Control", "no-cache")
+	}
+	if adv.etag != "" {
+		h.Set("ETag", adv.etag)
+		if etagMatches(req.Header.Get("If-None-Match"), adv.etag) {
+			countRequest("advertise", "not_modified")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	countRequest("advertise", "ok")
+	_, _ = w.Write(adv.data)
+}
+
+// etagMatches implements the weak comparison If-None-Match uses
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func (srv *Server) recoverKey(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "POST" {
 		w.WriteHeader(http.StatusBadRequest)
@@ -55,19 +173,54 @@ func (srv *Server) recoverKey(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	thp := req.RequestURI[5:]
-	out, err := srv.Keys.Recover(thp, in)
+	thp := strings.TrimPrefix(req.URL.Path, "/rec/")
+	keys := srv.keySet()
+	if keys.approvalRequired(thp) {
+		approved, result, err := srv.awaitApproval(w, req, thp, in)
+		if !approved {
+			srv.auditRecovery(req, keys, thp, result, err)
+			return
+		}
+	}
+
+	out, err := keys.Recover(thp, in)
+	if errors.Is(err, ErrThumbprintHashNotAllowed) {
+		srv.auditRecovery(req, keys, thp, AuditDenied, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
+		srv.auditRecovery(req, keys, thp, AuditFailed, err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	srv.auditRecovery(req, keys, thp, AuditOK, nil)
 
 	w.Header().Set("Content-Type", "application/jwk+json")
 	_, _ = w.Write(out)
 }
 
+// auditRecovery counts the recovery and sends an audit event about it if auditing is enabled
+func (srv *Server) auditRecovery(req *http.Request, keys *KeySet, thp, result string, err error) {
+	countRequest("recover", result)
+	if srv.Audit == nil {
+		return
+	}
+	e := AuditEvent{
+		Time:   time.Now().UTC(),
+		Remote: req.RemoteAddr,
+		Action: "recover",
+		Keys:   []string{keys.canonicalThumbprint(thp)},
+		Result: result,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	srv.Audit(e)
+}
+
 func (srv *Server) handleRequest(w http.ResponseWriter, req *http.Request) {
-	uri := req.RequestURI
+	uri := req.URL.Path
 	if uri == "/adv" || strings.HasPrefix(uri, "/adv/") {
 		srv.advertiseKey(w, req)
 	} else if strings.HasPrefix(uri, "/rec/") {
@@ -3,16 +3,21 @@ package tang
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/anatol/clevis.go"
+	"github.com/lestrrat-go/jwx/v3/jwa"
 	"github.com/lestrrat-go/jwx/v3/jwk"
 	"github.com/lestrrat-go/jwx/v3/jws"
 	"github.com/stretchr/testify/require"
@@ -289,6 +294,23 @@ func TestRecoverKeyUnknownThumbprint(t *testing.T) {
 	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
 }
 
+func TestRecoverKeyThumbprintFromPath(t *testing.T) {
+	t.Parallel()
+
+	keys, err := ReadKeys("testdata/keys")
+	require.NoError(t, err)
+	srv := NewServer()
+	srv.Keys = keys
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	// the query is not part of the thumbprint
+	resp, data := approvalTestRecover(t, ts.URL, "dFS8kG4bYnFTimBT8X6z-CuOpiKzrQeqeSdPV8GA_5M?client=1", "", reverseTestXferKey)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = jwk.ParseKey(data)
+	require.NoError(t, err)
+}
+
 func TestAdvertiseKeyNotFoundThumbprint(t *testing.T) {
 	t.Parallel()
 
@@ -317,3 +339,164 @@ func TestDefaultAdvertisement(t *testing.T) {
 	_, err = jws.Parse(data)
 	require.NoError(t, err)
 }
+
+func TestAdvertisementCaching(t *testing.T) {
+	t.Parallel()
+
+	keys, err := ReadKeys("testdata/keys")
+	require.NoError(t, err)
+	srv := NewServer()
+	srv.Keys = keys
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	get := func(path, ifNoneMatch string) *http.Response {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		require.NoError(t, err)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	resp := get("/adv", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/jose+json", resp.Header.Get("Content-Type"))
+	require.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+	etag := resp.Header.Get("ETag")
+	require.Equal(t, keys.defaultETag, etag)
+
+	for _, match := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		resp = get("/adv", match)
+		require.Equal(t, http.StatusNotModified, resp.StatusCode, match)
+		require.Equal(t, etag, resp.Header.Get("ETag"))
+	}
+	require.Equal(t, http.StatusOK, get("/adv", `"other"`).StatusCode)
+
+	// every signing key serves its advertisement with the matching tag
+	for thp, k := range keys.byThumbprint {
+		if !keyValidForUse(k, []jwk.KeyOperation{jwk.KeyOpSign}) {
+			continue
+		}
+		resp = get("/adv/"+thp, "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, k.etag, resp.Header.Get("ETag"))
+		require.Equal(t, http.StatusNotModified, get("/adv/"+thp, k.etag).StatusCode)
+	}
+
+	// reloading different keys changes the tag
+	vk, err := GenerateVerifyKey()
+	require.NoError(t, err)
+	ek, err := GenerateExchangeKey()
+	require.NoError(t, err)
+	reloaded := NewKeySet()
+	require.NoError(t, reloaded.AppendKey(vk, true))
+	require.NoError(t, reloaded.AppendKey(ek, true))
+	require.NoError(t, reloaded.RecomputeAdvertisements())
+	srv.SetKeys(reloaded)
+
+	resp = get("/adv", etag)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotEqual(t, etag, resp.Header.Get("ETag"))
+
+	srv.MaxAge = 5 * time.Minute
+	require.Equal(t, "max-age=300", get("/adv", "").Header.Get("Cache-Control"))
+}
+
+type perKeyAdvertisementCase struct {
+	name   string
+	thp    string
+	signer jwk.Key // key that has to sign the advertisement, nil if it is not found
+}
+
+// perKeyAdvertisementKeys creates a key directory with a key of every class and the /adv/{thp} cases for them
+func perKeyAdvertisementKeys(t *testing.T) (string, []perKeyAdvertisementCase) {
+	dir := t.TempDir()
+	ents, err := os.ReadDir("testdata/keys")
+	require.NoError(t, err)
+	for _, e := range ents {
+		data, err := os.ReadFile("testdata/keys/" + e.Name())
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dir+"/"+e.Name(), data, 0o600))
+	}
+
+	hiddenSign, err := GenerateVerifyKey()
+	require.NoError(t, err)
+	hiddenExchange, err := GenerateExchangeKey()
+	require.NoError(t, err)
+	thps := make(map[jwk.Key]string)
+	for _, k := range []jwk.Key{hiddenSign, hiddenExchange} {
+		thp, err := thumbprint(k, ThumbprintHash)
+		require.NoError(t, err)
+		data, err := json.Marshal(k)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dir+"/."+thp+".jwk", data, 0o600))
+		thps[k] = thp
+	}
+
+	keys, err := ReadKeys(dir)
+	require.NoError(t, err)
+	advertisedSign := keys.byThumbprint["D9PhbUsoRR8X7JplTtba1ZEhgg_NKf_5waxK9k_gjLg"]
+	require.NotNil(t, advertisedSign)
+	sha1Thp, err := thumbprint(advertisedSign, crypto.SHA1)
+	require.NoError(t, err)
+
+	return dir, []perKeyAdvertisementCase{
+		{"advertised sign key", "D9PhbUsoRR8X7JplTtba1ZEhgg_NKf_5waxK9k_gjLg", advertisedSign.Key},
+		{"advertised sign key by sha1", sha1Thp, advertisedSign.Key},
+		{"hidden sign key", thps[hiddenSign], hiddenSign},
+		{"advertised exchange key", "dFS8kG4bYnFTimBT8X6z-CuOpiKzrQeqeSdPV8GA_5M", nil},
+		{"hidden exchange key", thps[hiddenExchange], nil},
+		{"unknown key", "Ynx8mXsXJkO1ws5SzkxMnU6mDQ2bG-l2gH2oe5xg3QY", nil},
+	}
+}
+
+func checkPerKeyAdvertisements(t *testing.T, url string, cases []perKeyAdvertisementCase) {
+	for _, c := range cases {
+		resp, err := http.Get(url + "/adv/" + c.thp)
+		require.NoError(t, err, c.name)
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		if c.signer == nil {
+			require.Equal(t, http.StatusNotFound, resp.StatusCode, c.name)
+			continue
+		}
+		require.Equal(t, http.StatusOK, resp.StatusCode, c.name)
+		_, err = VerifyAdvertisement(data)
+		require.NoError(t, err, c.name)
+		pub, err := c.signer.PublicKey()
+		require.NoError(t, err)
+		_, err = jws.Verify(data, jws.WithKey(jwa.ES512(), pub))
+		require.NoError(t, err, c.name)
+	}
+}
+
+func TestPerKeyAdvertisement(t *testing.T) {
+	t.Parallel()
+
+	dir, cases := perKeyAdvertisementKeys(t)
+	keys, err := ReadKeys(dir)
+	require.NoError(t, err)
+	srv := NewServer()
+	srv.Keys = keys
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	checkPerKeyAdvertisements(t, ts.URL, cases)
+}
+
+func TestPerKeyAdvertisementNative(t *testing.T) {
+	t.Parallel()
+
+	dir, cases := perKeyAdvertisementKeys(t)
+	srv, err := NewNativeServer(dir, 0)
+	require.NoError(t, err)
+	defer srv.Stop()
+
+	checkPerKeyAdvertisements(t, fmt.Sprintf("http://localhost:%d", srv.Port), cases)
+}
@@ -0,0 +1,181 @@
+package tang
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+// shareVersion is the version of the textual share format
+const shareVersion = 1
+
+// shareEncoding only uses characters of the QR code alphanumeric mode
+var shareEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Share is a single share of a secret split with SplitSecret
+type Share struct {
+	// Threshold is the number of shares needed to recover the secret
+	Threshold int
+	// X is the evaluation point of the share, it is unique among the shares of a secret
+	X byte
+	// Y holds the polynomial values for every byte of the secret
+	Y []byte
+}
+
+// SplitSecret splits the secret into n shares using Shamir's secret sharing over GF(2^8).
+// Any k of the shares recover the secret, while fewer shares reveal nothing about it.
+func SplitSecret(secret []byte, n, k int) ([]Share, error) {
+	if k < 2 {
+		return nil, fmt.Errorf("threshold must be at least 2")
+	}
+	if n < k {
+		return nil, fmt.Errorf("number of shares (%d) is less than threshold (%d)", n, k)
+	}
+	if n > 255 {
+		return nil, fmt.Errorf("number of shares must not exceed 255")
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("empty secret")
+	}
+
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{Threshold: k, X: byte(i + 1), Y: make([]byte, len(secret))}
+	}
+
+	// every byte of the secret is the constant term of its own random polynomial of degree k-1
+	coeffs := make([]byte, k)
+	for b, s := range secret {
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		coeffs[0] = s
+		for i := range shares {
+			shares[i].Y[b] = gfEval(coeffs, shares[i].X)
+		}
+	}
+
+	return shares, nil
+}
+
+// CombineShares recovers the secret from at least threshold shares using Lagrange interpolation
+func CombineShares(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("no shares")
+	}
+	threshold, size := shares[0].Threshold, len(shares[0].Y)
+	if len(shares) < threshold {
+		return nil, fmt.Errorf("%d shares are needed, only %d provided", threshold, len(shares))
+	}
+
+	seen := make(map[byte]bool)
+	for _, s := range shares {
+		if s.Threshold != threshold || len(s.Y) != size {
+			return nil, fmt.Errorf("shares belong to different secrets")
+		}
+		if s.X == 0 {
+			return nil, fmt.Errorf("invalid share index 0")
+		}
+		if seen[s.X] {
+			return nil, fmt.Errorf("duplicate share %d", s.X)
+		}
+		seen[s.X] = true
+	}
+
+	// any threshold shares determine the polynomial, use exactly that many
+	shares = shares[:threshold]
+	secret := make([]byte, size)
+	for i, si := range shares {
+		// Lagrange basis polynomial for share i evaluated at 0
+		basis := byte(1)
+		for j, sj := range shares {
+			if i == j {
+				continue
+			}
+			basis = gfMul(basis, gfDiv(sj.X, sj.X^si.X))
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(si.Y[b], basis)
+		}
+	}
+
+	return secret, nil
+}
+
+// String encodes the share as "TANG<version>-<threshold>-<index>-<data>-<checksum>" where data and checksum
+// are base32 encoded. The result only contains characters of the QR code alphanumeric mode.
+func (s Share) String() string {
+	data := shareEncoding.EncodeToString(s.Y)
+	prefix := fmt.Sprintf("TANG%d-%d-%d-%s", shareVersion, s.Threshold, s.X, data)
+	return prefix + "-" + shareChecksum(prefix)
+}
+
+// ParseShare parses a share encoded with Share.String
+func ParseShare(str string) (Share, error) {
+	str = strings.ToUpper(strings.TrimSpace(str))
+
+	parts := strings.Split(str, "-")
+	if len(parts) != 5 {
+		return Share{}, fmt.Errorf("invalid share format")
+	}
+	prefix := strings.Join(parts[:4], "-")
+	if parts[4] != shareChecksum(prefix) {
+		return Share{}, fmt.Errorf("share checksum mismatch, the share is mistyped or corrupted")
+	}
+
+	var version, threshold, x int
+	if _, err := fmt.Sscanf(parts[0], "TANG%d", &version); err != nil || version != shareVersion {
+		return Share{}, fmt.Errorf("unsupported share version %s", parts[0])
+	}
+	if _, err := fmt.Sscanf(parts[1]+" "+parts[2], "%d %d", &threshold, &x); err != nil {
+		return Share{}, fmt.Errorf("invalid share header: %v", err)
+	}
+	if x < 1 || x > 255 || threshold < 2 {
+		return Share{}, fmt.Errorf("invalid share header")
+	}
+	y, err := shareEncoding.DecodeString(parts[3])
+	if err != nil {
+		return Share{}, fmt.Errorf("invalid share data: %v", err)
+	}
+
+	return Share{Threshold: threshold, X: byte(x), Y: y}, nil
+}
+
+func shareChecksum(s string) string {
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE([]byte(s)))
+	return shareEncoding.EncodeToString(sum[:])
+}
+
+// gfEval evaluates the polynomial with the given coefficients at x using Horner's method
+func gfEval(coeffs []byte, x byte) byte {
+	var y byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ coeffs[i]
+	}
+	return y
+}
+
+// gfMul multiplies in GF(2^8) with the AES reduction polynomial x^8 + x^4 + x^3 + x + 1
+func gfMul(a, b byte) byte {
+	var p byte
+	for range 8 {
+		// masks instead of branches keep the timing independent of the values
+		p ^= a & -(b & 1)
+		a = (a << 1) ^ (0x1b & -(a >> 7))
+		b >>= 1
+	}
+	return p
+}
+
+// gfDiv divides a by a non-zero b, the inverse of b is b^254
+func gfDiv(a, b byte) byte {
+	inv := byte(1)
+	for range 254 {
+		inv = gfMul(inv, b)
+	}
+	return gfMul(a, inv)
+}
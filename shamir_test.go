@@ -0,0 +1,146 @@
+package tang
+
+import (
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// combinations calls f for every k-element subset of shares
+func combinations(shares []Share, k int, f func([]Share)) {
+	var rec func(start int, chosen []Share)
+	rec = func(start int, chosen []Share) {
+		if len(chosen) == k {
+			f(append([]Share(nil), chosen...))
+			return
+		}
+		for i := start; i < len(shares); i++ {
+			rec(i+1, append(chosen, shares[i]))
+		}
+	}
+	rec(0, nil)
+}
+
+func TestShamirCombinations(t *testing.T) {
+	t.Parallel()
+
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+
+	for _, p := range []struct{ n, k int }{{2, 2}, {3, 2}, {5, 3}, {6, 6}, {7, 4}} {
+		t.Run(fmt.Sprintf("%d of %d", p.k, p.n), func(t *testing.T) {
+			t.Parallel()
+
+			shares, err := SplitSecret(secret, p.n, p.k)
+			require.NoError(t, err)
+			require.Len(t, shares, p.n)
+
+			// every subset of threshold size, and every larger one, recovers the secret
+			for size := p.k; size <= p.n; size++ {
+				combinations(shares, size, func(subset []Share) {
+					recovered, err := CombineShares(subset)
+					require.NoError(t, err)
+					require.Equal(t, secret, recovered)
+				})
+			}
+
+			// fewer shares than the threshold are refused
+			combinations(shares, p.k-1, func(subset []Share) {
+				_, err := CombineShares(subset)
+				require.Error(t, err)
+			})
+
+			// lowering the threshold on the shares does not help to recover the secret
+			combinations(shares, p.k-1, func(subset []Share) {
+				if len(subset) < 2 {
+					return
+				}
+				for i := range subset {
+					subset[i].Threshold = p.k - 1
+				}
+				recovered, err := CombineShares(subset)
+				require.NoError(t, err)
+				require.NotEqual(t, secret, recovered)
+			})
+		})
+	}
+}
+
+func TestShamirInvalidParameters(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("secret")
+	_, err := SplitSecret(secret, 3, 1)
+	require.Error(t, err)
+	_, err = SplitSecret(secret, 2, 3)
+	require.Error(t, err)
+	_, err = SplitSecret(secret, 256, 3)
+	require.Error(t, err)
+	_, err = SplitSecret(nil, 3, 2)
+	require.Error(t, err)
+
+	shares, err := SplitSecret(secret, 3, 2)
+	require.NoError(t, err)
+	_, err = CombineShares([]Share{shares[0], shares[0]})
+	require.ErrorContains(t, err, "duplicate share")
+
+	other, err := SplitSecret([]byte("other secret"), 3, 2)
+	require.NoError(t, err)
+	_, err = CombineShares([]Share{shares[0], other[1]})
+	require.ErrorContains(t, err, "different secrets")
+}
+
+func TestShareEncoding(t *testing.T) {
+	t.Parallel()
+
+	shares, err := SplitSecret([]byte("0123456789abcdef0123456789abcdef"), 5, 3)
+	require.NoError(t, err)
+
+	for _, s := range shares {
+		str := s.String()
+		require.Regexp(t, `^[0-9A-Z-]+$`, str)
+
+		parsed, err := ParseShare(str)
+		require.NoError(t, err)
+		require.Equal(t, s, parsed)
+	}
+
+	// a typo in the data is detected by the checksum
+	str := []byte(shares[0].String())
+	i := len("TANG1-3-1-")
+	if str[i] == 'A' {
+		str[i] = 'B'
+	} else {
+		str[i] = 'A'
+	}
+	_, err = ParseShare(string(str))
+	require.ErrorContains(t, err, "checksum mismatch")
+}
+
+func TestSharedBackup(t *testing.T) {
+	t.Parallel()
+
+	s, state := createTestStore(t)
+	backup, shares, err := CreateSharedBackup(s, 5, 3)
+	require.NoError(t, err)
+
+	combinations(shares, 3, func(subset []Share) {
+		target := NewKeyStore(t.TempDir())
+		_, err := RestoreSharedBackup(target, backup, subset, false)
+		require.NoError(t, err)
+		require.Equal(t, state, storeState(t, target))
+	})
+
+	target := NewKeyStore(t.TempDir())
+	_, err = RestoreSharedBackup(target, backup, shares[:2], false)
+	require.Error(t, err)
+
+	// shares of another backup do not decrypt this one
+	_, otherShares, err := CreateSharedBackup(s, 5, 3)
+	require.NoError(t, err)
+	_, err = RestoreSharedBackup(target, backup, otherShares[:3], false)
+	require.ErrorContains(t, err, "unable to decrypt backup")
+}
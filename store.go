@@ -0,0 +1,313 @@
+package tang
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/v3/jwk"
+)
+
+// ThumbprintHash is the hash used for key file names
+const ThumbprintHash = crypto.SHA256
+
+// KeyStore is a directory of Tang keys in the layout used by tangd: every key is stored in its own file
+// named after the key thumbprint, and the files of keys that are not advertised start with a dot.
+type KeyStore struct {
+	Dir string
+	// ThumbprintHashes and RejectDuplicates are set on the loaded key sets
+	ThumbprintHashes []crypto.Hash
+	RejectDuplicates bool
+}
+
+// StoredKey is a key in a KeyStore together with its state
+type StoredKey struct {
+	jwk.Key
+	// Thumbprint is the ThumbprintHash thumbprint of the key
+	Thumbprint string
+	Advertised bool
+	State      KeyState
+	// ApprovalRequired keys recover only after an operator approved the request
+	ApprovalRequired bool
+	Validity         KeyValidity
+	// Filename is the name of the file within the store directory
+	Filename string
+}
+
+// Stronger reports whether the key set keeps this copy of a key over the other one, e.g. the advertised
+// copy over a hidden one
+func (k StoredKey) Stronger(other StoredKey) bool {
+	return strongerStatus(k.Advertised, k.State, other.Advertised, other.State)
+}
+
+// Merge returns the copy of a key the key set keeps of two copies: the stronger one with the approval
+// requirement and the tightest validity bounds of both
+func (k StoredKey) Merge(other StoredKey) StoredKey {
+	merged := k
+	if other.Stronger(k) {
+		merged = other
+	}
+	merged.ApprovalRequired = k.ApprovalRequired || other.ApprovalRequired
+	merged.Validity = k.Validity.Merge(other.Validity)
+	return merged
+}
+
+// NewKeyStore creates a KeyStore for the given directory
+func NewKeyStore(dir string) *KeyStore {
+	return &KeyStore{Dir: dir}
+}
+
+// Keys returns all keys in the store. Files that hold multiple keys produce one entry per key.
+func (s *KeyStore) Keys() ([]StoredKey, error) {
+	ents, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []StoredKey
+	for _, e := range ents {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".jwk") {
+			continue
+		}
+
+		data, err := os.ReadFile(path.Join(s.Dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		set, err := jwk.Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", e.Name(), err)
+		}
+		for i := range set.Len() {
+			key, ok := set.Key(i)
+			if !ok {
+				return nil, fmt.Errorf("unable to get key from set %s", e.Name())
+			}
+			thp, err := thumbprint(key, ThumbprintHash)
+			if err != nil {
+				return nil, err
+			}
+			state, err := KeyStateOf(key)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", e.Name(), err)
+			}
+			approvalRequired, err := ApprovalRequired(key)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", e.Name(), err)
+			}
+			validity, err := KeyValidityOf(key)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", e.Name(), err)
+			}
+			keys = append(keys, StoredKey{
+				Key:              key,
+				Thumbprint:       thp,
+				Advertised:       e.Name()[0] != '.',
+				State:            state,
+				ApprovalRequired: approvalRequired,
+				Validity:         validity,
+				Filename:         e.Name(),
+			})
+		}
+	}
+
+	return keys, nil
+}
+
+// Load reads the keys of the store into a KeySet
+func (s *KeyStore) Load() (*KeySet, error) {
+	ks := NewKeySet()
+	ks.ThumbprintHashes, ks.RejectDuplicates = s.ThumbprintHashes, s.RejectDuplicates
+	if err := ks.Load(s.Dir); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Put stores the key in its own file. If the key is already stored in a file with the canonical name,
+// only its advertised state is updated. The thumbprint of the key is returned.
+func (s *KeyStore) Put(key jwk.Key, advertised bool) (string, error) {
+	thp, err := thumbprint(key, ThumbprintHash)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := s.stat(thp); err == nil {
+		return thp, s.SetAdvertised(thp, advertised)
+	}
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+
+	return thp, writeFileAtomic(path.Join(s.Dir, keyFilename(thp, advertised)), data, 0o440)
+}
+
+// Replace stores the key in its own file like Put, but an existing copy is overwritten, including its
+// state and restrictions. Copies of the key in other files are removed, unless they hold other keys too.
+func (s *KeyStore) Replace(key jwk.Key, advertised bool) (string, error) {
+	thp, err := thumbprint(key, ThumbprintHash)
+	if err != nil {
+		return "", err
+	}
+	stored, err := s.Keys()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	name := keyFilename(thp, advertised)
+	if err := writeFileAtomic(path.Join(s.Dir, name), data, 0o440); err != nil {
+		return "", err
+	}
+
+	perFile := make(map[string]int)
+	for _, k := range stored {
+		perFile[k.Filename]++
+	}
+	for _, k := range stored {
+		if k.Thumbprint != thp || k.Filename == name || perFile[k.Filename] != 1 {
+			continue
+		}
+		if err := os.Remove(path.Join(s.Dir, k.Filename)); err != nil {
+			return "", err
+		}
+	}
+	return thp, nil
+}
+
+// SetAdvertised changes the advertised state of the key with the given thumbprint
+func (s *KeyStore) SetAdvertised(thp string, advertised bool) error {
+	current, err := s.stat(thp)
+	if err != nil {
+		return err
+	}
+	if current == keyFilename(thp, advertised) {
+		return nil
+	}
+	return os.Rename(path.Join(s.Dir, current), path.Join(s.Dir, keyFilename(thp, advertised)))
+}
+
+// SetState changes the lifecycle state of the key with the given thumbprint.
+// Deprecated and revoked keys are hidden as well.
+func (s *KeyStore) SetState(thp string, state KeyState) error {
+	if err := s.update(thp, func(key jwk.Key) error { return setKeyState(key, state) }); err != nil {
+		return err
+	}
+	if state != KeyStateActive {
+		return s.SetAdvertised(thp, false)
+	}
+	return nil
+}
+
+// SetApprovalRequired changes whether recoveries with the key with the given thumbprint need an operator approval
+func (s *KeyStore) SetApprovalRequired(thp string, required bool) error {
+	return s.update(thp, func(key jwk.Key) error { return setApprovalRequired(key, required) })
+}
+
+// SetValidity changes the validity bounds of the key with the given thumbprint. Inconsistent bounds are rejected.
+func (s *KeyStore) SetValidity(thp string, v KeyValidity) error {
+	if err := v.Check(); err != nil {
+		return err
+	}
+	return s.update(thp, func(key jwk.Key) error { return setKeyValidity(key, v) })
+}
+
+// SetMetadata replaces the Tang metadata of the key with the given thumbprint with the one of from.
+// The key is hidden if the new state is not active.
+func (s *KeyStore) SetMetadata(thp string, from jwk.Key) error {
+	state, err := KeyStateOf(from)
+	if err != nil {
+		return err
+	}
+	if err := s.update(thp, func(key jwk.Key) error { return copyPrivateParams(key, from) }); err != nil {
+		return err
+	}
+	if state != KeyStateActive {
+		return s.SetAdvertised(thp, false)
+	}
+	return nil
+}
+
+// update rewrites the file of the key with the given thumbprint after applying the change to the key
+func (s *KeyStore) update(thp string, change func(jwk.Key) error) error {
+	current, err := s.stat(thp)
+	if err != nil {
+		return err
+	}
+	filename := path.Join(s.Dir, current)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	key, err := jwk.ParseKey(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", current, err)
+	}
+	if err := change(key); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(key); err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, data, 0o440)
+}
+
+// Remove deletes the key with the given thumbprint from the store
+func (s *KeyStore) Remove(thp string) error {
+	current, err := s.stat(thp)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path.Join(s.Dir, current))
+}
+
+// stat finds the file of the key with the given thumbprint, files do not have to be named after the key
+func (s *KeyStore) stat(thp string) (string, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return "", err
+	}
+	for _, k := range keys {
+		if k.Thumbprint == thp {
+			return k.Filename, nil
+		}
+	}
+	return "", fmt.Errorf("key '%s' not found", thp)
+}
+
+func keyFilename(thp string, advertised bool) string {
+	if advertised {
+		return thp + ".jwk"
+	}
+	return "." + thp + ".jwk"
+}
+
+// writeFileAtomic writes the file under a temporary name first, so readers never see partial content
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(path.Dir(filename), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,69 @@
+package tang
+
+import (
+	"crypto"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyStore(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	s := NewKeyStore(dir)
+
+	vk, err := GenerateVerifyKey()
+	require.NoError(t, err)
+	ek, err := GenerateExchangeKey()
+	require.NoError(t, err)
+
+	vkThp, err := s.Put(vk, true)
+	require.NoError(t, err)
+	ekThp, err := s.Put(ek, false)
+	require.NoError(t, err)
+
+	require.FileExists(t, path.Join(dir, vkThp+".jwk"))
+	require.FileExists(t, path.Join(dir, "."+ekThp+".jwk"))
+
+	keys, err := s.Keys()
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	for _, k := range keys {
+		switch k.Thumbprint {
+		case vkThp:
+			require.True(t, k.Advertised)
+			require.True(t, jwk.Equal(vk, k.Key))
+		case ekThp:
+			require.False(t, k.Advertised)
+			require.True(t, jwk.Equal(ek, k.Key))
+		default:
+			require.Fail(t, "unexpected key", k.Thumbprint)
+		}
+	}
+
+	// putting the same key again only changes its state
+	_, err = s.Put(ek, true)
+	require.NoError(t, err)
+	require.FileExists(t, path.Join(dir, ekThp+".jwk"))
+	require.NoFileExists(t, path.Join(dir, "."+ekThp+".jwk"))
+
+	s.ThumbprintHashes = []crypto.Hash{crypto.SHA256}
+	ks, err := s.Load()
+	require.NoError(t, err)
+	require.Len(t, ks.keys, 2)
+	require.Equal(t, s.ThumbprintHashes, ks.ThumbprintHashes)
+
+	require.NoError(t, s.SetAdvertised(vkThp, false))
+	require.FileExists(t, path.Join(dir, "."+vkThp+".jwk"))
+
+	require.NoError(t, s.Remove(vkThp))
+	require.ErrorContains(t, s.Remove(vkThp), "not found")
+
+	ents, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, ents, 1)
+}
@@ -0,0 +1,168 @@
+package tang
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/v3/jwk"
+)
+
+// SplitExchangeKey splits the private scalar D of an ECMR exchange key additively into n partial keys,
+// so that D = D_1 + ... + D_n modulo the curve order. This is an experimental threshold mode where every
+// partial key is served by its own Tang instance.
+//
+// The partial keys keep the public part of the original key, so they have the same thumbprints and the
+// advertisement of any instance can be used by unmodified clevis to encrypt. A /rec request answered by
+// an instance yields D_i * X; the results of all instances combined with CombineRecoveredKeys are identical
+// to the recovery performed with the original key.
+func SplitExchangeKey(key jwk.Key, n int) ([]jwk.Key, error) {
+	if n < 2 {
+		return nil, fmt.Errorf("a key has to be split into at least 2 parts")
+	}
+	if !keyValidForUse(key, []jwk.KeyOperation{jwk.KeyOpDeriveKey}) {
+		return nil, fmt.Errorf("not a derive key")
+	}
+	if alg, ok := key.Algorithm(); !ok || alg.String() != "ECMR" {
+		return nil, fmt.Errorf("not an ECMR key")
+	}
+
+	var ecKey ecdsa.PrivateKey
+	if err := jwk.Export(key, &ecKey); err != nil {
+		return nil, err
+	}
+	if ecKey.D == nil {
+		return nil, fmt.Errorf("not a private key")
+	}
+
+	params := ecKey.Curve.Params()
+	size := (params.BitSize + 7) / 8
+	scalars, err := splitScalar(ecKey.D, params.N, n)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]jwk.Key, n)
+	for i, d := range scalars {
+		part, err := key.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if err := part.Set(jwk.ECDSADKey, d.FillBytes(make([]byte, size))); err != nil {
+			return nil, err
+		}
+		parts[i] = part
+	}
+
+	return parts, nil
+}
+
+// splitScalar returns n random non-zero scalars that sum up to d modulo the order
+func splitScalar(d, order *big.Int, n int) ([]*big.Int, error) {
+	limit := new(big.Int).Sub(order, big.NewInt(1))
+	for {
+		scalars := make([]*big.Int, n)
+		rest := new(big.Int).Set(d)
+		for i := range n - 1 {
+			s, err := rand.Int(rand.Reader, limit)
+			if err != nil {
+				return nil, err
+			}
+			scalars[i] = s.Add(s, big.NewInt(1))
+			rest.Sub(rest, s)
+		}
+		// the last scalar makes the sum equal to d, retry in the unlikely case it is zero
+		scalars[n-1] = rest.Mod(rest, order)
+		if scalars[n-1].Sign() != 0 {
+			return scalars, nil
+		}
+	}
+}
+
+// CombineRecoveredKeys sums the EC points recovered from the instances that hold partial keys
+// created by SplitExchangeKey. The result equals the point recovered with the original key.
+func CombineRecoveredKeys(parts ...jwk.Key) (jwk.Key, error) {
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("no recovered keys")
+	}
+
+	var curve elliptic.Curve
+	var x, y *big.Int
+	for _, p := range parts {
+		var pub ecdsa.PublicKey
+		if err := jwk.Export(p, &pub); err != nil {
+			return nil, err
+		}
+		if curve == nil {
+			curve, x, y = pub.Curve, pub.X, pub.Y
+			continue
+		}
+		if pub.Curve != curve {
+			return nil, fmt.Errorf("recovered keys use different curves")
+		}
+		x, y = curve.Add(x, y, pub.X, pub.Y)
+	}
+
+	combined, err := jwk.Import(&ecdsa.PublicKey{Curve: curve, X: x, Y: y})
+	if err != nil {
+		return nil, err
+	}
+	if err := combined.Set(jwk.AlgorithmKey, "ECMR"); err != nil {
+		return nil, err
+	}
+	if err := combined.Set(jwk.KeyOpsKey, jwk.KeyOperationList{jwk.KeyOpDeriveKey}); err != nil {
+		return nil, err
+	}
+	return combined, nil
+}
+
+// ThresholdRecover sends the recovery request to every Tang instance holding a partial key
+// and combines their responses with CombineRecoveredKeys
+func ThresholdRecover(ctx context.Context, urls []string, thp string, webKey jwk.Key) (jwk.Key, error) {
+	body, err := json.Marshal(webKey)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]jwk.Key, len(urls))
+	for i, u := range urls {
+		parts[i], err = recoverFrom(ctx, u, thp, body)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", u, err)
+		}
+	}
+
+	return CombineRecoveredKeys(parts...)
+}
+
+func recoverFrom(ctx context.Context, url, thp string, body []byte) (jwk.Key, error) {
+	url = strings.TrimSuffix(url, "/") + "/rec/" + thp
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/jwk+json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	return jwk.ParseKey(data)
+}
@@ -0,0 +1,118 @@
+package tang
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jws"
+	"github.com/stretchr/testify/require"
+)
+
+func thresholdTestRequest(t *testing.T) jwk.Key {
+	ephemeral, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	require.NoError(t, err)
+	req, err := jwk.Import(&ephemeral.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, req.Set(jwk.AlgorithmKey, "ECMR"))
+	require.NoError(t, req.Set(jwk.KeyOpsKey, []jwk.KeyOperation{jwk.KeyOpDeriveKey}))
+	return req
+}
+
+func TestSplitExchangeKey(t *testing.T) {
+	t.Parallel()
+
+	vk, err := GenerateVerifyKey()
+	require.NoError(t, err)
+	ek, err := GenerateExchangeKey()
+	require.NoError(t, err)
+
+	full := NewKeySet()
+	require.NoError(t, full.AppendKey(vk, true))
+	require.NoError(t, full.AppendKey(ek, true))
+	require.NoError(t, full.RecomputeAdvertisements())
+	fullAdv, err := jws.Parse(full.DefaultAdvertisement)
+	require.NoError(t, err)
+
+	parts, err := SplitExchangeKey(ek, 3)
+	require.NoError(t, err)
+	require.Len(t, parts, 3)
+
+	thp, err := thumbprint(ek, ThumbprintHash)
+	require.NoError(t, err)
+
+	req := thresholdTestRequest(t)
+	expected, err := full.RecoverKey(thp, req)
+	require.NoError(t, err)
+
+	var urls []string
+	var partial []jwk.Key
+	for _, p := range parts {
+		partThp, err := thumbprint(p, ThumbprintHash)
+		require.NoError(t, err)
+		require.Equal(t, thp, partThp)
+
+		ks := NewKeySet()
+		require.NoError(t, ks.AppendKey(vk, true))
+		require.NoError(t, ks.AppendKey(p, true))
+		require.NoError(t, ks.RecomputeAdvertisements())
+
+		// every instance advertises exactly the same public keys as the original
+		adv, err := jws.Parse(ks.DefaultAdvertisement)
+		require.NoError(t, err)
+		require.Equal(t, fullAdv.Payload(), adv.Payload())
+
+		rec, err := ks.RecoverKey(thp, req)
+		require.NoError(t, err)
+		require.False(t, jwk.Equal(expected, rec), "a single instance must not be able to recover the key")
+		partial = append(partial, rec)
+
+		srv := NewServer()
+		srv.Keys = ks
+		ts := httptest.NewServer(srv.Handler)
+		t.Cleanup(ts.Close)
+		urls = append(urls, ts.URL)
+	}
+
+	combined, err := CombineRecoveredKeys(partial...)
+	require.NoError(t, err)
+	require.True(t, jwk.Equal(expected, combined))
+
+	// a subset of the instances does not recover the key
+	subset, err := CombineRecoveredKeys(partial[:2]...)
+	require.NoError(t, err)
+	require.False(t, jwk.Equal(expected, subset))
+
+	recovered, err := ThresholdRecover(context.Background(), urls, thp, req)
+	require.NoError(t, err)
+	require.True(t, jwk.Equal(expected, recovered))
+
+	_, err = ThresholdRecover(context.Background(), urls, "unknown", req)
+	require.Error(t, err)
+}
+
+func TestSplitExchangeKeyInvalid(t *testing.T) {
+	t.Parallel()
+
+	ek, err := GenerateExchangeKey()
+	require.NoError(t, err)
+	_, err = SplitExchangeKey(ek, 1)
+	require.Error(t, err)
+
+	vk, err := GenerateVerifyKey()
+	require.NoError(t, err)
+	_, err = SplitExchangeKey(vk, 2)
+	require.Error(t, err)
+
+	pub, err := jwk.PublicKeyOf(ek)
+	require.NoError(t, err)
+	_, err = SplitExchangeKey(pub, 2)
+	require.Error(t, err)
+
+	_, err = CombineRecoveredKeys()
+	require.Error(t, err)
+}